@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/sergds/autovpn2/internal"
 	"github.com/sergds/autovpn2/internal/client"
+	"github.com/sergds/autovpn2/internal/playbook"
 	"github.com/sergds/autovpn2/internal/rpc"
 	"github.com/sergds/autovpn2/internal/server"
 	"github.com/urfave/cli/v2"
@@ -24,8 +27,14 @@ func main() {
 				Name:    "apply",
 				Aliases: []string{"a", "ap", "app"},
 				Usage:   "Apply local playbook to an autovpn environment.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "detach", Aliases: []string{"d"}, Usage: "Don't wait for it, just start the job on server. Follow it later with attach."},
+				},
 				Action: func(ctx *cli.Context) error {
-					if ctx.NArg() != 0 {
+					if ctx.NArg() != 0 && ctx.Bool("detach") {
+						client.Execute(rpc.TASK_DETACH, append([]string{rpc.TASK_APPLY}, ctx.Args().Slice()...))
+						os.Exit(0)
+					} else if ctx.NArg() != 0 {
 						client.Execute(rpc.TASK_APPLY, ctx.Args().Slice())
 						os.Exit(0)
 					} else {
@@ -34,10 +43,77 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:    "plan",
+				Aliases: []string{"p", "pl"},
+				Usage:   "Show what applying local playbook would change, without changing anything.",
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 0 {
+						client.Execute(rpc.TASK_PLAN, ctx.Args().Slice())
+						os.Exit(0)
+					} else {
+						fmt.Println("Please specify path to a playbook!")
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "validate",
+				Aliases:   []string{"v", "check"},
+				Usage:     "Check local playbooks for mistakes, without talking to a server.",
+				ArgsUsage: "<playbook...>",
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() == 0 {
+						fmt.Println("Please specify path to a playbook!")
+						os.Exit(0)
+					}
+					if !client.Validate(ctx.Args().Slice()) {
+						os.Exit(1)
+					}
+					os.Exit(0)
+					return nil
+				},
+			},
+			{
+				Name:  "schema",
+				Usage: "Print JSON Schema of playbooks, for editors to autocomplete them.",
+				Action: func(ctx *cli.Context) error {
+					schema, err := playbook.JSONSchema()
+					if err != nil {
+						return err
+					}
+					os.Stdout.Write(append(schema, '\n'))
+					os.Exit(0)
+					return nil
+				},
+			},
+			{
+				Name:      "show",
+				Usage:     "Show effective playbook: local file with vars and extends expanded, or playbook stored on an autovpn server.",
+				ArgsUsage: "<playbook file|name>",
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 1 {
+						fmt.Println("Please specify playbook file or name!")
+						os.Exit(0)
+					}
+					if _, err := os.Stat(ctx.Args().First()); err == nil {
+						text, err := playbook.Expand(ctx.Args().First())
+						if err != nil {
+							fmt.Println(err.Error())
+							os.Exit(1)
+						}
+						fmt.Print(text)
+						os.Exit(0)
+					}
+					client.Execute(rpc.TASK_SHOW, ctx.Args().Slice())
+					os.Exit(0)
+					return nil
+				},
+			},
 			{
 				Name:    "list",
 				Aliases: []string{"l", "ls", "lis"},
-				Usage:   "List of applied playbooks on an autovpn server.",
+				Usage:   "List of applied playbooks on an autovpn server, and whether they drifted.",
 				Action: func(ctx *cli.Context) error {
 					client.Execute(rpc.TASK_LIST, ctx.Args().Slice())
 					os.Exit(0)
@@ -58,6 +134,120 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:  "locks",
+				Usage: "List held locks and interrupted jobs on an autovpn server.",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "clear", Usage: "Force-clear a stale lock (or busy mark of a playbook). Same as unlock --force."},
+				},
+				Action: func(ctx *cli.Context) error {
+					args := []string{}
+					if ctx.String("clear") != "" {
+						args = []string{"clear", ctx.String("clear")}
+					}
+					client.Execute(rpc.TASK_LOCKS, args)
+					os.Exit(0)
+					return nil
+				},
+			},
+			{
+				Name:  "jobs",
+				Usage: "List latest jobs on an autovpn server.",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "all", Usage: "List every job server remembers."},
+				},
+				Action: func(ctx *cli.Context) error {
+					args := []string{}
+					if ctx.Bool("all") {
+						args = []string{"all"}
+					}
+					client.Execute(rpc.TASK_JOBS, args)
+					os.Exit(0)
+					return nil
+				},
+			},
+			{
+				Name:      "attach",
+				Usage:     "Show output of a job, and follow it if it's still running.",
+				ArgsUsage: "<job id>",
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 1 {
+						fmt.Println("Please specify job id!")
+						os.Exit(0)
+					}
+					client.Execute(rpc.TASK_ATTACH, ctx.Args().Slice())
+					os.Exit(0)
+					return nil
+				},
+			},
+			{
+				Name:      "gc",
+				Usage:     "Find routes and DNS records left behind by playbooks that aren't installed anymore, and delete them if asked to.",
+				ArgsUsage: "[playbook with adapters to look at, if server's db doesn't know them]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "delete", Usage: "Delete what was found (after confirmation)."},
+					&cli.BoolFlag{Name: "yes", Aliases: []string{"y"}, Usage: "Don't ask for confirmation."},
+				},
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() > 1 {
+						fmt.Println("Expected at most one playbook!")
+						os.Exit(0)
+					}
+					if !ctx.Bool("delete") || !ctx.Bool("yes") {
+						client.Execute(rpc.TASK_GC, append([]string{"dry"}, ctx.Args().Slice()...))
+					}
+					if !ctx.Bool("delete") {
+						fmt.Println("Run with --delete to delete these.")
+						os.Exit(0)
+					}
+					if !ctx.Bool("yes") {
+						fmt.Print("Delete everything listed above? [y/N] ")
+						answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+						if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+							fmt.Println("Not deleting anything.")
+							os.Exit(0)
+						}
+					}
+					client.Execute(rpc.TASK_GC, append([]string{"delete"}, ctx.Args().Slice()...))
+					os.Exit(0)
+					return nil
+				},
+			},
+			{
+				Name:      "unlock",
+				Usage:     "Force-release a lock (or playbook's lock) no matter which job holds it. For locks left by hung jobs.",
+				ArgsUsage: "--force <lock|playbook>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "force", Usage: "Yes, really."},
+				},
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 1 {
+						fmt.Println("Please specify lock or playbook name!")
+						os.Exit(0)
+					}
+					if !ctx.Bool("force") {
+						fmt.Println("Job holding the lock doesn't know it's gone, and will carry on. Use --force if you're sure.")
+						os.Exit(0)
+					}
+					client.Execute(rpc.TASK_UNLOCK, ctx.Args().Slice())
+					os.Exit(0)
+					return nil
+				},
+			},
+			{
+				Name:      "cancel",
+				Usage:     "Cancel running jobs of a playbook (or one job by it's id). Whatever they changed gets rolled back.",
+				ArgsUsage: "<playbook|job id>",
+				Action: func(ctx *cli.Context) error {
+					if ctx.NArg() != 1 {
+						fmt.Println("Please specify playbook name or job id!")
+						os.Exit(0)
+					}
+					client.Execute(rpc.TASK_CANCEL, ctx.Args().Slice())
+					os.Exit(0)
+					return nil
+				},
+			},
 			{
 				Name:    "server",
 				Aliases: []string{"s", "serve", "srv"},
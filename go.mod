@@ -3,18 +3,18 @@ module github.com/sergds/autovpn2
 go 1.22.4
 
 require (
+	github.com/cenkalti/backoff v2.2.1+incompatible
 	github.com/fatih/color v1.17.0
+	github.com/miekg/dns v1.1.27
 	github.com/urfave/cli/v2 v2.27.2
 	google.golang.org/grpc v1.65.0
 	google.golang.org/protobuf v1.34.2
 )
 
 require (
-	github.com/cenkalti/backoff v2.2.1+incompatible // indirect
 	github.com/likexian/gokit v0.25.15 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
-	github.com/miekg/dns v1.1.27 // indirect
 	golang.org/x/crypto v0.23.0 // indirect
 )
 
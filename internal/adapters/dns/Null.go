@@ -3,6 +3,8 @@ package dns
 // Null DNS Adapter (no-op).
 // Usable as a skeleton for new dns adapters for your device/setup.
 
+import "context"
+
 type NullDNS struct {
 }
 
@@ -15,3 +17,4 @@ func (n *NullDNS) GetRecords(dnstype string) ([]DNSRecord, error) { return []DNS
 func (n *NullDNS) AddRecord(record DNSRecord) error               { return nil }                // Add a record to DNS
 func (n *NullDNS) DelRecord(record DNSRecord) error               { return nil }                // Delete a record from DNS
 func (n *NullDNS) CommitRecords() error                           { return nil }                // Like with routers, some DNS setups might not apply changes immediately.
+func (n *NullDNS) SetContext(ctx context.Context)                 {}                            // Requests made after this give up once ctx is cancelled.
@@ -1,6 +1,7 @@
 package dns
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -21,11 +22,16 @@ type PiholeAPI struct {
 	apikey   string
 	endpoint string
 	hclient  *http.Client
+	ctx      context.Context
 }
 
 func newPiholeAPI() *PiholeAPI {
 	jar, _ := cookiejar.New(&cookiejar.Options{})
-	return &PiholeAPI{hclient: &http.Client{Jar: jar}}
+	return &PiholeAPI{hclient: &http.Client{Jar: jar}, ctx: context.Background()}
+}
+
+func (p *PiholeAPI) SetContext(ctx context.Context) {
+	p.ctx = ctx
 }
 
 func (p *PiholeAPI) piholeRequest(args []string) (string, error) {
@@ -39,7 +45,12 @@ func (p *PiholeAPI) piholeRequest(args []string) (string, error) {
 		fmt.Println(err.Error())
 		return "", err
 	}
-	resp, err := p.hclient.Get(requrl)
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodGet, requrl, nil)
+	if err != nil {
+		fmt.Println(err.Error())
+		return "", err
+	}
+	resp, err := p.hclient.Do(req)
 	if err != nil {
 		fmt.Println(err.Error())
 		return "", err
@@ -88,7 +99,11 @@ func (p *PiholeAPI) GetRecords(dnstype string) ([]DNSRecord, error) {
 		arr, _ := rec.Array()
 		d, _ := arr[0].String()
 		a, _ := arr[1].String()
-		finalrecords = append(finalrecords, DNSRecord{Domain: d, Type: "A", Addr: net.ParseIP(a)})
+		addr := net.ParseIP(a)
+		if AddrType(addr) != dnstype { // Pi-hole keeps v4 and v6 ones in the same list.
+			continue
+		}
+		finalrecords = append(finalrecords, DNSRecord{Domain: d, Type: dnstype, Addr: addr})
 	}
 	return finalrecords, nil
 }
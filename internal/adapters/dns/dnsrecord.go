@@ -2,10 +2,23 @@ package dns
 
 import "net"
 
-// An oversimplified representation of a DNS record in a magical world without CNAME, SOA and other nightmares... contains only [A]ddress type, which is just fine for our goals.
+// An oversimplified representation of a DNS record in a magical world without CNAME, SOA and other nightmares... contains only [A]ddress types (A and AAAA), which is just fine for our goals.
 type DNSRecord struct {
 	Domain string `json:"domain"`
 	Type   string `json:"type"`
 	Addr   net.IP `json:"addr"`
 	TTL    int    `json:"ttl"`
 }
+
+// Zone file-ish line, for humans.
+func (r DNSRecord) String() string {
+	return r.Domain + "\tIN\t" + r.Type + "\t" + r.Addr.String()
+}
+
+// Type of record address needs: A for v4, AAAA for v6.
+func AddrType(addr net.IP) string {
+	if addr.To4() == nil {
+		return "AAAA"
+	}
+	return "A"
+}
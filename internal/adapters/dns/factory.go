@@ -3,6 +3,7 @@ package dns
 import "strings"
 
 // Creates adapter from config name. Basically a simple Factory method.
+// nil for names nobody knows, silently routing nothing through Null because of a typo was no fun. Empty name is Null, like it always was.
 func NewDNSAdapter(name string) DNSAdapter {
 	n := strings.ToLower(name)
 	switch n {
@@ -10,14 +11,49 @@ func NewDNSAdapter(name string) DNSAdapter {
 		{
 			return newPiholeAPI()
 		}
-	case "null":
+	case "null", "":
 		{
 			return newNullDNS()
 		}
 	default:
 		{
-			return newNullDNS()
+			return nil
 		}
 	}
-	return nil
+}
+
+// Every adapter there is, for validation and schema.
+var Names = []string{"piholeapi", "null"}
+
+// Adapterconfig keys adapter needs, all of them. ok is false for unknown adapters.
+func ConfigKeys(name string) (keys []string, ok bool) {
+	switch strings.ToLower(name) {
+	case "piholeapi":
+		return []string{"pihole_apikey", "pihole_server"}, true
+	case "null", "":
+		return []string{}, true
+	default:
+		return nil, false
+	}
+}
+
+// Adapterconfig keys that hold credentials. Only these can have ${...} secret references, anything else (origin, for one) could send a secret wherever it points.
+func SecretKeys(name string) []string {
+	switch strings.ToLower(name) {
+	case "piholeapi":
+		return []string{"pihole_apikey"}
+	default:
+		return []string{}
+	}
+}
+
+// What adapter talks to, like "keeneticrci@http://10.0.2.1". Jobs that share it take turns. Empty for adapters that don't talk to anything.
+func Endpoint(name string, conf map[string]string) string {
+	n := strings.ToLower(name)
+	switch n {
+	case "piholeapi":
+		return n + "@" + strings.TrimRight(conf["pihole_server"], "/")
+	default:
+		return ""
+	}
 }
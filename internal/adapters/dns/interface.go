@@ -1,9 +1,12 @@
 package dns
 
+import "context"
+
 type DNSAdapter interface {
 	Authenticate(conf map[string]string) error      // Some DNS setups may require credentials.
-	GetRecords(dnstype string) ([]DNSRecord, error) // Get all records of type
+	GetRecords(dnstype string) ([]DNSRecord, error) // Get all records of type ("A" or "AAAA")
 	AddRecord(record DNSRecord) error               // Add a record to DNS
 	DelRecord(record DNSRecord) error               // Delete a record from DNS
 	CommitRecords() error                           // Like with routers, some DNS setups might not apply changes immediately.
+	SetContext(ctx context.Context)                 // Requests made after this give up once ctx is cancelled.
 }
@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"context"
 	"crypto/md5"
 	"crypto/sha256"
 	"encoding/hex"
@@ -8,8 +9,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
+	"strconv"
 	"strings"
 
 	"github.com/antonholmquist/jason"
@@ -24,11 +27,33 @@ import (
 type KeeneticRCI struct {
 	endpoint string
 	hclient  *http.Client
+	ctx      context.Context
 }
 
 func newKeeneticRCI() *KeeneticRCI {
 	jar, _ := cookiejar.New(&cookiejar.Options{})
-	return &KeeneticRCI{hclient: &http.Client{Jar: jar}}
+	return &KeeneticRCI{hclient: &http.Client{Jar: jar}, ctx: context.Background()}
+}
+
+func (k *KeeneticRCI) SetContext(ctx context.Context) {
+	k.ctx = ctx
+}
+
+func (k *KeeneticRCI) get(url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(k.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return k.hclient.Do(req)
+}
+
+func (k *KeeneticRCI) post(url string, body string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(k.ctx, http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return k.hclient.Do(req)
 }
 
 func (k *KeeneticRCI) Authenticate(conf map[string]string) error {
@@ -37,15 +62,15 @@ func (k *KeeneticRCI) Authenticate(conf map[string]string) error {
 		return errors.New("wrong creds format (expected \"user:password\")")
 	}
 	k.endpoint = conf["keenetic_origin"]
-	resp, err := k.hclient.Get(k.endpoint + "/auth")
+	resp, err := k.get(k.endpoint + "/auth")
 	if err != nil {
 		return err
 	}
 	if resp.StatusCode == 401 {
 		md5h := md5.Sum([]byte(realcreds[0] + ":" + resp.Header.Get("X-NDM-Realm") + ":" + realcreds[1]))
 		sha256h := sha256.Sum256([]byte(resp.Header.Get("X-NDM-Challenge") + hex.EncodeToString(md5h[:])))
-		resp, err := k.hclient.Post(k.endpoint+"/auth", "application/json", strings.NewReader("{\"login\": \""+realcreds[0]+"\", \"password\": \""+hex.EncodeToString(sha256h[:])+"\"}"))
-		if resp.StatusCode == 200 && err == nil {
+		resp, err := k.post(k.endpoint+"/auth", "{\"login\": \""+realcreds[0]+"\", \"password\": \""+hex.EncodeToString(sha256h[:])+"\"}")
+		if err == nil && resp.StatusCode == 200 {
 			return nil // we are in
 		}
 	}
@@ -56,7 +81,7 @@ func (k *KeeneticRCI) Authenticate(conf map[string]string) error {
 }
 
 func (k *KeeneticRCI) GetRoutes() ([]*Route, error) {
-	resp, err := k.hclient.Post(k.endpoint+"/rci/", "application/json", strings.NewReader("{\"show\":{\"ip\":{\"route\":{}},\"ipv6\":{\"route\":{}}}}"))
+	resp, err := k.post(k.endpoint+"/rci/", "{\"show\":{\"ip\":{\"route\":{}},\"ipv6\":{\"route\":{}}}}")
 	if err != nil {
 		return []*Route{}, err
 	}
@@ -76,28 +101,52 @@ func (k *KeeneticRCI) GetRoutes() ([]*Route, error) {
 	routeobj, _ := routearr.Marshal()
 	var v4routes []*Route
 	json.Unmarshal(routeobj, &v4routes)
-	// Strip network prefix. For our goals, raw ip is enough
-	for _, rr := range v4routes {
-		if strings.Contains(rr.Destination, "/") { // Catch v4 prefix
-			rr.Destination = strings.Split(rr.Destination, "/")[0]
+	// v6 ones are optional, router without IPv6 set up may not even answer for them.
+	var v6routes []*Route
+	if routearr, err := respjson.GetValue("show", "ipv6", "route"); err == nil {
+		routeobj, _ := routearr.Marshal()
+		var raw []struct {
+			Route
+			Prefix string `json:"prefix"` // Some firmwares call it that.
+		}
+		json.Unmarshal(routeobj, &raw)
+		for _, r := range raw {
+			if r.Destination == "" {
+				r.Destination = r.Prefix
+			}
+			v6routes = append(v6routes, &Route{Destination: r.Destination, Gateway: r.Gateway, Interface: r.Interface})
 		}
 	}
+	// Split network prefix off, host routes come as /32 (/128) and network ones are ours too now.
+	for _, rr := range append(v4routes, v6routes...) {
+		rr.Destination, rr.Prefix = ParseDestination(rr.Destination)
+	}
 	// Comments are optional and stored separately. Get 'em
-	routes2, err := k.rciRequestGET("ip/route")
+	k.getComments("ip/route", v4routes)
+	k.getComments("ipv6/route", v6routes)
+	return append(v4routes, v6routes...), nil
+}
+
+// Comments only come with config view of routes. Failing to get them isn't fatal, routes just stay without.
+func (k *KeeneticRCI) getComments(path string, routes []*Route) {
+	if len(routes) == 0 {
+		return
+	}
+	routes2, err := k.rciRequestGET(path)
 	if err != nil {
 		fmt.Println("error getting comments: " + err.Error())
-		return v4routes, nil
+		return
 	}
 	//fmt.Println(routes2)
 	routes2_parsed, err := jason.NewValueFromBytes([]byte(routes2))
 	if err != nil {
 		fmt.Println("error parsing routes2: " + err.Error())
-		return v4routes, nil
+		return
 	}
 	routes2_arr, err := routes2_parsed.Array()
 	if err != nil {
 		fmt.Println("error parsing routes2 array: " + err.Error())
-		return v4routes, nil
+		return
 	}
 	for _, r := range routes2_arr {
 		robj, err := r.Object()
@@ -109,28 +158,70 @@ func (k *KeeneticRCI) GetRoutes() ([]*Route, error) {
 		if err != nil {
 			fmt.Println("Failed getting comment")
 		}
-		host, err := robj.GetString("host")
-		if err != nil {
+		var target Route
+		if host, err := robj.GetString("host"); err == nil {
+			target.Destination = host
+		} else if network, err := robj.GetString("network"); err == nil {
+			mask, _ := robj.GetString("mask")
+			target.Destination, target.Prefix = network, maskBits(mask)
+		} else if prefix, err := robj.GetString("prefix"); err == nil { // v6 ones
+			target.Destination, target.Prefix = ParseDestination(prefix)
+		} else {
 			fmt.Println("Failed getting host")
 			continue
 		}
-		for _, rr := range v4routes {
-			if rr.Destination == host {
+		for _, rr := range routes {
+			if rr.Target() == target.Target() {
 				rr.Comment = comment
 			}
 		}
 	}
-	return v4routes, nil
 }
 
 // Some preformatted json ahead. Because arbitrary json handling in Go is kinda PAIN.
+// v6 routes are all prefixes under "ipv6 route", /128 for hosts. v4 ones are either a "host" or a "network" with a "mask".
+
+func isV6(addr string) bool {
+	return strings.Contains(addr, ":")
+}
+
+// 149.154.160.0/20 -> "network": "149.154.160.0", "mask": "255.255.240.0". Or "host": "1.2.3.4", or "prefix": "2001:db8::/32".
+func destinationJSON(route Route) string {
+	if isV6(route.Destination) {
+		prefix := 128
+		if route.IsNetwork() {
+			prefix = route.Prefix
+		}
+		return "\"prefix\": \"" + route.Destination + "/" + strconv.Itoa(prefix) + "\""
+	}
+	if route.IsNetwork() {
+		return "\"network\": \"" + route.Destination + "\", \"mask\": \"" + net.IP(net.CIDRMask(route.Prefix, 32)).String() + "\""
+	}
+	return "\"host\": \"" + route.Destination + "\""
+}
+
+// 255.255.240.0 -> 20.
+func maskBits(mask string) int {
+	ip := net.ParseIP(mask).To4()
+	if ip == nil {
+		return 0
+	}
+	bits, _ := net.IPMask(ip).Size()
+	return bits
+}
 
 func (k *KeeneticRCI) AddRoute(route Route) error {
-	return k.rciRequestJSON("[{\"ip\": {\"route\": {\"comment\": \"" + route.Comment + "\", \"interface\": \"" + route.Interface + "\", \"host\": \"" + route.Destination + "\"}}}]")
+	if isV6(route.Destination) {
+		return k.rciRequestJSON("[{\"ipv6\": {\"route\": {\"comment\": \"" + route.Comment + "\", \"interface\": \"" + route.Interface + "\", " + destinationJSON(route) + "}}}]")
+	}
+	return k.rciRequestJSON("[{\"ip\": {\"route\": {\"comment\": \"" + route.Comment + "\", \"interface\": \"" + route.Interface + "\", " + destinationJSON(route) + "}}}]")
 
 }
 func (k *KeeneticRCI) DelRoute(route Route) error {
-	return k.rciRequestJSON("[{\"ip\": {\"route\": {\"interface\": \"" + route.Interface + "\", \"host\": \"" + route.Destination + "\", \"no\": \"true\", \"name\": \"" + route.Interface + "\"}}}]")
+	if isV6(route.Destination) {
+		return k.rciRequestJSON("[{\"ipv6\": {\"route\": {\"interface\": \"" + route.Interface + "\", " + destinationJSON(route) + ", \"no\": \"true\"}}}]")
+	}
+	return k.rciRequestJSON("[{\"ip\": {\"route\": {\"interface\": \"" + route.Interface + "\", " + destinationJSON(route) + ", \"no\": \"true\", \"name\": \"" + route.Interface + "\"}}}]")
 }
 
 func (k *KeeneticRCI) SaveConfig() error {
@@ -138,7 +229,7 @@ func (k *KeeneticRCI) SaveConfig() error {
 }
 
 func (k *KeeneticRCI) rciRequestJSON(contents string) error {
-	resp, err := k.hclient.Post(k.endpoint+"/rci/", "application/json", strings.NewReader(contents))
+	resp, err := k.post(k.endpoint+"/rci/", contents)
 	if err != nil {
 		fmt.Println(err.Error())
 		return err
@@ -180,7 +271,7 @@ func (k *KeeneticRCI) rciRequestJSON(contents string) error {
 // RCI allows GET requests with url path acting as a show command. These contain additional info for web ui.
 // Route comments can only be retrieved this way.
 func (k *KeeneticRCI) rciRequestGET(path string) (string, error) {
-	resp, err := k.hclient.Get(k.endpoint + "/rci/" + path)
+	resp, err := k.get(k.endpoint + "/rci/" + path)
 	if err != nil {
 		fmt.Println(err.Error())
 		return "", err
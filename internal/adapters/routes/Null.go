@@ -3,6 +3,8 @@ package routes
 // Null Routes Adapter (no-op).
 // Usable as a skeleton for new dns adapters for your device/setup.
 
+import "context"
+
 type NullRoutes struct {
 }
 
@@ -15,3 +17,4 @@ func (nr *NullRoutes) GetRoutes() ([]*Route, error)              { return []*Rou
 func (nr *NullRoutes) AddRoute(route Route) error                { return nil }             // Add a route. Some fancy routers allow adding text comments to routes for WebUI as well.
 func (nr *NullRoutes) DelRoute(route Route) error                { return nil }             // Delete a route from the routing table
 func (nr *NullRoutes) SaveConfig() error                         { return nil }             // Some(Probably most) routers don't commit config changes immediately to non-volatile storage. So this should be called before exit.
+func (nr *NullRoutes) SetContext(ctx context.Context)            {}                         // Requests made after this give up once ctx is cancelled.
@@ -3,15 +3,51 @@ package routes
 import "strings"
 
 // Creates adapter from config name. Basically a simple Factory method.
+// nil for names nobody knows, see dns.NewDNSAdapter.
 func NewRouteAdapter(name string) RouteAdapter {
 	n := strings.ToLower(name)
 	switch n {
 	case "keeneticrci":
 		return newKeeneticRCI()
-	case "null":
+	case "null", "":
 		return newNullRoutes()
 	default:
-		return newNullRoutes()
+		return nil
+	}
+}
+
+// Every adapter there is, for validation and schema.
+var Names = []string{"keeneticrci", "null"}
+
+// Adapterconfig keys adapter needs, all of them. ok is false for unknown adapters.
+func ConfigKeys(name string) (keys []string, ok bool) {
+	switch strings.ToLower(name) {
+	case "keeneticrci":
+		return []string{"keenetic_login", "keenetic_origin"}, true
+	case "null", "":
+		return []string{}, true
+	default:
+		return nil, false
+	}
+}
+
+// Adapterconfig keys that hold credentials. Only these can have ${...} secret references, anything else (origin, for one) could send a secret wherever it points.
+func SecretKeys(name string) []string {
+	switch strings.ToLower(name) {
+	case "keeneticrci":
+		return []string{"keenetic_login"}
+	default:
+		return []string{}
+	}
+}
+
+// What adapter talks to, like "keeneticrci@http://10.0.2.1". Jobs that share it take turns. Empty for adapters that don't talk to anything.
+func Endpoint(name string, conf map[string]string) string {
+	n := strings.ToLower(name)
+	switch n {
+	case "keeneticrci":
+		return n + "@" + strings.TrimRight(conf["keenetic_origin"], "/")
+	default:
+		return ""
 	}
-	return nil
 }
@@ -1,9 +1,12 @@
 package routes
 
+import "context"
+
 type RouteAdapter interface {
 	Authenticate(conf map[string]string) error // Creds and endpoint are specific to implementation
 	GetRoutes() ([]*Route, error)              // Get all routes from device's routing table.
 	AddRoute(route Route) error                // Add a route. Some fancy routers allow adding text comments to routes for WebUI as well.
 	DelRoute(route Route) error                // Delete a route from the routing table
 	SaveConfig() error                         // Some(Probably most) routers don't commit config changes immediately to non-volatile storage. So this should be called before exit.
+	SetContext(ctx context.Context)            // Requests made after this give up once ctx is cancelled. Job's context goes here, so cancelled jobs don't keep poking the router.
 }
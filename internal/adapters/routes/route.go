@@ -1,9 +1,42 @@
 package routes
 
+import (
+	"strconv"
+	"strings"
+)
+
 // Represents an IP route for our needs. Based on keenetic representation, which is probably bad for compatability.
 type Route struct {
 	Destination string `json:"destination"`
 	Gateway     string `json:"gateway"`
 	Interface   string `json:"interface"`
 	Comment     string `json:"comment"`
+	Prefix      int    `json:"-"` // Prefix length of network routes. 0 (or /32, /128) is a route to a single host.
+}
+
+// Whether route goes to a whole network rather than one host.
+func (r Route) IsNetwork() bool {
+	full := 32
+	if strings.Contains(r.Destination, ":") {
+		full = 128
+	}
+	return r.Prefix != 0 && r.Prefix != full
+}
+
+// Where route goes, in a form fit for comparing routes: plain address for hosts, address/length for networks.
+func (r Route) Target() string {
+	if !r.IsNetwork() {
+		return r.Destination
+	}
+	return r.Destination + "/" + strconv.Itoa(r.Prefix)
+}
+
+// Splits "addr/len" into parts. No prefix length means a host route.
+func ParseDestination(dest string) (string, int) {
+	addr, bits, found := strings.Cut(dest, "/")
+	if !found {
+		return dest, 0
+	}
+	prefix, _ := strconv.Atoi(bits)
+	return addr, prefix
 }
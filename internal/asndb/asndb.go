@@ -0,0 +1,220 @@
+package asndb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sergds/autovpn2/internal/playbook"
+)
+
+// Offline ASN -> announced prefixes database. No BGP sessions, no whois, just a dump file somebody (or RefreshLoop) keeps fresh.
+// Understood formats, one entry per line, gzipped or not:
+//   - ip2asn TSV (iptoasn.com): range_start<TAB>range_end<TAB>AS_number<TAB>...
+//   - CSV: prefix,AS_number (149.154.160.0/20,62041). "AS" in front of the number is fine too.
+//
+// Lines starting with # and AS number 0 ("not routed") are skipped. File is reloaded whenever it's mtime changes.
+type DB struct {
+	path   string
+	mu     sync.Mutex
+	mtime  time.Time
+	ranges map[uint32][]span
+}
+
+type span struct {
+	start netip.Addr
+	end   netip.Addr
+}
+
+func Open(path string) *DB {
+	return &DB{path: path}
+}
+
+func trimAS(s string) string {
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		return s[2:]
+	}
+	return s
+}
+
+// Prefixes announced by asn. Neighbouring and overlapping ones are merged, so that the router gets as few routes as possible.
+func (db *DB) Prefixes(asn uint32) ([]netip.Prefix, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.reload(); err != nil {
+		return nil, err
+	}
+	spans := db.ranges[asn]
+	prefixes := make([]netip.Prefix, 0)
+	for _, s := range spans {
+		prefixes = append(prefixes, playbook.RangePrefixes(s.start, s.end)...)
+	}
+	return prefixes, nil
+}
+
+func (db *DB) reload() error {
+	st, err := os.Stat(db.path)
+	if err != nil {
+		return errors.New("asn db: " + err.Error())
+	}
+	if db.ranges != nil && st.ModTime().Equal(db.mtime) {
+		return nil
+	}
+	f, err := os.Open(db.path)
+	if err != nil {
+		return errors.New("asn db: " + err.Error())
+	}
+	defer f.Close()
+	ranges, err := parse(f)
+	if err != nil {
+		return errors.New("asn db: " + err.Error())
+	}
+	db.ranges, db.mtime = ranges, st.ModTime()
+	log.Printf("asn db: loaded %v ASNs from %s", len(ranges), db.path)
+	return nil
+}
+
+func parse(r io.Reader) (map[uint32][]span, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	ranges := make(map[uint32][]span)
+	sc := bufio.NewScanner(br)
+	lineno := 0
+	for sc.Scan() {
+		lineno++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s, asn, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %s", lineno, err)
+		}
+		if asn != 0 {
+			ranges[asn] = append(ranges[asn], s)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for asn, spans := range ranges {
+		ranges[asn] = merge(spans)
+	}
+	return ranges, nil
+}
+
+func parseLine(line string) (span, uint32, error) {
+	if fields := strings.Split(line, "\t"); len(fields) >= 3 { // ip2asn
+		start, err1 := netip.ParseAddr(fields[0])
+		end, err2 := netip.ParseAddr(fields[1])
+		asn, err3 := strconv.ParseUint(trimAS(fields[2]), 10, 32)
+		if err1 != nil || err2 != nil || err3 != nil || start.Is4() != end.Is4() || end.Less(start) {
+			return span{}, 0, errors.New("bad ip2asn entry")
+		}
+		return span{start, end}, uint32(asn), nil
+	}
+	prefix, asnstr, found := strings.Cut(line, ",")
+	if !found {
+		return span{}, 0, errors.New("neither ip2asn nor prefix,asn")
+	}
+	p, err := netip.ParsePrefix(strings.TrimSpace(prefix))
+	if err != nil {
+		return span{}, 0, err
+	}
+	asn, err := strconv.ParseUint(trimAS(strings.TrimSpace(asnstr)), 10, 32)
+	if err != nil {
+		return span{}, 0, err
+	}
+	p = p.Masked()
+	return span{p.Addr(), playbook.LastAddr(p)}, uint32(asn), nil
+}
+
+// Sorts spans and glues together ones that touch or overlap.
+func merge(spans []span) []span {
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start.Less(spans[j].start) })
+	merged := make([]span, 0, len(spans))
+	for _, s := range spans {
+		if n := len(merged); n != 0 {
+			last := &merged[n-1]
+			if last.end.Is4() == s.start.Is4() && (s.start.Compare(last.end) <= 0 || s.start == last.end.Next()) {
+				if last.end.Less(s.end) {
+					last.end = s.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// Downloads url over db's file every so often, so that nobody has to cron it. Goes through a temp file, half downloaded db is worse than an old one.
+func (db *DB) RefreshLoop(url string, every time.Duration) {
+	for {
+		if err := db.download(url); err != nil {
+			log.Println("asn db: refresh failed: " + err.Error())
+		}
+		time.Sleep(every)
+	}
+}
+
+func (db *DB) download(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return errors.New("non 200 status code")
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(db.path), ".asndb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// Don't replace a good db with something we can't read.
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	_, err = parse(f)
+	f.Close()
+	if err != nil {
+		return errors.New("downloaded db is broken: " + err.Error())
+	}
+	return os.Rename(tmp.Name(), db.path)
+}
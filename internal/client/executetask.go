@@ -6,6 +6,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/fatih/color"
@@ -18,7 +20,6 @@ import (
 func Execute(task string, argv []string) {
 	var summary []string = make([]string, 0)
 
-	args := argv
 	sp := fastansi.NewStatusPrinter()
 	conn := ConnectToServer(sp)
 	sp.Status(3, color.GreenString("Connected to AutoVPN @ "+conn.Target()))
@@ -30,39 +31,58 @@ func Execute(task string, argv []string) {
 	defer conn.Close()
 	c := pb.NewAutoVPNClient(conn)
 
-	switch task {
-	case pb.TASK_APPLY:
+	// Detached task is sent as "detach <task> <args...>", prepare inner task's args all the same.
+	// Playbook paths get replaced with what's in them, in a copy. argv stays as caller gave it.
+	inner, args := task, slices.Clone(argv)
+	if task == pb.TASK_DETACH {
+		inner, args = argv[0], slices.Clone(argv[1:])
+	}
+	switch inner {
+	case pb.TASK_APPLY, pb.TASK_PLAN:
 		{
-			pbc, err := os.ReadFile(args[0])
+			pbc, err := playbook.Expand(args[0])
 			if err != nil {
 				fmt.Println(err.Error())
 				os.Exit(0)
 			}
-			args[0] = string(pbc)
-			sp.Status(2, color.WhiteString("Applying playbook..."))
-
+			args[0] = pbc
+			if inner == pb.TASK_PLAN {
+				sp.Status(2, color.WhiteString("Planning playbook..."))
+			} else {
+				sp.Status(2, color.WhiteString("Applying playbook..."))
+			}
 		}
+	case pb.TASK_GC:
+		if len(args) == 2 { // Playbook to take adapters from.
+			pbc, err := playbook.Expand(args[1])
+			if err != nil {
+				fmt.Println(err.Error())
+				os.Exit(0)
+			}
+			args[1] = pbc
+		}
+		sp.Status(2, color.WhiteString("Looking for garbage..."))
 	case pb.TASK_UNDO:
 		pbname := args[0]
-		// check if this is a filename
-		if f, err := os.Open(pbname); err != nil {
-			b, err := io.ReadAll(f)
-			if err == nil {
-				pb, err := playbook.Parse(string(b))
-				if err != nil {
-					pbname = pb.Name
+		// Playbook file instead of a name: name is whatever it says inside (after templates and extends), or file's name if it doesn't parse.
+		if st, err := os.Stat(pbname); err == nil && !st.IsDir() {
+			pbname = strings.TrimSuffix(filepath.Base(pbname), filepath.Ext(pbname))
+			if pbc, err := playbook.Expand(args[0]); err == nil {
+				if pbook, err := playbook.Parse(pbc); err == nil && pbook.Name != "" {
+					pbname = pbook.Name
 				}
 			}
 		}
-		// post process (a possible file name)
-		pbname = strings.Split(pbname, string(os.PathSeparator))[len(strings.Split(pbname, string(os.PathSeparator)))-1]
-		pbname = strings.Split(pbname, ".")[0]
 		args[0] = pbname
 		sp.Status(2, color.WhiteString("Undoing playbook..."))
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	ss, err := c.ExecuteTask(ctx, &pb.ExecuteRequest{Operation: task, Argv: args})
+	forward := args
+	if task == pb.TASK_DETACH {
+		forward = append([]string{inner}, args...)
+	}
+	ss, err := c.ExecuteTask(ctx, &pb.ExecuteRequest{Operation: task, Argv: forward})
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
@@ -86,6 +106,9 @@ func Execute(task string, argv []string) {
 				sp.Status(1, color.BlueString(*status.Opdesc))
 				continue
 			}
+		case pb.STEP_RETRY:
+			sp.Status(1, color.YellowString("Retrying..."))
+			summary = append(summary, color.YellowString(*status.Opdesc))
 		case pb.STEP_PUSH_SUMMARY:
 			summary = append(summary, *status.Opdesc)
 		default:
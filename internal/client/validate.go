@@ -0,0 +1,40 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/sergds/autovpn2/internal/playbook"
+)
+
+// Checks playbook files without bothering the server. What only server can tell (profiles, ASN db, DNS proxy) is checked on apply and plan.
+// Returns whether all of them are fine.
+func Validate(paths []string) bool {
+	ok := true
+	for _, path := range paths {
+		if err := validateFile(path); err != nil {
+			ok = false
+			fmt.Println(color.RedString(path + ":"))
+			for _, line := range strings.Split(err.Error(), "\n") {
+				fmt.Println("  " + line)
+			}
+			continue
+		}
+		fmt.Println(color.GreenString(path + ": OK"))
+	}
+	return ok
+}
+
+func validateFile(path string) error {
+	text, err := playbook.Expand(path)
+	if err != nil {
+		return err
+	}
+	pbook, err := playbook.Parse(text)
+	if err != nil {
+		return errors.New("can't parse: " + err.Error())
+	}
+	return pbook.Validate()
+}
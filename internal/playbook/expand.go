@@ -0,0 +1,160 @@
+package playbook
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Playbooks for different tunnels tend to be copies of each other. So a playbook can take everything from another one and change what it needs:
+//
+//	extends: base.yaml # Relative to the playbook itself. Base can extend something too.
+//	vars:
+//	  iface: OpenVPN0
+//	  region: us
+//	interface: "{{ .iface }}"
+//
+// Mappings are merged key by key (playbook's keys win), anything else (hosts, for one) is replaced as a whole.
+// Every string in the result is then a Go template, executed with vars of the whole chain, so base can use vars it's children set.
+// YAML wants values starting with {{ quoted. All of this happens on client, server only ever gets (and keeps) the result.
+func Expand(path string) (string, error) {
+	files := make(map[*yaml.Node]string)
+	root, err := loadExtended(path, nil, files)
+	if err != nil {
+		return "", err
+	}
+	vars := make(map[string]any)
+	if node := takeKey(root, "vars"); node != nil {
+		if err := node.Decode(&vars); err != nil {
+			return "", fmt.Errorf("%s: vars: %s", path, err)
+		}
+	}
+	if err := render(root, vars, files); err != nil {
+		return "", err
+	}
+	out := &bytes.Buffer{}
+	enc := yaml.NewEncoder(out)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Playbook at path merged over whatever it extends. seen is the chain so far, so that loops don't go forever.
+// files remembers which file every node came from, for errors to point at the right one.
+func loadExtended(path string, seen []string, files map[*yaml.Node]string) (*yaml.Node, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(seen, abs) {
+		return nil, errors.New("extends goes in circles: " + strings.Join(append(seen, abs), " -> "))
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(b, doc); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, errors.New(path + ": playbook is empty")
+	}
+	var probe any
+	if err := doc.Decode(&probe); err != nil { // Node doesn't mind keys repeating, anything else does.
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	walk(doc, func(n *yaml.Node) { files[n] = path })
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, errors.New(path + ": playbook is not a mapping")
+	}
+	ext := takeKey(root, "extends")
+	if ext == nil {
+		return root, nil
+	}
+	if ext.Kind != yaml.ScalarNode || ext.Value == "" {
+		return nil, fmt.Errorf("%s:%v: extends should be a path to playbook", path, ext.Line)
+	}
+	basePath := ext.Value
+	if !filepath.IsAbs(basePath) {
+		basePath = filepath.Join(filepath.Dir(path), basePath)
+	}
+	base, err := loadExtended(basePath, append(seen, abs), files)
+	if err != nil {
+		return nil, err
+	}
+	return merge(base, root), nil
+}
+
+// Removes key from mapping, returning it's value. nil if there's no such key.
+func takeKey(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			value := mapping.Content[i+1]
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return value
+		}
+	}
+	return nil
+}
+
+func walk(node *yaml.Node, fn func(*yaml.Node)) {
+	fn(node)
+	for _, child := range node.Content {
+		walk(child, fn)
+	}
+}
+
+func merge(base *yaml.Node, over *yaml.Node) *yaml.Node {
+	if base.Kind != yaml.MappingNode || over.Kind != yaml.MappingNode {
+		return over
+	}
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: base.Tag, Content: slices.Clone(base.Content)}
+	for i := 0; i+1 < len(over.Content); i += 2 {
+		key, value := over.Content[i], over.Content[i+1]
+		found := false
+		for j := 0; j+1 < len(merged.Content); j += 2 {
+			if merged.Content[j].Value == key.Value {
+				merged.Content[j+1] = merge(merged.Content[j+1], value)
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged.Content = append(merged.Content, key, value)
+		}
+	}
+	return merged
+}
+
+// Executes every string with templates in it. Missing vars are an error, an empty interface because of a typo is no better than a typo itself.
+func render(node *yaml.Node, vars map[string]any, files map[*yaml.Node]string) error {
+	if node.Kind == yaml.ScalarNode && strings.Contains(node.Value, "{{") {
+		tmpl, err := template.New("").Option("missingkey=error").Parse(node.Value)
+		if err != nil {
+			return fmt.Errorf("%s:%v: %s", files[node], node.Line, err)
+		}
+		out := &bytes.Buffer{}
+		if err := tmpl.Execute(out, vars); err != nil {
+			return fmt.Errorf("%s:%v: %s", files[node], node.Line, err)
+		}
+		// Whatever it became decides it's type, "{{ .hours }}" can be an int.
+		node.Value, node.Tag, node.Style = out.String(), "", 0
+	}
+	for _, child := range node.Content {
+		if err := render(child, vars, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package playbook
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string // Playbook is main.yaml.
+		check   func(t *testing.T, pb *Playbook)
+		wantErr string // Part of the error, "" for none.
+	}{
+		{
+			name: "vars",
+			files: map[string]string{"main.yaml": `name: test
+vars: {iface: OpenVPN0, hours: 6}
+interface: "{{ .iface }}"
+autoupdateinterval: "{{ .hours }}"
+hosts: [a.com]
+`},
+			check: func(t *testing.T, pb *Playbook) {
+				if pb.Interface != "OpenVPN0" || pb.Autoupdateinterval != 6 {
+					t.Errorf("interface = %q, autoupdateinterval = %v, want OpenVPN0 and 6", pb.Interface, pb.Autoupdateinterval)
+				}
+			},
+		},
+		{
+			name: "extends merges mappings and replaces lists",
+			files: map[string]string{
+				"base.yaml": `adapters: {routes: keeneticrci, dns: piholeapi}
+adapterconfig:
+  routes: {keenetic_origin: "http://{{ .router }}", keenetic_login: "admin:x"}
+interface: Wireguard1
+hosts: [base.com]
+`,
+				"main.yaml": `extends: base.yaml
+vars: {router: 10.0.2.1}
+name: test
+adapterconfig:
+  routes: {keenetic_login: "admin:y"}
+hosts: [a.com, b.com]
+`,
+			},
+			check: func(t *testing.T, pb *Playbook) {
+				if pb.Adapters.Routes != "keeneticrci" || pb.Interface != "Wireguard1" {
+					t.Errorf("adapters = %+v, interface = %q, want ones from base", pb.Adapters, pb.Interface)
+				}
+				if pb.Adapterconfig.Routes["keenetic_origin"] != "http://10.0.2.1" || pb.Adapterconfig.Routes["keenetic_login"] != "admin:y" {
+					t.Errorf("routes adapterconfig = %v, want base's origin with child's var and child's login", pb.Adapterconfig.Routes)
+				}
+				if !slices.Equal(pb.Hosts, []string{"a.com", "b.com"}) {
+					t.Errorf("hosts = %v, want child's", pb.Hosts)
+				}
+			},
+		},
+		{
+			name: "extends chain",
+			files: map[string]string{
+				"a.yaml":    "interface: Wireguard1\nhosts: [a.com]\n",
+				"b.yaml":    "extends: a.yaml\nhosts: [b.com]\n",
+				"main.yaml": "extends: b.yaml\nname: test\n",
+			},
+			check: func(t *testing.T, pb *Playbook) {
+				if pb.Interface != "Wireguard1" || !slices.Equal(pb.Hosts, []string{"b.com"}) {
+					t.Errorf("interface = %q, hosts = %v, want Wireguard1 and [b.com]", pb.Interface, pb.Hosts)
+				}
+			},
+		},
+		{
+			name: "extends loop",
+			files: map[string]string{
+				"a.yaml":    "extends: main.yaml\n",
+				"main.yaml": "extends: a.yaml\nname: test\n",
+			},
+			wantErr: "goes in circles",
+		},
+		{
+			name:    "missing var",
+			files:   map[string]string{"main.yaml": "name: test\ninterface: \"{{ .iface }}\"\n"},
+			wantErr: "main.yaml:2",
+		},
+		{
+			name:    "missing base",
+			files:   map[string]string{"main.yaml": "extends: nope.yaml\nname: test\n"},
+			wantErr: "nope.yaml",
+		},
+		{
+			name:    "not a mapping",
+			files:   map[string]string{"main.yaml": "- a.com\n"},
+			wantErr: "not a mapping",
+		},
+		{
+			name:    "repeated key",
+			files:   map[string]string{"main.yaml": "name: a\nname: b\n"},
+			wantErr: "already defined",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, text := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			out, err := Expand(filepath.Join(dir, "main.yaml"))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			pb, err := Parse(out) // Whatever Expand gives has to be a playbook as is, vars and extends gone.
+			if err != nil {
+				t.Fatalf("expanded playbook doesn't parse: %v\n%s", err, out)
+			}
+			tt.check(t, pb)
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package playbook
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+)
+
+// Playbooks are stored in db as gob, and gob refuses to decode a field into a different type. Old revisions of playbook live here.
+
+// Playbook as it was before hosts could have several addresses: PlaybookAddrs was host -> address.
+// Built from Playbook itself, so it doesn't need to be kept in sync by hand when new fields come along.
+var playbookV1 = func() reflect.Type {
+	t := reflect.TypeOf(Playbook{})
+	fields := make([]reflect.StructField, t.NumField())
+	for i := range fields {
+		fields[i] = t.Field(i)
+		if fields[i].Name == "PlaybookAddrs" {
+			fields[i].Type = reflect.TypeOf(map[string]string{})
+		}
+	}
+	return reflect.StructOf(fields)
+}()
+
+// Decodes playbook from db, whatever revision it was stored as. migrated tells if it was an old one, so it's worth writing back.
+func DecodeGob(b []byte) (pb *Playbook, migrated bool, err error) {
+	pb = &Playbook{}
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(pb)
+	if err == nil {
+		return pb, false, nil
+	}
+	old := reflect.New(playbookV1)
+	if gob.NewDecoder(bytes.NewReader(b)).Decode(old.Interface()) != nil {
+		return nil, false, err // Not an old one either. Tell about what's wrong with it as a new one.
+	}
+	pb = &Playbook{}
+	cur := reflect.ValueOf(pb).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		if cur.Type().Field(i).Name != "PlaybookAddrs" {
+			cur.Field(i).Set(old.Elem().Field(i))
+		}
+	}
+	if addrs := old.Elem().FieldByName("PlaybookAddrs").Interface().(map[string]string); addrs != nil {
+		pb.PlaybookAddrs = make(map[string][]string)
+		for host, addr := range addrs {
+			pb.PlaybookAddrs[host] = []string{addr}
+		}
+	}
+	return pb, true, nil
+}
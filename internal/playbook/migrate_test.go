@@ -0,0 +1,85 @@
+package playbook
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func gobOf(t *testing.T, v any) []byte {
+	t.Helper()
+	b := &bytes.Buffer{}
+	if err := gob.NewEncoder(b).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// Playbook the way revision 1 stored it.
+func v1Playbook(t *testing.T, name string, addrs map[string]string) []byte {
+	t.Helper()
+	old := reflect.New(playbookV1)
+	old.Elem().FieldByName("Name").SetString(name)
+	old.Elem().FieldByName("Interface").SetString("Wireguard1")
+	old.Elem().FieldByName("Hosts").Set(reflect.ValueOf([]string{"a.com", "b.com"}))
+	old.Elem().FieldByName("PlaybookAddrs").Set(reflect.ValueOf(addrs))
+	return gobOf(t, old.Interface())
+}
+
+func TestDecodeGob(t *testing.T) {
+	tests := []struct {
+		name         string
+		gob          func(t *testing.T) []byte
+		wantMigrated bool
+		wantAddrs    map[string][]string
+		wantErr      bool
+	}{
+		{
+			name: "current",
+			gob: func(t *testing.T) []byte {
+				return gobOf(t, &Playbook{Name: "test", Interface: "Wireguard1", Hosts: []string{"a.com", "b.com"}, PlaybookAddrs: map[string][]string{"a.com": {"1.1.1.1", "1.1.1.2"}}})
+			},
+			wantAddrs: map[string][]string{"a.com": {"1.1.1.1", "1.1.1.2"}},
+		},
+		{
+			name: "v1",
+			gob: func(t *testing.T) []byte {
+				return v1Playbook(t, "test", map[string]string{"a.com": "1.1.1.1", "b.com": "2.2.2.2"})
+			},
+			wantMigrated: true,
+			wantAddrs:    map[string][]string{"a.com": {"1.1.1.1"}, "b.com": {"2.2.2.2"}},
+		},
+		{
+			name:         "v1 never applied",
+			gob:          func(t *testing.T) []byte { return v1Playbook(t, "test", nil) },
+			wantMigrated: true,
+		},
+		{
+			name:    "garbage",
+			gob:     func(t *testing.T) []byte { return []byte("definitely not gob") },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pb, migrated, err := DecodeGob(tt.gob(t))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if migrated != tt.wantMigrated {
+				t.Errorf("migrated = %v, want %v", migrated, tt.wantMigrated)
+			}
+			if pb.Name != "test" || pb.Interface != "Wireguard1" || !slices.Equal(pb.Hosts, []string{"a.com", "b.com"}) {
+				t.Errorf("got %q, %q, %v, want the rest of playbook kept as is", pb.Name, pb.Interface, pb.Hosts)
+			}
+			if !reflect.DeepEqual(pb.PlaybookAddrs, tt.wantAddrs) {
+				t.Errorf("PlaybookAddrs = %v, want %v", pb.PlaybookAddrs, tt.wantAddrs)
+			}
+		})
+	}
+}
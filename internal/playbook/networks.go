@@ -0,0 +1,88 @@
+package playbook
+
+import (
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Hosts that are whole networks instead of names: "149.154.160.0/20" or "91.108.4.0-91.108.23.255".
+// Ranges get cut into as few prefixes as they fit in, routers only know prefixes. ok is false for anything else (domains, single addresses).
+func ParseNetwork(host string) (prefixes []netip.Prefix, ok bool, err error) {
+	if strings.Contains(host, "/") { // No domain has a slash in it.
+		p, err := netip.ParsePrefix(host)
+		if err != nil {
+			return nil, true, errors.New("bad network " + host + ": " + err.Error())
+		}
+		if p.Bits() == 0 {
+			return nil, true, errors.New("bad network " + host + ": that's a default route, set it on the router instead")
+		}
+		return []netip.Prefix{p.Masked()}, true, nil
+	}
+	from, to, found := strings.Cut(host, "-")
+	if !found {
+		return nil, false, nil
+	}
+	start, err1 := netip.ParseAddr(from)
+	end, err2 := netip.ParseAddr(to)
+	if err1 != nil || err2 != nil { // Just a domain with a dash in it.
+		return nil, false, nil
+	}
+	start, end = start.Unmap(), end.Unmap()
+	if start.Is4() != end.Is4() {
+		return nil, true, errors.New("bad range " + host + ": mixes v4 and v6")
+	}
+	if end.Less(start) {
+		return nil, true, errors.New("bad range " + host + ": ends before it starts")
+	}
+	prefixes = RangePrefixes(start.WithZone(""), end.WithZone(""))
+	if prefixes[0].Bits() == 0 {
+		return nil, true, errors.New("bad range " + host + ": that's a default route, set it on the router instead")
+	}
+	return prefixes, true, nil
+}
+
+// Prefixes covering start..end exactly. Biggest aligned block starting at start that doesn't run past end, then the same from where it ended. Until end.
+func RangePrefixes(start netip.Addr, end netip.Addr) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0)
+	for {
+		p := netip.PrefixFrom(start, start.BitLen())
+		for p.Bits() > 0 {
+			wider := netip.PrefixFrom(start, p.Bits()-1).Masked()
+			if wider.Addr() != start || LastAddr(wider).Compare(end) > 0 {
+				break
+			}
+			p = wider
+		}
+		prefixes = append(prefixes, p)
+		last := LastAddr(p)
+		if last == end {
+			return prefixes
+		}
+		start = last.Next()
+	}
+}
+
+// Broadcast address, for v4 folks.
+func LastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// "AS2906", "as2906" and plain "2906" are all the same thing.
+func ParseASN(s string) (uint32, error) {
+	digits := s
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		digits = s[2:]
+	}
+	asn, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil || asn == 0 {
+		return 0, errors.New("bad ASN " + s)
+	}
+	return uint32(asn), nil
+}
@@ -0,0 +1,71 @@
+package playbook
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestRangePrefixes(t *testing.T) {
+	tests := []struct {
+		start string
+		end   string
+		want  []string
+	}{
+		{start: "10.0.0.1", end: "10.0.0.1", want: []string{"10.0.0.1/32"}},
+		{start: "10.0.0.0", end: "10.0.0.255", want: []string{"10.0.0.0/24"}},
+		{start: "91.108.4.0", end: "91.108.23.255", want: []string{"91.108.4.0/22", "91.108.8.0/21", "91.108.16.0/21"}},
+		{start: "10.0.0.1", end: "10.0.0.6", want: []string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/31", "10.0.0.6/32"}},
+		{start: "10.0.0.255", end: "10.0.1.0", want: []string{"10.0.0.255/32", "10.0.1.0/32"}},
+		{start: "255.255.255.254", end: "255.255.255.255", want: []string{"255.255.255.254/31"}},
+		{start: "0.0.0.0", end: "255.255.255.255", want: []string{"0.0.0.0/0"}},
+		{start: "2001:db8::", end: "2001:db8::ffff", want: []string{"2001:db8::/112"}},
+		{start: "2001:db8::1", end: "2001:db8::2", want: []string{"2001:db8::1/128", "2001:db8::2/128"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.start+"-"+tt.end, func(t *testing.T) {
+			got := make([]string, 0)
+			for _, p := range RangePrefixes(netip.MustParseAddr(tt.start), netip.MustParseAddr(tt.end)) {
+				got = append(got, p.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("RangePrefixes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		host    string
+		want    []string
+		network bool
+		wantErr bool
+	}{
+		{host: "149.154.160.0/20", want: []string{"149.154.160.0/20"}, network: true},
+		{host: "149.154.161.7/20", want: []string{"149.154.160.0/20"}, network: true},
+		{host: "10.0.0.0-10.0.1.255", want: []string{"10.0.0.0/23"}, network: true},
+		{host: "0.0.0.0/0", network: true, wantErr: true},
+		{host: "0.0.0.0-255.255.255.255", network: true, wantErr: true},
+		{host: "10.0.0.9-10.0.0.1", network: true, wantErr: true},
+		{host: "10.0.0.1-2001:db8::1", network: true, wantErr: true},
+		{host: "10.0.0.0/33", network: true, wantErr: true},
+		{host: "my-router.lan"},
+		{host: "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			prefixes, network, err := ParseNetwork(tt.host)
+			if network != tt.network || (err != nil) != tt.wantErr {
+				t.Fatalf("network = %v, err = %v, want %v and error: %v", network, err, tt.network, tt.wantErr)
+			}
+			got := make([]string, 0)
+			for _, p := range prefixes {
+				got = append(got, p.String())
+			}
+			if len(tt.want) != 0 && !slices.Equal(got, tt.want) {
+				t.Errorf("prefixes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,16 @@
 package playbook
 
 import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sergds/autovpn2/internal/schedule"
+	"github.com/sergds/autovpn2/internal/secrets"
 	"gopkg.in/yaml.v3"
 )
 
@@ -9,6 +19,7 @@ import (
 // For example look into examples/ file(s).
 type Playbook struct {
 	Name     string
+	Profile  string `yaml:",omitempty"` // Adapter profile from server's config to take adapters and adapterconfig from. Playbook's own ones override it key by key.
 	Adapters struct {
 		Routes string
 		Dns    string
@@ -19,31 +30,284 @@ type Playbook struct {
 	}
 	Interface          string
 	Hosts              []string          `yaml:",omitempty"`
+	Asns               []string          `yaml:",omitempty"` // "AS2906". Every prefix ASN announces gets routed, according to server's offline ASN db (AVPN2_ASNDB).
+	Wildcards          []string          `yaml:",omitempty"` // "*.nflxvideo.net". Addresses server's DNS proxy (AVPN2_DNSPROXY) answers for matching names get routed until their TTL runs out.
+	Sources            []Source          `yaml:",omitempty"` // External lists of hosts (files on server or URLs), fetched anew on every apply and full update.
 	Custom             map[string]string `yaml:",omitempty"`
 	Autoupdateinterval int
-	InstallTime        int64             `yaml:",omitempty"`
-	PlaybookAddrs      map[string]string `yaml:",omitempty"` // Used for undoing, auto-refresh
-	Installed          bool              `yaml:",omitempty"`
-	Busy               bool              `yaml:",omitempty"`
-	Busyreason         string            `yaml:",omitempty"`
+	Schedule           string              `yaml:",omitempty"` // Cron expression ("0 4 * * *") or "@every 6h" for auto updates. Takes precedence over autoupdateinterval.
+	Schedulejitter     int                 `yaml:",omitempty"` // In minutes. Random delay added to every scheduled update, so that playbooks don't stampede the router at once.
+	Schedulewindow     string              `yaml:",omitempty"` // "HH:MM-HH:MM" (server local time). Auto updates (TTL ones included) are only allowed inside of it.
+	Ttlrefresh         bool                `yaml:",omitempty"` // Re-resolve every host on it's own when DNS answer's TTL runs out.
+	Ttlfloor           int                 `yaml:",omitempty"` // In seconds. Don't re-resolve a host more often than that, whatever it's TTL is. 0 -- server default.
+	Ttlceiling         int                 `yaml:",omitempty"` // In seconds. Re-resolve a host at least that often, whatever it's TTL is. 0 -- server default.
+	Driftcheck         int                 `yaml:",omitempty"` // In minutes. How often to check adapters for stuff that changed behind our back. 0 -- server default, negative -- never.
+	Driftrepair        bool                `yaml:",omitempty"` // Put back whatever drift check finds missing or modified, instead of just telling about it.
+	Dnspin             string              `yaml:",omitempty"` // Which of host's addresses get DNS records: "all" (default), "first" (first one resolver gave) or "lowest". Routes go to all of them anyway.
+	Ipfamily           string              `yaml:",omitempty"` // Which addresses of hosts to resolve and route: "v4" (default), "v6" or "both".
+	Pincnames          bool                `yaml:",omitempty"` // Also pin names host's CNAME chain goes through to it's addresses, so that asking for CDN name directly ends up routed too.
+	InstallTime        int64               `yaml:",omitempty"`
+	PlaybookAddrs      map[string][]string `yaml:",omitempty"` // Used for undoing, auto-refresh. Every address host resolved to.
+	PlaybookChains     map[string][]string `yaml:",omitempty"` // CNAMEs each host resolved through last time.
+	PlaybookTTLs       map[string]int      `yaml:",omitempty"` // TTL (seconds) of the last answer for each resolved host.
+	PlaybookResolved   map[string]int64    `yaml:",omitempty"` // When each host was resolved last time (Unix seconds).
+	PlaybookSourced    map[string]string   `yaml:",omitempty"` // Hosts sources gave last time, and which source each came from.
+	Installed          bool                `yaml:",omitempty"`
+	Overrides          *AdapterOverrides   `yaml:"-"` // Adapters as playbook itself has them, before profile filled in the rest. nil until a profile is used.
+	Busy               bool                `yaml:",omitempty"`
+	Busyreason         string              `yaml:",omitempty"`
+}
+
+// Named set of adapters and their config, so that every playbook doesn't have to carry router's password. Lives in server's config.
+type Profile struct {
+	Adapters struct {
+		Routes string
+		Dns    string
+	}
+	Adapterconfig struct {
+		Routes map[string]string
+		Dns    map[string]string
+	}
 }
 
+type AdapterOverrides struct {
+	Routes     string
+	Dns        string
+	Routesconf map[string]string
+	Dnsconf    map[string]string
+}
+
+// Address families, see Ipfamily.
+const (
+	FAMILY_V4   = "v4"
+	FAMILY_V6   = "v6"
+	FAMILY_BOTH = "both"
+)
+
+// DNS pinning policies, see Dnspin.
+const (
+	PIN_ALL    = "all"
+	PIN_FIRST  = "first"
+	PIN_LOWEST = "lowest"
+)
+
+// Strict: keys playbook doesn't have are an error, not something to quietly ignore (adapterconfg: is a typo, not a wish).
+// Doesn't check values, that's Validate's job.
 func Parse(pbyaml string) (*Playbook, error) {
 	pb := &Playbook{}
-	err := yaml.Unmarshal([]byte(pbyaml), pb)
+	dec := yaml.NewDecoder(strings.NewReader(pbyaml))
+	dec.KnownFields(true)
+	err := dec.Decode(pb)
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("playbook is empty")
+	}
 	if err != nil {
 		return nil, err
 	}
 	return pb, err
 }
 
-func (pb *Playbook) Lock(reason string) bool {
-	pb.Busyreason = reason
-	if pb.Busy {
-		return false
+// Hosts whose last answer's TTL (clamped to floor..ceiling) has run out by now.
+func (pb *Playbook) ExpiredHosts(now int64, floor int, ceiling int) []string {
+	expired := make([]string, 0)
+	for host, resolved := range pb.PlaybookResolved {
+		ttl := pb.PlaybookTTLs[host]
+		if ttl < floor {
+			ttl = floor
+		}
+		if ceiling > 0 && ttl > ceiling {
+			ttl = ceiling
+		}
+		if now-resolved >= int64(ttl) {
+			expired = append(expired, host)
+		}
+	}
+	return expired
+}
+
+// Works out when this playbook wants to be auto updated. nil schedule means it doesn't (TTL refresh aside), nil window means any time is fine.
+// autoupdateinterval is just a shorthand for "@every <N>h".
+func (pb *Playbook) UpdateSchedule() (sched *schedule.Schedule, window *schedule.Window, err error) {
+	if pb.Schedule != "" {
+		sched, err = schedule.Parse(pb.Schedule)
+		if err != nil {
+			return nil, nil, errors.New("bad schedule: " + err.Error())
+		}
+	} else if pb.Autoupdateinterval > 0 {
+		sched = schedule.Every(time.Duration(pb.Autoupdateinterval) * time.Hour)
+	}
+	if pb.Schedulewindow != "" {
+		window, err = schedule.ParseWindow(pb.Schedulewindow)
+		if err != nil {
+			return nil, nil, errors.New("bad schedulewindow: " + err.Error())
+		}
+	}
+	return sched, window, nil
+}
+
+func (pb *Playbook) CheckDnspin() error {
+	switch pb.Dnspin {
+	case "", PIN_ALL, PIN_FIRST, PIN_LOWEST:
+		return nil
+	}
+	return errors.New("bad dnspin: " + pb.Dnspin + " (expected all, first or lowest)")
+}
+
+func (pb *Playbook) CheckIpfamily() error {
+	switch pb.Ipfamily {
+	case "", FAMILY_V4, FAMILY_V6, FAMILY_BOTH:
+		return nil
+	}
+	return errors.New("bad ipfamily: " + pb.Ipfamily + " (expected v4, v6 or both)")
+}
+
+func (pb *Playbook) WantsV4() bool {
+	return pb.Ipfamily != FAMILY_V6
+}
+
+func (pb *Playbook) WantsV6() bool {
+	return pb.Ipfamily == FAMILY_V6 || pb.Ipfamily == FAMILY_BOTH
+}
+
+// DNS record types playbook deals with.
+func (pb *Playbook) RecordTypes() []string {
+	types := make([]string, 0)
+	if pb.WantsV4() {
+		types = append(types, "A")
+	}
+	if pb.WantsV6() {
+		types = append(types, "AAAA")
 	}
+	return types
+}
+
+// Which of host's addresses get DNS records, according to dnspin. v4 and v6 ones are pinned on their own, so "first" gives one of each.
+func (pb *Playbook) Pinned(addrs []string) []string {
+	if pb.Dnspin != PIN_FIRST && pb.Dnspin != PIN_LOWEST {
+		return addrs
+	}
+	pinned := make([]string, 0)
+	for _, v6 := range []bool{false, true} {
+		var pick net.IP
+		for _, addr := range addrs {
+			ip := net.ParseIP(addr)
+			if ip == nil || (ip.To4() == nil) != v6 {
+				continue
+			}
+			if pick == nil || (pb.Dnspin == PIN_LOWEST && bytes.Compare(ip.To16(), pick.To16()) < 0) {
+				pick = ip
+			}
+		}
+		if pick != nil {
+			pinned = append(pinned, pick.String())
+		}
+	}
+	return pinned
+}
+
+func (pb *Playbook) CheckWildcards() error {
+	for _, w := range pb.Wildcards {
+		suffix, ok := strings.CutPrefix(w, "*.")
+		if !ok || suffix == "" || strings.Contains(suffix, "*") {
+			return errors.New("bad wildcard: " + w + " (expected *.domain)")
+		}
+	}
+	return nil
+}
+
+// Wildcard name matches, "" if none does. Wildcards match subdomains of any depth, but not the domain itself (put it in hosts for that).
+func (pb *Playbook) MatchWildcard(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, w := range pb.Wildcards {
+		if strings.HasSuffix(name, strings.ToLower(w[1:])) {
+			return w
+		}
+	}
+	return ""
+}
+
+// Fills adapters in from profile, playbook's own ones win. Profile may change between calls, so it's always merged with what playbook had itself, not with the last result.
+// nil profile puts playbook's own adapters back.
+func (pb *Playbook) UseProfile(prof *Profile) {
+	if pb.Overrides == nil {
+		pb.Overrides = &AdapterOverrides{Routes: pb.Adapters.Routes, Dns: pb.Adapters.Dns, Routesconf: pb.Adapterconfig.Routes, Dnsconf: pb.Adapterconfig.Dns}
+	}
+	own := pb.Overrides
+	pb.Adapters.Routes, pb.Adapters.Dns = own.Routes, own.Dns
+	pb.Adapterconfig.Routes, pb.Adapterconfig.Dns = mergeConf(nil, own.Routesconf), mergeConf(nil, own.Dnsconf)
+	if prof == nil {
+		return
+	}
+	if pb.Adapters.Routes == "" {
+		pb.Adapters.Routes = prof.Adapters.Routes
+	}
+	if pb.Adapters.Routes == prof.Adapters.Routes { // Config of some other adapter is of no use.
+		pb.Adapterconfig.Routes = mergeConf(prof.Adapterconfig.Routes, own.Routesconf)
+	}
+	if pb.Adapters.Dns == "" {
+		pb.Adapters.Dns = prof.Adapters.Dns
+	}
+	if pb.Adapters.Dns == prof.Adapters.Dns {
+		pb.Adapterconfig.Dns = mergeConf(prof.Adapterconfig.Dns, own.Dnsconf)
+	}
+}
+
+// Keys of over replace ones of base. Neither gets changed.
+func mergeConf(base map[string]string, over map[string]string) map[string]string {
+	if base == nil && over == nil {
+		return nil
+	}
+	merged := make(map[string]string)
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range over {
+		merged[k] = v
+	}
+	return merged
+}
+
+// Deep copy, so that steps messing with maps of one don't mess with the other.
+func (pb *Playbook) Clone() *Playbook {
+	buf := &bytes.Buffer{}
+	clone := &Playbook{}
+	if gob.NewEncoder(buf).Encode(pb) != nil || gob.NewDecoder(buf).Decode(clone) != nil {
+		return nil // Can't happen with a struct of plain maps and strings. Famous last words.
+	}
+	return clone
+}
+
+// Copy fit for showing to people: credentials in adapterconfig are masked, secret references are left as they are.
+func (pb *Playbook) Redacted() *Playbook {
+	red := pb.Clone()
+	for _, conf := range []map[string]string{red.Adapterconfig.Routes, red.Adapterconfig.Dns} {
+		for k, v := range conf {
+			conf[k] = secrets.MaskValue(k, v)
+		}
+	}
+	if own := red.Overrides; own != nil {
+		for _, conf := range []map[string]string{own.Routesconf, own.Dnsconf} {
+			for k, v := range conf {
+				conf[k] = secrets.MaskValue(k, v)
+			}
+		}
+	}
+	return red
+}
+
+// Playbook as one would write it: without anything server keeps about it's installation.
+func (pb *Playbook) Spec() *Playbook {
+	spec := pb.Clone()
+	spec.InstallTime, spec.Installed, spec.Busy, spec.Busyreason = 0, false, false, ""
+	spec.PlaybookAddrs, spec.PlaybookChains, spec.PlaybookTTLs, spec.PlaybookResolved, spec.PlaybookSourced = nil, nil, nil, nil, nil
+	return spec
+}
+
+// Marks playbook as being worked on, so it shows up as such in db (and autoupdater leaves it alone).
+// It's just a marker, actual locking is done by server's lock manager.
+func (pb *Playbook) MarkBusy(reason string) {
+	pb.Busyreason = reason
 	pb.Busy = true
-	return pb.Busy
 }
 
 func (pb *Playbook) Unlock() {
@@ -0,0 +1,95 @@
+package playbook
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+
+	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+)
+
+// Fields server fills in itself. Parse takes them (that's how playbooks get shown), but nobody should be writing them, so editors don't suggest them.
+var serverState = []string{"installtime", "playbookaddrs", "playbookchains", "playbookttls", "playbookresolved", "playbooksourced", "installed", "busy", "busyreason"}
+
+// JSON Schema of playbook YAML, for editors to autocomplete and check playbooks as they're written.
+// Made from Playbook itself, so it doesn't fall behind when fields are added.
+func JSONSchema() ([]byte, error) {
+	schema := typeSchema(reflect.TypeOf(Playbook{}), "")
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "AutoVPN playbook"
+	// Playbook that extends another one can leave anything to it.
+	schema["anyOf"] = []any{map[string]any{"required": []string{"name", "interface"}}, map[string]any{"required": []string{"extends"}}}
+	// Client's business, see Expand. Server never sees these.
+	props := schema["properties"].(map[string]any)
+	props["vars"] = map[string]any{"type": "object", "description": "Values for {{ .name }} templates anywhere in playbook"}
+	props["extends"] = map[string]any{"type": "string", "description": "Playbook to take everything from, path relative to this one"}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// Schema of t, found at path (dot separated yaml keys) of playbook. Path is for the few fields that have a fixed set of values.
+func typeSchema(t reflect.Type, path string) map[string]any {
+	switch path {
+	case "adapters.routes":
+		return map[string]any{"type": "string", "enum": routes.Names}
+	case "adapters.dns":
+		return map[string]any{"type": "string", "enum": dnsadapters.Names}
+	case "adapterconfig.routes":
+		return confSchema(routes.Names, routes.ConfigKeys)
+	case "adapterconfig.dns":
+		return confSchema(dnsadapters.Names, dnsadapters.ConfigKeys)
+	case "dnspin":
+		return map[string]any{"type": "string", "enum": []string{PIN_ALL, PIN_FIRST, PIN_LOWEST}}
+	case "ipfamily":
+		return map[string]any{"type": "string", "enum": []string{FAMILY_V4, FAMILY_V6, FAMILY_BOTH}}
+	case "sources[].format":
+		return map[string]any{"type": "string", "enum": SourceFormats}
+	case "wildcards":
+		return map[string]any{"type": "array", "items": map[string]any{"type": "string", "pattern": `^\*\.`}}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem(), path+"[]")}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem(), path+"{}")}
+	case reflect.Pointer:
+		return typeSchema(t.Elem(), path)
+	case reflect.Struct:
+		props := make(map[string]any)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name) // Same as yaml.v3 does.
+			}
+			if path == "" && slices.Contains(serverState, name) {
+				continue
+			}
+			props[name] = typeSchema(f.Type, strings.TrimPrefix(path+"."+name, "."))
+		}
+		return map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+	}
+	return map[string]any{}
+}
+
+// Config keys of every adapter of a kind. Which of them adapter needs is for Validate to say, schema can't know which adapter it is.
+func confSchema(names []string, keys func(string) ([]string, bool)) map[string]any {
+	props := make(map[string]any)
+	for _, name := range names {
+		known, _ := keys(name)
+		for _, k := range known {
+			props[k] = map[string]any{"type": "string", "description": "Config of " + name + " adapter"}
+		}
+	}
+	return map[string]any{"type": "object", "properties": props, "additionalProperties": false}
+}
@@ -0,0 +1,158 @@
+package playbook
+
+import (
+	"bufio"
+	"errors"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// External list of hosts, the kind everyone tracks blocked services with (antifilter, v2fly's domain-list-community, dnsmasq ipset= files).
+// Server fetches it on every apply and full update and routes whatever is in it, same as if it was pasted into hosts.
+type Source struct {
+	Url    string // http(s) URL, or a path to a file in server's sourcedir.
+	Format string `yaml:",omitempty"` // One of SOURCE_*. Figured out line by line if not given.
+}
+
+// Formats of sources.
+const (
+	SOURCE_PLAIN   = "plain"   // One host (domain, address, network) per line.
+	SOURCE_HOSTS   = "hosts"   // /etc/hosts style: address, then names. Names are taken, address isn't (it's 0.0.0.0 in blocklists anyway).
+	SOURCE_DNSMASQ = "dnsmasq" // ipset=/a.com/b.com/set, nftset=..., server=/a.com/1.1.1.1, address=/a.com/...
+	SOURCE_V2FLY   = "v2fly"   // domain:a.com, full:a.com, or just a.com. regexp: and keyword: can't be routed, include: can't be followed, those are skipped.
+	SOURCE_CSV     = "csv"     // First column, separated by , or ;. Header line is skipped just like any other line that isn't a host.
+)
+
+var SourceFormats = []string{SOURCE_PLAIN, SOURCE_HOSTS, SOURCE_DNSMASQ, SOURCE_V2FLY, SOURCE_CSV}
+
+// Names hosts file have for the machine itself, not worth routing.
+var localNames = map[string]bool{"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true, "ip6-localhost": true, "ip6-loopback": true}
+
+func (pb *Playbook) CheckSources() error {
+	for _, src := range pb.Sources {
+		if src.Url == "" {
+			return errors.New("source without url")
+		}
+		if src.Format != "" && !slices.Contains(SourceFormats, src.Format) {
+			return errors.New("bad source format " + src.Format + " of " + src.Url + " (expected " + strings.Join(SourceFormats, ", ") + ")")
+		}
+	}
+	return nil
+}
+
+// Hosts of source's contents, in order and without duplicates. skipped is how many entries weren't hosts (or couldn't be routed).
+func ParseSource(format string, text string) (hosts []string, skipped int) {
+	hosts = make([]string, 0)
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(strings.NewReader(text))
+	sc.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if i := strings.Index(line, " #"); i != -1 {
+			line = strings.TrimSpace(line[:i])
+		}
+		f := format
+		if f == "" {
+			f = guessFormat(line)
+		}
+		entries := parseSourceLine(f, line)
+		if len(entries) == 0 {
+			skipped++
+		}
+		for _, h := range entries {
+			key := strings.ToLower(strings.TrimSuffix(h, "."))
+			if addr, err := netip.ParseAddr(h); err == nil && (addr.IsUnspecified() || addr.IsLoopback()) {
+				skipped++ // Blocklists' sinkholes, not something to route.
+				continue
+			}
+			if checkHost(h) != nil || localNames[key] || (!strings.Contains(key, ".") && !isAddrOrNetwork(h)) { // Dotless names are headers and junk.
+				skipped++
+				continue
+			}
+			if !seen[key] {
+				seen[key] = true
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	return hosts, skipped
+}
+
+func guessFormat(line string) string {
+	switch {
+	case strings.Contains(line, "=/"):
+		return SOURCE_DNSMASQ
+	case strings.HasPrefix(line, "domain:") || strings.HasPrefix(line, "full:") || strings.HasPrefix(line, "regexp:") || strings.HasPrefix(line, "keyword:") || strings.HasPrefix(line, "include:"):
+		return SOURCE_V2FLY
+	case strings.ContainsAny(line, ",;"):
+		return SOURCE_CSV
+	}
+	if fields := strings.Fields(line); len(fields) > 1 {
+		if _, err := netip.ParseAddr(fields[0]); err == nil {
+			return SOURCE_HOSTS
+		}
+	}
+	return SOURCE_PLAIN
+}
+
+func parseSourceLine(format string, line string) []string {
+	switch format {
+	case SOURCE_HOSTS:
+		names := make([]string, 0)
+		for _, name := range strings.Fields(line)[1:] {
+			if _, err := netip.ParseAddr(name); err != nil { // "0.0.0.0 0.0.0.0" is out there too.
+				names = append(names, name)
+			}
+		}
+		return names
+	case SOURCE_DNSMASQ:
+		_, rest, found := strings.Cut(line, "=/")
+		if !found {
+			return nil
+		}
+		// Domains sit between the first slash and the last one, whatever comes after is set name or server.
+		last := strings.LastIndex(rest, "/")
+		if last == -1 {
+			return nil
+		}
+		domains := make([]string, 0)
+		for _, d := range strings.Split(rest[:last], "/") {
+			if d = strings.TrimPrefix(d, "."); d != "" && d != "#" {
+				domains = append(domains, d)
+			}
+		}
+		return domains
+	case SOURCE_V2FLY:
+		entry := strings.Fields(line)[0] // Attributes (@cn) come after a space.
+		kind, value, found := strings.Cut(entry, ":")
+		if !found {
+			return []string{entry}
+		}
+		if kind == "domain" || kind == "full" {
+			return []string{value}
+		}
+		return nil
+	case SOURCE_CSV:
+		first, _, _ := strings.Cut(line, ",")
+		first, _, _ = strings.Cut(first, ";")
+		return []string{strings.Trim(strings.TrimSpace(first), `"`)}
+	default:
+		return []string{strings.Fields(line)[0]}
+	}
+}
+
+// Whether name is one of playbook's hosts, it's own or one of sources'.
+func (pb *Playbook) IsHost(name string) bool {
+	_, sourced := pb.PlaybookSourced[name]
+	return sourced || slices.Contains(pb.Hosts, name)
+}
+
+func isAddrOrNetwork(h string) bool {
+	_, err := netip.ParseAddr(h)
+	_, network, _ := ParseNetwork(h)
+	return err == nil || network
+}
@@ -0,0 +1,101 @@
+package playbook
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		name        string
+		format      string
+		text        string
+		want        []string
+		wantSkipped int
+	}{
+		{
+			name:   "plain",
+			format: SOURCE_PLAIN,
+			text: `# comment
+example.com
+EXAMPLE.com.
+1.2.3.4 # trailing comment
+10.0.0.0/8
+
+! adblock comment
+// another one
+not_a.host!
+`,
+			want:        []string{"example.com", "1.2.3.4", "10.0.0.0/8"},
+			wantSkipped: 1,
+		},
+		{
+			name:   "hosts",
+			format: SOURCE_HOSTS,
+			text: `127.0.0.1 localhost
+0.0.0.0 0.0.0.0
+0.0.0.0 a.com b.com
+::1 ip6-localhost ip6-loopback
+`,
+			want:        []string{"a.com", "b.com"},
+			wantSkipped: 4,
+		},
+		{
+			name:   "dnsmasq",
+			format: SOURCE_DNSMASQ,
+			text: `ipset=/a.com/.b.com/vpn
+nftset=/c.com/4#inet#fw4#vpn
+server=/d.com/1.1.1.1
+address=/e.com/#
+garbage
+`,
+			want:        []string{"a.com", "b.com", "c.com", "d.com", "e.com"},
+			wantSkipped: 1,
+		},
+		{
+			name:   "v2fly",
+			format: SOURCE_V2FLY,
+			text: `domain:a.com
+full:www.b.com @cn
+c.com
+regexp:^ads\..*
+keyword:google
+include:other-list
+`,
+			want:        []string{"a.com", "www.b.com", "c.com"},
+			wantSkipped: 3,
+		},
+		{
+			name:   "csv",
+			format: SOURCE_CSV,
+			text: `domain,comment
+"a.com",blocked
+b.com;since 2022
+`,
+			want:        []string{"a.com", "b.com"},
+			wantSkipped: 1,
+		},
+		{
+			name:   "guessed line by line",
+			format: "",
+			text: `ipset=/a.com/vpn
+domain:b.com
+0.0.0.0 c.com
+d.com,x
+e.com
+`,
+			want: []string{"a.com", "b.com", "c.com", "d.com", "e.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, skipped := ParseSource(tt.format, tt.text)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("hosts = %v, want %v", got, tt.want)
+			}
+			if skipped != tt.wantSkipped {
+				t.Errorf("skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package playbook
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+	"github.com/sergds/autovpn2/internal/secrets"
+)
+
+// Everything that can be checked without a server: adapters and their config, hosts, duplicates and the rest of playbook's options.
+// Every problem found is reported, not just the first one, so that fixing a playbook doesn't take a dozen tries.
+// Playbook with a profile that wasn't filled in yet (client side) gets a pass on adapters it doesn't name, profile may have them.
+func (pb *Playbook) Validate() error {
+	problems := make([]error, 0)
+	add := func(err error) {
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if pb.Name == "" {
+		add(errors.New("name is empty"))
+	} else if strings.ContainsAny(pb.Name, " \t\r\n/") {
+		add(errors.New("bad name " + pb.Name + " (no spaces or slashes, it ends up in route comments)"))
+	}
+	if strings.TrimSpace(pb.Interface) == "" {
+		add(errors.New("interface is empty (where should routes go?)"))
+	}
+	unfilled := pb.Profile != "" && pb.Overrides == nil
+	add(checkAdapter("routes", pb.Adapters.Routes, pb.Adapterconfig.Routes, unfilled, routes.ConfigKeys, routes.SecretKeys))
+	add(checkAdapter("dns", pb.Adapters.Dns, pb.Adapterconfig.Dns, unfilled, dnsadapters.ConfigKeys, dnsadapters.SecretKeys))
+	if len(pb.Hosts) == 0 && len(pb.Asns) == 0 && len(pb.Wildcards) == 0 && len(pb.Sources) == 0 && len(pb.Custom) == 0 {
+		add(errors.New("playbook has nothing to route (no hosts, asns, wildcards, sources or custom)"))
+	}
+	for _, h := range pb.Hosts {
+		add(checkHost(h))
+	}
+	add(duplicates("hosts", pb.Hosts, func(h string) string { return strings.ToLower(strings.TrimSuffix(h, ".")) }))
+	for _, as := range pb.Asns {
+		_, err := ParseASN(as)
+		add(err)
+	}
+	add(duplicates("asns", pb.Asns, func(as string) string {
+		asn, _ := ParseASN(as)
+		return fmt.Sprint(asn)
+	}))
+	add(pb.CheckWildcards())
+	add(duplicates("wildcards", pb.Wildcards, strings.ToLower))
+	add(pb.CheckSources())
+	for name, addr := range pb.Custom {
+		if !isHostname(name) {
+			add(errors.New("bad custom name " + name))
+		}
+		if _, err := netip.ParseAddr(addr); err != nil {
+			add(errors.New("bad custom address " + addr + " of " + name + " (expected an IP address)"))
+		}
+	}
+	_, _, err := pb.UpdateSchedule()
+	add(err)
+	if pb.Schedulejitter < 0 {
+		add(errors.New("schedulejitter can't be negative"))
+	}
+	if pb.Ttlfloor < 0 || pb.Ttlceiling < 0 {
+		add(errors.New("ttlfloor and ttlceiling can't be negative"))
+	} else if pb.Ttlceiling != 0 && pb.Ttlfloor > pb.Ttlceiling {
+		add(errors.New("ttlfloor is above ttlceiling"))
+	}
+	add(pb.CheckDnspin())
+	add(pb.CheckIpfamily())
+	return errors.Join(problems...)
+}
+
+// Adapter has to exist, have every config key it needs and nothing it doesn't know (that's a typo most of the time).
+// Secret references are only for credentials, server won't resolve them anywhere else.
+func checkAdapter(kind string, name string, conf map[string]string, unfilled bool, keys func(string) ([]string, bool), secretKeys func(string) []string) error {
+	if name == "" && unfilled {
+		return nil
+	}
+	known, ok := keys(name)
+	if !ok {
+		return errors.New("unknown " + kind + " adapter " + name)
+	}
+	problems := make([]error, 0)
+	for _, k := range known {
+		if _, ok := conf[k]; !ok && !unfilled {
+			problems = append(problems, errors.New(kind+" adapter "+name+" needs "+k+" in adapterconfig"))
+		}
+	}
+	for k, v := range conf {
+		if !slices.Contains(known, k) {
+			problems = append(problems, errors.New("unknown adapterconfig key "+k+" for "+kind+" adapter "+name))
+		} else if secrets.HasRef(v) && !slices.Contains(secretKeys(name), k) {
+			problems = append(problems, errors.New("secret reference in "+k+" of "+kind+" adapter "+name+" (only credentials can have them)"))
+		}
+	}
+	return errors.Join(problems...)
+}
+
+// Host is a domain name, an address or a network.
+func checkHost(h string) error {
+	if _, ok, err := ParseNetwork(h); ok {
+		return err
+	}
+	if _, err := netip.ParseAddr(h); err == nil || isHostname(h) {
+		return nil
+	}
+	return errors.New("bad host " + h + " (expected a domain name, an address or a network)")
+}
+
+// Letters, digits, dashes and underscores (those are out there, _dmarc and friends), in labels of up to 63 of them. Trailing dot is fine.
+func isHostname(h string) bool {
+	h = strings.TrimSuffix(h, ".")
+	if h == "" || len(h) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(h, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func duplicates(field string, values []string, key func(string) string) error {
+	seen := make(map[string]bool)
+	dups := make([]string, 0)
+	for _, v := range values {
+		k := key(v)
+		if seen[k] {
+			dups = append(dups, v)
+		}
+		seen[k] = true
+	}
+	if len(dups) != 0 {
+		return errors.New("duplicate " + field + ": " + strings.Join(dups, ", "))
+	}
+	return nil
+}
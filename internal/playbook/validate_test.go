@@ -0,0 +1,84 @@
+package playbook
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	const keenetic = `adapters: {routes: keeneticrci, dns: "null"}
+adapterconfig:
+  routes: {keenetic_login: "admin:${env:KPASS}", keenetic_origin: "http://10.0.2.1"}
+`
+	tests := []struct {
+		name string
+		yaml string
+		want []string // Parts of the error, one per problem. None for a valid playbook.
+	}{
+		{name: "valid", yaml: keenetic + "name: test\ninterface: Wireguard1\nhosts: [a.com, 1.2.3.4, 10.0.0.0/8, 10.1.0.0-10.1.0.255]\n"},
+		{name: "valid with everything", yaml: keenetic + `name: test
+interface: Wireguard1
+asns: [AS2906]
+wildcards: ["*.nflxvideo.net"]
+sources: [{url: "https://example.com/list.txt", format: v2fly}]
+custom: {my.lan: 10.0.2.5}
+schedule: "0 4 * * *"
+schedulewindow: "01:00-06:00"
+ttlfloor: 60
+ttlceiling: 3600
+dnspin: lowest
+ipfamily: both
+`},
+		{name: "profile fills adapters in", yaml: "name: test\nprofile: home\ninterface: Wireguard1\nhosts: [a.com]\n"},
+		{name: "no name", yaml: keenetic + "interface: Wireguard1\nhosts: [a.com]\n", want: []string{"name is empty"}},
+		{name: "bad name", yaml: keenetic + "name: my test\ninterface: Wireguard1\nhosts: [a.com]\n", want: []string{"bad name"}},
+		{name: "nothing to route", yaml: keenetic + "name: test\ninterface: Wireguard1\n", want: []string{"nothing to route"}},
+		{name: "unknown adapter", yaml: "name: test\nadapters: {routes: mikrotik, dns: \"null\"}\ninterface: Wireguard1\nhosts: [a.com]\n", want: []string{"unknown routes adapter mikrotik"}},
+		{name: "missing adapterconfig", yaml: "name: test\nadapters: {routes: keeneticrci, dns: \"null\"}\ninterface: Wireguard1\nhosts: [a.com]\n", want: []string{"needs keenetic_login", "needs keenetic_origin"}},
+		{name: "secret outside of credentials", yaml: `name: test
+adapters: {routes: keeneticrci, dns: "null"}
+adapterconfig:
+  routes: {keenetic_login: "admin:x", keenetic_origin: "http://${secret:router}"}
+interface: Wireguard1
+hosts: [a.com]
+`, want: []string{"secret reference in keenetic_origin"}},
+		{name: "every problem at once", yaml: keenetic + `name: test
+interface: " "
+hosts: [a.com, A.com., "bad host!", 10.0.0.9-10.0.0.1]
+asns: [AS0]
+dnspin: random
+ipfamily: v5
+ttlfloor: 600
+ttlceiling: 60
+schedule: "0 4 * *"
+`, want: []string{"interface is empty", "duplicate hosts: A.com.", "bad host bad host!", "ends before it starts", "bad ASN AS0", "bad dnspin", "bad ipfamily", "ttlfloor is above ttlceiling", "bad schedule"}},
+		{name: "bad custom", yaml: keenetic + "name: test\ninterface: Wireguard1\ncustom: {\"-x\": not-an-ip}\n", want: []string{"bad custom name -x", "bad custom address not-an-ip"}},
+		{name: "bad source format", yaml: keenetic + "name: test\ninterface: Wireguard1\nsources: [{url: list.txt, format: json}]\n", want: []string{"bad source format json"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pb, err := Parse(tt.yaml)
+			if err != nil {
+				t.Fatalf("playbook doesn't parse: %v", err)
+			}
+			err = pb.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate = %v, want no problems", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate found no problems, want %v", tt.want)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(err.Error(), w) {
+					t.Errorf("problems don't mention %q:\n%v", w, err)
+				}
+			}
+			if n := len(strings.Split(err.Error(), "\n")); n < len(tt.want) {
+				t.Errorf("%v problems reported, want at least %v", n, len(tt.want))
+			}
+		})
+	}
+}
@@ -8,9 +8,15 @@ const (
 	STEP_ROUTES       = "routes"       // Use when using routes adapter
 	STEP_NOTIFY       = "notify"       // STATE text gets put into current step name on client
 	STEP_ERROR        = "error"        // Terminates executors! For errors, STATE text is essentially the error message.
+	STEP_RETRY        = "retry"        // Step failed, but executor gives it another go. STATE text says why and when.
 	STEP_PUSH_SUMMARY = "push_summary" // Push this string into client's summary. Summary is shown at the end of operation.
 	STEP_LOCK_ADD     = "lock_add"
 	STEP_PREP_CTX     = "prep_ctx"
+	STEP_LOCKS        = "locks" // List locks or clear them
+	STEP_CANCEL       = "cancel"
+	STEP_JOBS         = "jobs"
+	STEP_ATTACH       = "attach"
+	STEP_SHOW         = "show"
 )
 
 const (
@@ -18,6 +24,22 @@ const (
 	UNDO_STEP_ROUTES = "undo_routes" // When removing routes
 )
 
+const (
+	ROLLBACK_STEP_ROUTES   = "rollback_routes"   // When reversing route changes of a failed job
+	ROLLBACK_STEP_DNS      = "rollback_dns"      // When reversing DNS changes of a failed job
+	ROLLBACK_STEP_PLAYBOOK = "rollback_playbook" // When restoring previous revision of playbook
+)
+
+const (
+	GC_STEP_ROUTES = "gc_routes" // When looking for (and deleting) orphan routes
+	GC_STEP_DNS    = "gc_dns"    // When looking for (and deleting) orphan DNS records
+)
+
+const (
+	PLAN_STEP_DNS    = "plan_dns"    // When comparing DNS records with playbook
+	PLAN_STEP_ROUTES = "plan_routes" // When comparing routes with playbook
+)
+
 // Describe to the poor user tf we are doing right now.
 func DescribeState(state string) string {
 	switch state {
@@ -35,12 +57,38 @@ func DescribeState(state string) string {
 		return "During execution of the task following failed:"
 	case STEP_PUSH_SUMMARY:
 		return ""
+	case STEP_RETRY:
+		return "Step failed, retrying:"
 	case UNDO_STEP_DNS:
 		return "Undoing DNS records"
 	case UNDO_STEP_ROUTES:
 		return "Undoing static routes"
+	case ROLLBACK_STEP_ROUTES:
+		return "Rolling back static routes"
+	case ROLLBACK_STEP_DNS:
+		return "Rolling back DNS records"
+	case ROLLBACK_STEP_PLAYBOOK:
+		return "Restoring previous playbook revision"
+	case PLAN_STEP_DNS:
+		return "Planning DNS records"
+	case PLAN_STEP_ROUTES:
+		return "Planning static routes"
+	case GC_STEP_ROUTES:
+		return "Collecting orphan static routes"
+	case GC_STEP_DNS:
+		return "Collecting orphan DNS records"
 	case STEP_LOCK_ADD:
 		return "Locking playbook and adding to DB"
+	case STEP_LOCKS:
+		return "Playbook locks"
+	case STEP_JOBS:
+		return "Jobs"
+	case STEP_ATTACH:
+		return "Attached to job"
+	case STEP_CANCEL:
+		return "Cancelling jobs"
+	case STEP_SHOW:
+		return "Playbook"
 	case STEP_PREP_CTX:
 		return "Preparing for operation"
 	default:
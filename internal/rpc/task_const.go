@@ -2,7 +2,19 @@ package rpc
 
 // contains the enums for tasks we can do.
 const (
-	TASK_APPLY = "apply"
-	TASK_LIST  = "list"
-	TASK_UNDO  = "undo"
+	TASK_APPLY   = "apply"
+	TASK_LIST    = "list"
+	TASK_UNDO    = "undo"
+	TASK_PLAN    = "plan"    // Tell what apply would change, but don't touch anything.
+	TASK_LOCKS   = "locks"   // List held locks and interrupted jobs. With "clear <name>" args force-clears a lock.
+	TASK_REFRESH = "refresh" // Re-resolve installed playbook's hosts and push what changed. Started by autoupdater.
+	TASK_CANCEL  = "cancel"  // Cancel running jobs of a playbook, or one job by it's ID.
+	TASK_JOBS    = "jobs"    // List latest jobs. With "all" arg lists every one server remembers.
+	TASK_ATTACH  = "attach"  // Replay job's output by it's ID, and follow it if it's still running.
+	TASK_DETACH  = "detach"  // Run another task (first arg is it's name, the rest are it's args) in background. Server only tells job's ID.
+	TASK_RECOVER = "recover" // Rolling back a job that got interrupted by server going down. Started by server itself.
+	TASK_REPAIR  = "repair"  // Push installed playbook's addresses again, without re-resolving. Started by drift reconciler.
+	TASK_GC      = "gc"      // Find routes and records no installed playbook owns. First arg is "dry" or "delete", second one (optional) is playbook yaml whose adapters to look at too.
+	TASK_UNLOCK  = "unlock"  // Force-release a lock (or all locks of a playbook) by name, no matter who holds it. Admin's last resort.
+	TASK_SHOW    = "show"    // Show playbook as server has it: vars and extends expanded, profile filled in, credentials masked.
 )
@@ -0,0 +1,222 @@
+// Tiny cron. Just enough of it to tell autoupdater when playbooks should be refreshed.
+package schedule
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Either a classic 5 field cron expression (minute hour day-of-month month day-of-week), one of @hourly/@daily/@weekly/@monthly, or "@every <duration>".
+// Everything is evaluated in server's local time.
+type Schedule struct {
+	expr    string
+	every   time.Duration
+	minute  uint64 // Bitsets of allowed values for every field.
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool // Cron quirk: if both day fields are restricted, matching any of them is enough.
+	dowStar bool
+}
+
+var macros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+var monthNames = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+var dowNames = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil {
+			return nil, errors.New("bad @every duration: " + err.Error())
+		}
+		if d < time.Minute {
+			return nil, errors.New("@every duration must be at least a minute")
+		}
+		return &Schedule{expr: expr, every: d}, nil
+	}
+	full := expr
+	if m, ok := macros[expr]; ok {
+		full = m
+	}
+	fields := strings.Fields(full)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression needs 5 fields, got " + strconv.Itoa(len(fields)) + ": " + expr)
+	}
+	s := &Schedule{expr: expr}
+	var err error
+	if s.minute, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return nil, errors.New("minute: " + err.Error())
+	}
+	if s.hour, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return nil, errors.New("hour: " + err.Error())
+	}
+	if s.dom, err = parseField(fields[2], 1, 31, nil); err != nil {
+		return nil, errors.New("day of month: " + err.Error())
+	}
+	if s.month, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, errors.New("month: " + err.Error())
+	}
+	if s.dow, err = parseField(fields[4], 0, 7, dowNames); err != nil {
+		return nil, errors.New("day of week: " + err.Error())
+	}
+	if s.dow&(1<<7) != 0 { // 7 is sunday too
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*" || fields[2] == "?"
+	s.dowStar = fields[4] == "*" || fields[4] == "?"
+	return s, nil
+}
+
+// Plain interval schedule, counted from the previous run.
+func Every(d time.Duration) *Schedule {
+	return &Schedule{expr: "@every " + d.String(), every: d}
+}
+
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// First moment strictly after "after" that schedule fires at. Zero time if it never does (like "0 0 31 2 *").
+func (s *Schedule) Next(after time.Time) time.Time {
+	if s.every > 0 {
+		return after.Add(s.every)
+	}
+	loc := after.Location()
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute(), 0, 0, loc).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Parses one cron field: "*", "5", "1-5", "*/15", "10-50/10", "mon-fri" and comma separated lists of those.
+func parseField(field string, min int, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if rng, st, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(st)
+			if err != nil || n <= 0 {
+				return 0, errors.New("bad step in " + part)
+			}
+			step = n
+			part = rng
+		}
+		lo, hi := min, max
+		if part != "*" && part != "?" {
+			from, to, isrange := strings.Cut(part, "-")
+			var err error
+			if lo, err = fieldValue(from, names); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isrange {
+				if hi, err = fieldValue(to, names); err != nil {
+					return 0, err
+				}
+			} else if step != 1 {
+				hi = max // "5/10" means starting at 5
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.New(part + " is out of range " + strconv.Itoa(min) + "-" + strconv.Itoa(max))
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func fieldValue(v string, names map[string]int) (int, error) {
+	if n, ok := names[strings.ToLower(v)]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.New("bad value " + v)
+	}
+	return n, nil
+}
+
+// Time of day range, like "01:00-06:00". Can wrap over midnight ("23:00-05:00").
+type Window struct {
+	expr string
+	from int // Minutes since midnight
+	to   int
+}
+
+func ParseWindow(expr string) (*Window, error) {
+	from, to, ok := strings.Cut(strings.TrimSpace(expr), "-")
+	if !ok {
+		return nil, errors.New("window should look like HH:MM-HH:MM, got " + expr)
+	}
+	w := &Window{expr: expr}
+	var err error
+	if w.from, err = clockMinutes(from); err != nil {
+		return nil, err
+	}
+	if w.to, err = clockMinutes(to); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func clockMinutes(clock string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, errors.New("bad time of day " + clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w *Window) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return m >= w.from && m < w.to
+	}
+	return m >= w.from || m < w.to
+}
+
+func (w *Window) String() string {
+	return w.expr
+}
@@ -0,0 +1,127 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{expr: "0 4 * * *"},
+		{expr: "*/15 * * * *"},
+		{expr: "10-50/10 1,13 * jan-mar mon-fri"},
+		{expr: "0 0 * * 7"},
+		{expr: "@daily"},
+		{expr: "@every 6h"},
+		{expr: "  @hourly  "},
+		{expr: "0 4 * *", wantErr: true},
+		{expr: "60 * * * *", wantErr: true},
+		{expr: "* 24 * * *", wantErr: true},
+		{expr: "* * 0 * *", wantErr: true},
+		{expr: "* * * 13 *", wantErr: true},
+		{expr: "* * * * 8", wantErr: true},
+		{expr: "5-1 * * * *", wantErr: true},
+		{expr: "*/0 * * * *", wantErr: true},
+		{expr: "x * * * *", wantErr: true},
+		{expr: "@every 30s", wantErr: true},
+		{expr: "@every soon", wantErr: true},
+		{expr: "@fortnightly", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if err == nil && s.String() == "" {
+				t.Error("String() is empty")
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation(time.DateTime, s, time.Local)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+	tests := []struct {
+		expr  string
+		after string
+		want  string // "" for never.
+	}{
+		{expr: "0 4 * * *", after: "2026-03-10 03:59:30", want: "2026-03-10 04:00:00"},
+		{expr: "0 4 * * *", after: "2026-03-10 04:00:00", want: "2026-03-11 04:00:00"}, // Strictly after.
+		{expr: "*/15 * * * *", after: "2026-03-10 10:16:00", want: "2026-03-10 10:30:00"},
+		{expr: "0 0 1 * *", after: "2026-12-15 12:00:00", want: "2027-01-01 00:00:00"},
+		{expr: "30 9 * * mon-fri", after: "2026-03-13 10:00:00", want: "2026-03-16 09:30:00"}, // Friday -> Monday.
+		{expr: "0 0 * * 7", after: "2026-03-10 00:00:00", want: "2026-03-15 00:00:00"},        // 7 is sunday too.
+		{expr: "0 0 13 * fri", after: "2026-03-14 00:00:00", want: "2026-03-20 00:00:00"},     // Both day fields: either one will do.
+		{expr: "0 0 29 feb *", after: "2026-01-01 00:00:00", want: "2028-02-29 00:00:00"},
+		{expr: "0 0 31 2 *", after: "2026-01-01 00:00:00", want: ""},
+		{expr: "@hourly", after: "2026-03-10 10:00:01", want: "2026-03-10 11:00:00"},
+		{expr: "@every 6h", after: "2026-03-10 10:17:42", want: "2026-03-10 16:17:42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr+" after "+tt.after, func(t *testing.T) {
+			s, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.Next(at(tt.after))
+			if tt.want == "" {
+				if !got.IsZero() {
+					t.Errorf("Next = %v, want never", got)
+				}
+				return
+			}
+			if !got.Equal(at(tt.want)) {
+				t.Errorf("Next = %v, want %v", got.Format(time.DateTime), tt.want)
+			}
+		})
+	}
+}
+
+func TestWindow(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+		inside  []string
+		outside []string
+	}{
+		{expr: "01:00-06:00", inside: []string{"01:00", "03:30", "05:59"}, outside: []string{"00:59", "06:00", "12:00"}},
+		{expr: "23:00-05:00", inside: []string{"23:00", "23:59", "00:00", "04:59"}, outside: []string{"05:00", "12:00", "22:59"}},
+		{expr: " 08:00 - 09:00 ", inside: []string{"08:30"}, outside: []string{"09:00"}},
+		{expr: "01:00", wantErr: true},
+		{expr: "25:00-06:00", wantErr: true},
+		{expr: "1am-6am", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			w, err := ParseWindow(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			clock := func(s string) time.Time {
+				c, _ := time.Parse("15:04", s)
+				return time.Date(2026, 3, 10, c.Hour(), c.Minute(), 0, 0, time.Local)
+			}
+			for _, s := range tt.inside {
+				if !w.Contains(clock(s)) {
+					t.Errorf("%s isn't inside", s)
+				}
+			}
+			for _, s := range tt.outside {
+				if w.Contains(clock(s)) {
+					t.Errorf("%s is inside", s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package secrets
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Adapter config values can point to secrets instead of carrying them:
+//
+//	${env:KEENETIC_PASS}        -- server's environment variable
+//	${file:/run/secrets/pihole} -- contents of a file, trailing newline dropped
+//	${secret:router}            -- one of server config's secrets
+//
+// References can be a part of a value too: keenetic_login: "admin:${env:KEENETIC_PASS}". They're resolved right before adapter needs them, never stored.
+// Playbooks come from whoever can reach the server, so on their own they only get ${secret:}. Otherwise "${file:/etc/shadow}" with origin
+// pointing elsewhere ships server's files away. env and file references are for server's config (profiles, and secrets themselves:
+// "router: ${env:KEENETIC_PASS}"), a playbook can only have one that config has too.
+var refPattern = regexp.MustCompile(`\$\{(env|file|secret):([^}]*)\}`)
+
+// Secrets shorter than that aren't redacted, or every "a" in the output would be.
+const minRedacted = 4
+
+const Mask = "***"
+
+// Resolves references, and remembers every secret it came across so that they can be cut out of whatever gets shown to people.
+type Store struct {
+	mu     sync.Mutex
+	config func() (keyed map[string]string, trusted []string, err error) // Secrets of server's config and every value config has, read anew every time (config can change).
+	known  map[string]bool
+}
+
+func NewStore(config func() (keyed map[string]string, trusted []string, err error)) *Store {
+	return &Store{config: config, known: make(map[string]bool)}
+}
+
+// Copy of conf with references resolved. Conf itself is left alone, it's what gets stored.
+// References are only resolved in keys secret says hold credentials. Anywhere else they're an error: "origin: https://evil/${env:X}" is how secrets leave the server.
+func (s *Store) Resolve(conf map[string]string, secret func(key string) bool) (map[string]string, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	keyed, trusted, err := s.config()
+	if err != nil {
+		return nil, err
+	}
+	resolved := make(map[string]string, len(conf))
+	for k, v := range conf {
+		if HasRef(v) && !secret(k) {
+			return nil, errors.New(k + ": secret references are only allowed in credentials")
+		}
+		value, err := s.resolveValue(v, keyed, serverRefs(trusted))
+		if err != nil {
+			return nil, errors.New(k + ": " + err.Error())
+		}
+		if Sensitive(k) { // Credentials in clear are still credentials.
+			s.remember(value)
+			if _, pass, found := strings.Cut(value, ":"); found { // login:password
+				s.remember(pass)
+			}
+		}
+		resolved[k] = value
+	}
+	return resolved, nil
+}
+
+// Errors about env and file references config doesn't have. Resolve does the same, this is for telling early, before a job changes anything.
+func (s *Store) Check(conf map[string]string) error {
+	_, trusted, err := s.config()
+	if err != nil {
+		return err
+	}
+	allowed := serverRefs(trusted)
+	for k, v := range conf {
+		for _, m := range refPattern.FindAllStringSubmatch(v, -1) {
+			if m[1] != "secret" && !allowed[m[0]] {
+				return errors.New(k + ": " + m[0] + ": " + errUntrusted.Error())
+			}
+		}
+	}
+	return nil
+}
+
+var errUntrusted = errors.New("env and file references only work in server's config, playbooks get ${secret:name}")
+
+// env and file references server's config has.
+func serverRefs(trusted []string) map[string]bool {
+	refs := make(map[string]bool)
+	for _, v := range trusted {
+		for _, ref := range refPattern.FindAllString(v, -1) {
+			refs[ref] = true
+		}
+	}
+	return refs
+}
+
+// allowed are env and file references that can be resolved, any ${secret:} can.
+func (s *Store) resolveValue(v string, keyed map[string]string, allowed map[string]bool) (string, error) {
+	var firstErr error
+	out := refPattern.ReplaceAllStringFunc(v, func(ref string) string {
+		m := refPattern.FindStringSubmatch(ref)
+		secret, err := s.lookup(m[1], m[2], keyed, allowed[ref])
+		if err != nil {
+			if firstErr == nil {
+				firstErr = errors.New(ref + ": " + err.Error())
+			}
+			return ""
+		}
+		s.remember(secret)
+		return secret
+	})
+	return out, firstErr
+}
+
+func (s *Store) lookup(kind string, name string, keyed map[string]string, trusted bool) (string, error) {
+	if kind != "secret" && !trusted {
+		return "", errUntrusted
+	}
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("not set in server's environment")
+		}
+		return v, nil
+	case "file":
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	default:
+		v, ok := keyed[name]
+		if !ok {
+			return "", errors.New("no such secret in server's config")
+		}
+		// Secret can say where it really is, config is trusted with that. Not with other secrets though, that's how loops happen.
+		for _, m := range refPattern.FindAllStringSubmatch(v, -1) {
+			if m[1] == "secret" {
+				return "", errors.New("secret " + name + " points to another secret")
+			}
+		}
+		return s.resolveValue(v, nil, serverRefs([]string{v}))
+	}
+}
+
+func (s *Store) remember(secret string) {
+	if len(secret) < minRedacted {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.known[secret] = true
+}
+
+// Text with every secret store has seen replaced by ***.
+func (s *Store) Redact(text string) string {
+	s.mu.Lock()
+	known := make([]string, 0, len(s.known))
+	for secret := range s.known {
+		known = append(known, secret)
+	}
+	s.mu.Unlock()
+	sort.Slice(known, func(i, j int) bool { return len(known[i]) > len(known[j]) }) // "admin:hunter2" before "hunter2".
+	for _, secret := range known {
+		text = strings.ReplaceAll(text, secret, Mask)
+	}
+	return text
+}
+
+// Whether config key holds credentials, judging by it's name (keenetic_login, pihole_apikey, ...).
+func Sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"login", "pass", "key", "token", "secret", "auth"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func HasRef(value string) bool {
+	return refPattern.MatchString(value)
+}
+
+// Config value fit for showing: ones with references stay (that's where secrets are, not here), credentials in clear don't.
+func MaskValue(key string, value string) string {
+	if !Sensitive(key) || value == "" || HasRef(value) {
+		return value
+	}
+	return Mask
+}
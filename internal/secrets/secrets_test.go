@@ -0,0 +1,61 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	t.Setenv("AVPN2_TEST_PASS", "hunter2")
+	file := filepath.Join(t.TempDir(), "pihole")
+	if err := os.WriteFile(file, []byte("apikey\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyed := map[string]string{"router": "hunter3", "env": "${env:AVPN2_TEST_PASS}", "loop": "${secret:router}"}
+	tests := []struct {
+		name    string
+		value   string
+		trusted []string // Values of server's config.
+		want    string
+		wantErr string
+	}{
+		{name: "plain", value: "admin:hunter2", want: "admin:hunter2"},
+		{name: "secret", value: "admin:${secret:router}", want: "admin:hunter3"},
+		{name: "no such secret", value: "${secret:nope}", wantErr: "no such secret"},
+		{name: "env from playbook", value: "admin:${env:AVPN2_TEST_PASS}", wantErr: "only work in server's config"},
+		{name: "file from playbook", value: "${file:" + file + "}", wantErr: "only work in server's config"},
+		{name: "env config has", value: "admin:${env:AVPN2_TEST_PASS}", trusted: []string{"root:${env:AVPN2_TEST_PASS}"}, want: "admin:hunter2"},
+		{name: "file config has", value: "${file:" + file + "}", trusted: []string{"${file:" + file + "}"}, want: "apikey"},
+		{name: "other file than config has", value: "${file:/etc/passwd}", trusted: []string{"${file:" + file + "}"}, wantErr: "only work in server's config"},
+		{name: "secret pointing to env", value: "admin:${secret:env}", want: "admin:hunter2"},
+		{name: "secret pointing to secret", value: "${secret:loop}", wantErr: "points to another secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStore(func() (map[string]string, []string, error) { return keyed, tt.trusted, nil })
+			conf := map[string]string{"keenetic_login": tt.value}
+			checkErr := s.Check(conf)
+			resolved, err := s.Resolve(conf, func(key string) bool { return true })
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				if strings.Contains(tt.wantErr, "server's config") && checkErr == nil {
+					t.Error("Check let it through")
+				}
+				return
+			}
+			if err != nil || checkErr != nil {
+				t.Fatalf("err = %v, Check = %v", err, checkErr)
+			}
+			if resolved["keenetic_login"] != tt.want {
+				t.Errorf("resolved to %q, want %q", resolved["keenetic_login"], tt.want)
+			}
+			if tt.value != tt.want && !strings.Contains(s.Redact("got "+tt.want), Mask) {
+				t.Error("resolved secret isn't redacted")
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Seals what server keeps in db (playbooks, journal) with AES-256-GCM, so that router's password isn't lying around in clear.
+// Key is kept in a file of it's own, hex encoded. Lose it and the db is lost too.
+type Vault struct {
+	aead cipher.AEAD
+}
+
+// Sealed blobs start with this, anything else is from before there was a vault.
+var sealedMagic = []byte("AVPN2SEALED1")
+
+// Reads key from path, or makes a new one there if there's no file yet.
+func OpenVault(path string) (*Vault, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return newVault(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("bad key in " + path + " (expected 64 hex digits)")
+	}
+	return newVault(key)
+}
+
+func newVault(key []byte) (*Vault, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Vault{aead: aead}, nil
+}
+
+func (v *Vault) Seal(plain []byte) []byte {
+	nonce := make([]byte, v.aead.NonceSize())
+	rand.Read(nonce)
+	out := append([]byte{}, sealedMagic...)
+	out = append(out, nonce...)
+	return v.aead.Seal(out, nonce, plain, sealedMagic)
+}
+
+// Plain contents of blob. sealed is false for blobs written before there was a vault, those are returned as they are.
+func (v *Vault) Open(blob []byte) (plain []byte, sealed bool, err error) {
+	if !bytes.HasPrefix(blob, sealedMagic) {
+		return blob, false, nil
+	}
+	rest := blob[len(sealedMagic):]
+	if len(rest) < v.aead.NonceSize() {
+		return nil, true, errors.New("sealed blob is too short")
+	}
+	plain, err = v.aead.Open(nil, rest[:v.aead.NonceSize()], rest[v.aead.NonceSize():], sealedMagic)
+	if err != nil {
+		return nil, true, errors.New("can't unseal, wrong key? " + err.Error())
+	}
+	return plain, true, nil
+}
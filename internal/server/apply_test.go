@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sergds/autovpn2/internal/secrets"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+// Server the way ServerMain makes it, minus grpc, mDNS and background loops. Everything lives in test's temp dir.
+func testServer(t *testing.T) *AutoVPNServer {
+	t.Helper()
+	dir := t.TempDir()
+	pbdb, err := openPlaybookDB(filepath.Join(dir, "avpn2_playbooks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pbdb.Close() })
+	srv := &AutoVPNServer{playbookDB: pbdb, jobs: make(map[string]*runningJob), config: &configFile{path: filepath.Join(dir, "avpn2_server.yaml")}}
+	srv.secrets = secrets.NewStore(srv.serverSecrets)
+	if srv.vault, err = secrets.OpenVault(filepath.Join(dir, "avpn2.key")); err != nil {
+		t.Fatal(err)
+	}
+	srv.locks = NewLockManager(time.Minute, time.Minute)
+	srv.updater = NewAutoUpdater(srv)
+	srv.reconciler = NewReconciler(srv)
+	return srv
+}
+
+func nullPlaybook(name string, hosts ...string) string {
+	yaml := "name: " + name + "\nadapters: {routes: \"null\", dns: \"null\"}\ninterface: Wireguard1\nhosts:\n"
+	for _, h := range hosts {
+		yaml += "- " + h + "\n"
+	}
+	return yaml
+}
+
+func apply(t *testing.T, srv *AutoVPNServer, yaml string) error {
+	t.Helper()
+	tb := NewTaskBuilder(srv)
+	if err := tb.Apply(yaml); err != nil {
+		return err
+	}
+	return srv.RunTask(context.Background(), tb, func(upd *executor.ExecutorUpdate) {})
+}
+
+// DNS and routes steps run at the same time after FetchIPs, while DNS side saves playbook. Run with -race.
+func TestApplyParallelSteps(t *testing.T) {
+	tests := []struct {
+		name      string
+		revisions [][]string // Hosts of every apply, in order.
+		want      []string   // Hosts playbook ends up with addresses for.
+	}{
+		{name: "fresh apply", revisions: [][]string{{"1.2.3.4", "5.6.7.8"}}, want: []string{"4.3.2.1.in-addr.arpa", "8.7.6.5.in-addr.arpa"}},
+		{name: "network", revisions: [][]string{{"10.1.0.0/16"}}, want: []string{"10.1.0.0/16"}},
+		{name: "re-apply drops removed host", revisions: [][]string{{"1.2.3.4", "5.6.7.8"}, {"5.6.7.8"}}, want: []string{"8.7.6.5.in-addr.arpa"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := testServer(t)
+			for _, hosts := range tt.revisions {
+				if err := apply(t, srv, nullPlaybook("test", hosts...)); err != nil {
+					t.Fatalf("apply failed: %v", err)
+				}
+			}
+			pbook, ok := srv.playbooks()["test"]
+			if !ok {
+				t.Fatal("playbook isn't in db")
+			}
+			if !pbook.GetInstallState() || pbook.Busy {
+				t.Errorf("installed = %v, busy = %v, want installed and not busy", pbook.GetInstallState(), pbook.Busy)
+			}
+			got := make([]string, 0)
+			for h := range pbook.PlaybookAddrs {
+				got = append(got, h)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("PlaybookAddrs has %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Several playbooks at once, each with it's own parallel steps.
+func TestApplyConcurrentPlaybooks(t *testing.T) {
+	srv := testServer(t)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- apply(t, srv, nullPlaybook(fmt.Sprintf("test%v", i), fmt.Sprintf("10.0.0.%v", i+1)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("apply failed: %v", err)
+		}
+	}
+	if n := len(srv.playbooks()); n != 8 {
+		t.Errorf("%v playbooks in db, want 8", n)
+	}
+}
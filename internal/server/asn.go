@@ -0,0 +1,52 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sergds/autovpn2/internal/playbook"
+)
+
+// Server has to have somewhere to look playbook's ASNs up. Whether they're valid is checked by Validate.
+func (s *AutoVPNServer) checkAsns(pbook *playbook.Playbook) error {
+	if len(pbook.Asns) != 0 && s.asndb == nil {
+		return errors.New("playbook has asns, but server has no ASN db (set AVPN2_ASNDB)")
+	}
+	return nil
+}
+
+// Name ASN's prefixes are kept under in PlaybookAddrs, and route comments get.
+func asnHost(asn uint32) string {
+	return fmt.Sprintf("AS%d", asn)
+}
+
+func isAsnHost(host string) bool {
+	if !strings.HasPrefix(host, "AS") {
+		return false
+	}
+	_, err := playbook.ParseASN(host)
+	return err == nil
+}
+
+// Prefixes announced by ASN, only of families playbook wants. Unlike raw networks in hosts, there's a lot of them and the v6 ones are rarely wanted.
+func (s *AutoVPNServer) asnPrefixes(pbook *playbook.Playbook, as string) (string, []string, error) {
+	asn, err := playbook.ParseASN(as)
+	if err != nil {
+		return "", nil, err
+	}
+	if s.asndb == nil {
+		return "", nil, errors.New("no ASN db (set AVPN2_ASNDB)")
+	}
+	prefixes, err := s.asndb.Prefixes(asn)
+	if err != nil {
+		return "", nil, err
+	}
+	nets := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		if (p.Addr().Is4() && pbook.WantsV4()) || (p.Addr().Is6() && pbook.WantsV6()) {
+			nets = append(nets, p.String())
+		}
+	}
+	return asnHost(asn), nets, nil
+}
@@ -1,44 +1,205 @@
 package server
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/sergds/autovpn2/internal/playbook"
+	"github.com/sergds/autovpn2/internal/schedule"
+	"github.com/sergds/autovpn2/internal/server/executor"
 )
 
 // More like AutoSlow, because of how unscalable and unoptimized it is. Needs redesign and refactor like client code. Someday i'll have the time for that ~sigh~
 type AutoUpdater struct {
-	cronTable map[string]int   // Contains entries for auto update intervals. playbook name <==> interval in hours.
-	ageTable  map[string]int64 // Contains live difference of Now and Install time Unix (seconds) timestamps. Basically playbook's age.
-	server    *AutoVPNServer
+	cronTable  map[string]*updaterEntry   // Contains entries for auto updates. playbook name <==> when and how often.
+	running    map[string]bool            // Playbooks with a refresh job in flight, so we don't pile them up.
+	failures   map[string]*refreshFailure // Playbooks whose last refresh failed. Resolver or adapters being down shouldn't get hammered every tick.
+	mu         sync.Mutex                 // Table gets touched from grpc tasks and updater loop at once.
+	ttlFloor   int                        // Server defaults for TTL driven refresh, in seconds. Playbook can override them.
+	ttlCeiling int
+	server     *AutoVPNServer
+}
+
+type updaterEntry struct {
+	sched  *schedule.Schedule // nil if playbook is only TTL refreshed (or not at all)
+	window *schedule.Window   // nil means any time of day
+	jitter time.Duration
+	basis  int64 // InstallTime that next was worked out from. Refresh bumps InstallTime, so then it's time to work out a new one.
+	next   int64 // When the next full refresh is due, jitter included.
+}
+
+// Works out when the next full refresh is due, counting from basis (playbook's InstallTime). false if schedule never fires.
+func (e *updaterEntry) plan(basis int64) bool {
+	e.basis = basis
+	e.next = 0
+	next := e.sched.Next(time.Unix(basis, 0))
+	if next.IsZero() {
+		return false
+	}
+	if e.jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(e.jitter))))
+	}
+	e.next = next.Unix()
+	return true
+}
+
+// Failed refresh is rolled back, so InstallTime stays and schedule would say it's due right away, on every tick.
+// Instead it's tried again later and later, each failure doubling the wait, up to refreshBackoffMax (or playbook's next slot, whichever comes first).
+type refreshFailure struct {
+	count int   // Failures in a row.
+	retry int64 // Not before then.
 }
 
+const (
+	refreshBackoff    = time.Minute
+	refreshBackoffMax = time.Hour
+)
+
 func NewAutoUpdater(server *AutoVPNServer) *AutoUpdater {
-	return &AutoUpdater{cronTable: make(map[string]int), ageTable: make(map[string]int64), server: server}
+	u := &AutoUpdater{cronTable: make(map[string]*updaterEntry), running: make(map[string]bool), failures: make(map[string]*refreshFailure), server: server}
+	u.ttlFloor = envSeconds("AVPN2_TTL_FLOOR", 60)
+	u.ttlCeiling = envSeconds("AVPN2_TTL_CEILING", 86400)
+	return u
+}
+
+func envSeconds(name string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || v < 0 {
+		return def
+	}
+	return v
+}
+
+// TTL clamps for playbook. Playbook's own take precedence over server's.
+func (u *AutoUpdater) ttlBounds(pbook *playbook.Playbook) (floor int, ceiling int) {
+	floor, ceiling = u.ttlFloor, u.ttlCeiling
+	if pbook.Ttlfloor > 0 {
+		floor = pbook.Ttlfloor
+	}
+	if pbook.Ttlceiling > 0 {
+		ceiling = pbook.Ttlceiling
+	}
+	return floor, ceiling
 }
 
 func (u *AutoUpdater) Tick() {
-	books := GetAllPlaybooksFromDB(u.server.playbookDB)
-	for k, _ := range u.cronTable {
-		u.ageTable[k] = time.Now().Unix() - books[k].InstallTime
-		//log.Println(k, v, u.ageTable[k], u.ageTable[k]/3600)
+	books := u.server.playbooks()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	for k, e := range u.cronTable {
+		if books[k] == nil || u.running[k] { // Got removed (UpdateUpdaterTable will collect it) or is already being refreshed.
+			continue
+		}
+		floor, ceiling := u.ttlBounds(books[k])
+		if f := u.failures[k]; f != nil && now.Unix() < f.retry {
+			continue
+		}
+		if e.window != nil && !e.window.Contains(now) {
+			continue // Not allowed to touch anything right now, whatever is due will wait for the window.
+		}
+		if e.sched != nil {
+			if e.basis != books[k].InstallTime {
+				if e.plan(books[k].InstallTime) {
+					log.Println("Next update of " + k + " is at " + time.Unix(e.next, 0).Format(time.DateTime))
+				}
+			}
+			if e.next != 0 && now.Unix() >= e.next {
+				log.Println(k + " needs updating (schedule: " + e.sched.String() + ")")
+				u.running[k] = true
+				go u.refresh(k, nil)
+				continue
+			}
+		}
+		if books[k].Ttlrefresh {
+			if expired := books[k].ExpiredHosts(now.Unix(), floor, ceiling); len(expired) != 0 {
+				log.Println(k+" has hosts with expired TTL: ", strings.Join(expired, ", "))
+				u.running[k] = true
+				go u.refresh(k, expired)
+			}
+		}
+	}
+}
+
+// Runs a refresh job for playbook in background and remembers if it failed. Job record has the rest. nil hosts means refresh all of them.
+func (u *AutoUpdater) refresh(name string, hosts []string) {
+	var err error
+	defer func() {
+		u.mu.Lock()
+		delete(u.running, name)
+		if err != nil {
+			u.failed(name, time.Now(), err)
+		} else {
+			delete(u.failures, name)
+		}
+		u.mu.Unlock()
+	}()
+	builder := NewTaskBuilder(u.server)
+	builder.Refresh(name, hosts)
+	err = u.server.RunTask(context.Background(), builder, func(upd *executor.ExecutorUpdate) {
+		if upd.StepMessage != "" {
+			log.Println("[refresh " + name + "] [" + upd.CurrentStep + "] " + upd.StepMessage)
+		}
+	})
+	if err == nil {
+		log.Println("refresh of " + name + " done")
 	}
+	u.server.UpdateUpdaterTable()
+}
 
-	for k, v := range u.cronTable {
-		if int(u.ageTable[k]/3600) > v {
-			log.Println(k+" needs updating:", u.ageTable[k]/3600)
+// Records a failed refresh and works out when to try again. Caller holds u.mu.
+func (u *AutoUpdater) failed(name string, now time.Time, err error) {
+	f := u.failures[name]
+	if f == nil {
+		f = &refreshFailure{}
+		u.failures[name] = f
+	}
+	f.count++
+	wait := refreshBackoff
+	for i := 1; i < f.count && wait < refreshBackoffMax; i++ {
+		wait *= 2
+	}
+	retry := now.Add(min(wait, refreshBackoffMax))
+	if e := u.cronTable[name]; e != nil && e.sched != nil {
+		if slot := e.sched.Next(now); !slot.IsZero() && slot.Before(retry) {
+			retry = slot
 		}
+		e.next = retry.Unix()
 	}
+	f.retry = retry.Unix()
+	log.Printf("refresh of %s failed (and got rolled back), %v time(s) in a row, next try at %s: %s", name, f.count, retry.Format(time.DateTime), err)
 }
 
-func (u *AutoUpdater) UpdateEntry(name string, interval int) {
-	u.cronTable[name] = interval
+// Adds or updates playbook's entry. Entry is left alone if nothing about the schedule changed, so the rolled jitter sticks.
+func (u *AutoUpdater) UpdateEntry(name string, sched *schedule.Schedule, window *schedule.Window, jitter time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if e, ok := u.cronTable[name]; ok && fmt.Sprint(e.sched) == fmt.Sprint(sched) && fmt.Sprint(e.window) == fmt.Sprint(window) && e.jitter == jitter {
+		return
+	}
+	u.cronTable[name] = &updaterEntry{sched: sched, window: window, jitter: jitter, basis: -1}
 }
 
-func (u *AutoUpdater) GetEntries() map[string]int {
-	return u.cronTable
+func (u *AutoUpdater) GetEntries() map[string]*schedule.Schedule {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entries := make(map[string]*schedule.Schedule)
+	for k, e := range u.cronTable {
+		entries[k] = e.sched
+	}
+	return entries
 }
 
 func (u *AutoUpdater) DelEntry(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	delete(u.cronTable, name)
-	delete(u.ageTable, name)
+	delete(u.failures, name)
 }
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sergds/autovpn2/internal/schedule"
+)
+
+func TestRefreshBackoff(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.Local)
+	tests := []struct {
+		name     string
+		sched    string // "" for TTL only playbook.
+		failures int
+		want     time.Duration // From now to next try.
+	}{
+		{name: "first failure", failures: 1, want: time.Minute},
+		{name: "doubles", failures: 3, want: 4 * time.Minute},
+		{name: "capped", failures: 20, want: refreshBackoffMax},
+		{name: "next slot comes first", sched: "*/2 * * * *", failures: 5, want: 2 * time.Minute},
+		{name: "next slot is later", sched: "@daily", failures: 2, want: 2 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := NewAutoUpdater(nil)
+			e := &updaterEntry{next: now.Add(-time.Hour).Unix()}
+			if tt.sched != "" {
+				e.sched = mustParse(t, tt.sched)
+			}
+			u.cronTable["test"] = e
+			for i := 0; i < tt.failures; i++ {
+				u.failed("test", now, errors.New("router is down"))
+			}
+			f := u.failures["test"]
+			if f.count != tt.failures {
+				t.Errorf("count = %v, want %v", f.count, tt.failures)
+			}
+			if got := time.Unix(f.retry, 0).Sub(now); got != tt.want {
+				t.Errorf("next try in %v, want %v", got, tt.want)
+			}
+			if tt.sched != "" && e.next != f.retry {
+				t.Errorf("schedule says next refresh is at %v, want %v", time.Unix(e.next, 0), time.Unix(f.retry, 0))
+			}
+		})
+	}
+}
+
+func TestPlanJitter(t *testing.T) {
+	installed := time.Date(2026, 3, 10, 3, 30, 0, 0, time.Local)
+	tests := []struct {
+		name   string
+		sched  string
+		jitter time.Duration
+		from   time.Time // Next refresh lands in from..from+jitter.
+	}{
+		{name: "no jitter", sched: "0 4 * * *", from: installed.Add(30 * time.Minute)},
+		{name: "jitter", sched: "0 4 * * *", jitter: 15 * time.Minute, from: installed.Add(30 * time.Minute)},
+		{name: "interval", sched: "@every 6h", jitter: time.Hour, from: installed.Add(6 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &updaterEntry{sched: mustParse(t, tt.sched), jitter: tt.jitter, basis: -1}
+			for i := 0; i < 50; i++ {
+				if !e.plan(installed.Unix()) {
+					t.Fatal("schedule never fires")
+				}
+				next := time.Unix(e.next, 0)
+				if next.Before(tt.from) || next.After(tt.from.Add(tt.jitter)) {
+					t.Fatalf("next refresh at %v, want within %v of %v", next, tt.jitter, tt.from)
+				}
+			}
+			if e.basis != installed.Unix() {
+				t.Errorf("basis = %v, want %v", e.basis, installed.Unix())
+			}
+		})
+	}
+	e := &updaterEntry{sched: mustParse(t, "0 0 31 2 *"), next: 1}
+	if e.plan(installed.Unix()) || e.next != 0 {
+		t.Errorf("plan of a schedule that never fires = %v, next %v, want false and 0", e.plan(installed.Unix()), e.next)
+	}
+}
+
+func mustParse(t *testing.T, expr string) *schedule.Schedule {
+	t.Helper()
+	s, err := schedule.Parse(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
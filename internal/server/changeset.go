@@ -0,0 +1,198 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+	"github.com/sergds/autovpn2/internal/playbook"
+)
+
+// What has to be done to routes to get from what router has now to what playbook wants.
+type RouteChanges struct {
+	Unchanged []routes.Route
+	Add       []routes.Route
+	Remove    []routes.Route
+	Recreate  []RouteConflict // Wanted route is there, but isn't tagged as ours. Gets deleted and added back with our comment, otherwise undo won't find it.
+}
+
+type RouteConflict struct {
+	Existing routes.Route
+	Wanted   routes.Route
+}
+
+// Same as RouteChanges, but for DNS records.
+type DNSChanges struct {
+	Unchanged []dnsadapters.DNSRecord
+	Add       []dnsadapters.DNSRecord
+	Remove    []dnsadapters.DNSRecord
+}
+
+// Comment prefix of every route we add, whatever playbook it's for. gc finds garbage by it.
+const routeTagPrefix = "[AutoVPN2] Playbook: "
+
+// Comment prefix of every route we add for playbook. Undo, diffs and friends find our routes by it.
+func RouteTag(pbname string) string {
+	return routeTagPrefix + pbname + " Host: "
+}
+
+// Routes playbook wants, one per address. Every address of every host, whatever DNS pinning policy is.
+// Hosts go in sorted order, so an address several hosts share always gets tagged with the same one, and diffs don't see a changed route that isn't.
+func DesiredRoutes(curpb *playbook.Playbook, dnsrecords map[string][]string) []routes.Route {
+	desired := make([]routes.Route, 0)
+	seen := make(map[string]bool)
+	for _, h := range sortedKeys(dnsrecords) {
+		for _, ip := range dnsrecords[h] {
+			if seen[ip] { // Several hosts may share an address. One route is enough.
+				continue
+			}
+			seen[ip] = true
+			desired = append(desired, addrRoute(ip, curpb.Interface, RouteTag(curpb.Name)+h))
+		}
+	}
+	return desired
+}
+
+// Route to an address the way PlaybookAddrs keeps it. Networks are kept with their prefix length.
+func addrRoute(addr string, iface string, comment string) routes.Route {
+	dest, prefix := routes.ParseDestination(addr)
+	return routes.Route{Destination: dest, Prefix: prefix, Gateway: "0.0.0.0", Interface: iface, Comment: comment}
+}
+
+// Compares desired routes with the ones router has. Only routes tagged as playbook's own are ever removed.
+func DiffRoutes(pbname string, desired []routes.Route, current []*routes.Route) *RouteChanges {
+	changes := &RouteChanges{Unchanged: make([]routes.Route, 0), Add: make([]routes.Route, 0), Remove: make([]routes.Route, 0), Recreate: make([]RouteConflict, 0)}
+	want := make(map[string]bool)
+	for _, r := range desired {
+		want[r.Target()+"@"+r.Interface] = true
+	}
+	have := make(map[string]*routes.Route)
+	for _, r := range current {
+		key := r.Target() + "@" + r.Interface
+		ours := strings.HasPrefix(r.Comment, RouteTag(pbname))
+		if ours {
+			have[key] = r
+			if !want[key] {
+				changes.Remove = append(changes.Remove, *r)
+			}
+		} else if want[key] && have[key] == nil {
+			have[key] = r
+		}
+	}
+	for _, r := range desired {
+		cur, ok := have[r.Target()+"@"+r.Interface]
+		switch {
+		case !ok:
+			changes.Add = append(changes.Add, r)
+		case !strings.HasPrefix(cur.Comment, RouteTag(pbname)):
+			changes.Recreate = append(changes.Recreate, RouteConflict{Existing: *cur, Wanted: r})
+		default:
+			changes.Unchanged = append(changes.Unchanged, r)
+		}
+	}
+	return changes
+}
+
+// Name raw IP hosts are stored under: 4.3.2.1.in-addr.arpa for v4, nibbles of the whole address backwards under ip6.arpa for v6.
+func reverseName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0])
+	}
+	const hexdigits = "0123456789abcdef"
+	name := make([]byte, 0, 64+len("ip6.arpa"))
+	v6 := ip.To16()
+	for i := len(v6) - 1; i >= 0; i-- {
+		name = append(name, hexdigits[v6[i]&0xf], '.', hexdigits[v6[i]>>4], '.')
+	}
+	return string(name) + "ip6.arpa"
+}
+
+// Raw IP, network and ASN hosts have no DNS records of their own.
+func isRawHost(host string) bool {
+	if strings.HasSuffix(host, ".in-addr.arpa") || strings.HasSuffix(host, ".ip6.arpa") || isAsnHost(host) {
+		return true
+	}
+	_, network, _ := playbook.ParseNetwork(host)
+	return network
+}
+
+// Records of every given type adapter has.
+func getRecords(dnsad dnsadapters.DNSAdapter, types []string) ([]dnsadapters.DNSRecord, error) {
+	all := make([]dnsadapters.DNSRecord, 0)
+	for _, t := range types {
+		recs, err := dnsad.GetRecords(t)
+		if err != nil {
+			return all, err
+		}
+		all = append(all, recs...)
+	}
+	return all, nil
+}
+
+// DNS records playbook wants. Raw IPs, networks and ASNs don't get any. Which addresses of a host get pinned depends on playbook's dnspin.
+func DesiredRecords(curpb *playbook.Playbook, dnsrecords map[string][]string) []dnsadapters.DNSRecord {
+	desired := make([]dnsadapters.DNSRecord, 0)
+	for host, ips := range dnsrecords {
+		if isRawHost(host) || len(ips) == 0 {
+			continue
+		}
+		for _, ip := range curpb.Pinned(ips) {
+			addr := net.ParseIP(ip)
+			desired = append(desired, dnsadapters.DNSRecord{Domain: host, Addr: addr, Type: dnsadapters.AddrType(addr)})
+		}
+	}
+	return desired
+}
+
+// Domains which records belong to playbook (or to it's previous revision), so they're fair game for removal.
+// DNS records have no comments to tag them with, unlike routes.
+func OwnedDomains(pbooks ...*playbook.Playbook) map[string]bool {
+	owned := make(map[string]bool)
+	for _, pbook := range pbooks {
+		if pbook == nil {
+			continue
+		}
+		for _, h := range pbook.Hosts {
+			owned[h] = true
+		}
+		for h := range pbook.Custom {
+			owned[h] = true
+		}
+		for h := range pbook.PlaybookSourced {
+			owned[h] = true
+		}
+		for h := range pbook.PlaybookAddrs {
+			owned[h] = true
+		}
+	}
+	return owned
+}
+
+// Compares desired records with the ones DNS has. Records of domains we don't own are never touched.
+func DiffRecords(desired []dnsadapters.DNSRecord, current []dnsadapters.DNSRecord, owned map[string]bool) *DNSChanges {
+	changes := &DNSChanges{Unchanged: make([]dnsadapters.DNSRecord, 0), Add: make([]dnsadapters.DNSRecord, 0), Remove: make([]dnsadapters.DNSRecord, 0)}
+	want := make(map[string]bool)
+	for _, r := range desired {
+		want[r.Domain+"@"+r.Addr.String()] = true
+	}
+	have := make(map[string]bool)
+	for _, r := range current {
+		if !owned[r.Domain] && !want[r.Domain+"@"+r.Addr.String()] {
+			continue
+		}
+		have[r.Domain+"@"+r.Addr.String()] = true
+		if !want[r.Domain+"@"+r.Addr.String()] {
+			changes.Remove = append(changes.Remove, r)
+		}
+	}
+	for _, r := range desired {
+		if have[r.Domain+"@"+r.Addr.String()] {
+			changes.Unchanged = append(changes.Unchanged, r)
+		} else {
+			changes.Add = append(changes.Add, r)
+		}
+	}
+	return changes
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+	"github.com/sergds/autovpn2/internal/playbook"
+)
+
+func targets(rs []routes.Route) []string {
+	out := make([]string, 0)
+	for _, r := range rs {
+		out = append(out, r.Target()+"@"+r.Interface)
+	}
+	slices.Sort(out)
+	return out
+}
+
+func TestDiffRoutes(t *testing.T) {
+	tag := RouteTag("net")
+	tests := []struct {
+		name         string
+		desired      []routes.Route
+		current      []routes.Route
+		wantAdd      []string
+		wantRemove   []string
+		wantRecreate []string
+		wantSame     []string
+	}{
+		{
+			name:    "fresh",
+			desired: []routes.Route{addrRoute("1.1.1.1", "Wireguard1", tag+"a.com"), addrRoute("10.0.0.0/8", "Wireguard1", tag+"10.0.0.0/8")},
+			wantAdd: []string{"1.1.1.1@Wireguard1", "10.0.0.0/8@Wireguard1"},
+		},
+		{
+			name:       "unchanged, added and removed",
+			desired:    []routes.Route{addrRoute("1.1.1.1", "Wireguard1", tag+"a.com"), addrRoute("2.2.2.2", "Wireguard1", tag+"b.com")},
+			current:    []routes.Route{addrRoute("1.1.1.1", "Wireguard1", tag+"a.com"), addrRoute("3.3.3.3", "Wireguard1", tag+"c.com")},
+			wantAdd:    []string{"2.2.2.2@Wireguard1"},
+			wantRemove: []string{"3.3.3.3@Wireguard1"},
+			wantSame:   []string{"1.1.1.1@Wireguard1"},
+		},
+		{
+			name:       "interface changed",
+			desired:    []routes.Route{addrRoute("1.1.1.1", "Wireguard2", tag+"a.com")},
+			current:    []routes.Route{addrRoute("1.1.1.1", "Wireguard1", tag+"a.com")},
+			wantAdd:    []string{"1.1.1.1@Wireguard2"},
+			wantRemove: []string{"1.1.1.1@Wireguard1"},
+		},
+		{
+			name:    "other playbooks' routes are left alone",
+			current: []routes.Route{addrRoute("1.1.1.1", "Wireguard1", RouteTag("netflix")+"a.com"), addrRoute("2.2.2.2", "Wireguard1", "set by hand"), addrRoute("3.3.3.3", "Wireguard1", WildcardTag("net")+"*.a.com")},
+		},
+		{
+			name:         "untagged route we want",
+			desired:      []routes.Route{addrRoute("1.1.1.1", "Wireguard1", tag+"a.com")},
+			current:      []routes.Route{addrRoute("1.1.1.1", "Wireguard1", "set by hand")},
+			wantRecreate: []string{"1.1.1.1@Wireguard1"},
+		},
+		{
+			name:     "ours wins over untagged twin",
+			desired:  []routes.Route{addrRoute("1.1.1.1", "Wireguard1", tag+"a.com")},
+			current:  []routes.Route{addrRoute("1.1.1.1", "Wireguard1", "set by hand"), addrRoute("1.1.1.1", "Wireguard1", tag+"a.com")},
+			wantSame: []string{"1.1.1.1@Wireguard1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := make([]*routes.Route, 0)
+			for i := range tt.current {
+				current = append(current, &tt.current[i])
+			}
+			changes := DiffRoutes("net", tt.desired, current)
+			recreate := make([]routes.Route, 0)
+			for _, c := range changes.Recreate {
+				recreate = append(recreate, c.Wanted)
+			}
+			for _, c := range []struct {
+				what string
+				got  []routes.Route
+				want []string
+			}{{"Add", changes.Add, tt.wantAdd}, {"Remove", changes.Remove, tt.wantRemove}, {"Recreate", recreate, tt.wantRecreate}, {"Unchanged", changes.Unchanged, tt.wantSame}} {
+				if want := append([]string{}, c.want...); !slices.Equal(targets(c.got), want) {
+					t.Errorf("%s = %v, want %v", c.what, targets(c.got), want)
+				}
+			}
+		})
+	}
+}
+
+func record(domain string, addr string) dnsadapters.DNSRecord {
+	ip := net.ParseIP(addr)
+	return dnsadapters.DNSRecord{Domain: domain, Addr: ip, Type: dnsadapters.AddrType(ip)}
+}
+
+func records(rs []dnsadapters.DNSRecord) []string {
+	out := make([]string, 0)
+	for _, r := range rs {
+		out = append(out, r.Domain+"="+r.Addr.String())
+	}
+	slices.Sort(out)
+	return out
+}
+
+func TestDiffRecords(t *testing.T) {
+	tests := []struct {
+		name       string
+		desired    []dnsadapters.DNSRecord
+		current    []dnsadapters.DNSRecord
+		owned      []string
+		wantAdd    []string
+		wantRemove []string
+		wantSame   []string
+	}{
+		{
+			name:    "fresh",
+			desired: []dnsadapters.DNSRecord{record("a.com", "1.1.1.1"), record("a.com", "2001:db8::1")},
+			owned:   []string{"a.com"},
+			wantAdd: []string{"a.com=1.1.1.1", "a.com=2001:db8::1"},
+		},
+		{
+			name:       "address changed",
+			desired:    []dnsadapters.DNSRecord{record("a.com", "1.1.1.2")},
+			current:    []dnsadapters.DNSRecord{record("a.com", "1.1.1.1"), record("b.com", "2.2.2.2")},
+			owned:      []string{"a.com"},
+			wantAdd:    []string{"a.com=1.1.1.2"},
+			wantRemove: []string{"a.com=1.1.1.1"},
+		},
+		{
+			name:       "host dropped",
+			current:    []dnsadapters.DNSRecord{record("a.com", "1.1.1.1")},
+			owned:      []string{"a.com"},
+			wantRemove: []string{"a.com=1.1.1.1"},
+		},
+		{
+			name:    "records of others are left alone",
+			current: []dnsadapters.DNSRecord{record("router.lan", "10.0.2.1")},
+			owned:   []string{"a.com"},
+		},
+		{
+			name:     "someone else's record that we want is kept",
+			desired:  []dnsadapters.DNSRecord{record("router.lan", "10.0.2.1")},
+			current:  []dnsadapters.DNSRecord{record("router.lan", "10.0.2.1"), record("router.lan", "10.0.2.2")},
+			wantSame: []string{"router.lan=10.0.2.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owned := make(map[string]bool)
+			for _, d := range tt.owned {
+				owned[d] = true
+			}
+			changes := DiffRecords(tt.desired, tt.current, owned)
+			for _, c := range []struct {
+				what string
+				got  []dnsadapters.DNSRecord
+				want []string
+			}{{"Add", changes.Add, tt.wantAdd}, {"Remove", changes.Remove, tt.wantRemove}, {"Unchanged", changes.Unchanged, tt.wantSame}} {
+				if want := append([]string{}, c.want...); !slices.Equal(records(c.got), want) {
+					t.Errorf("%s = %v, want %v", c.what, records(c.got), want)
+				}
+			}
+		})
+	}
+}
+
+func TestDesiredRoutes(t *testing.T) {
+	pbook := &playbook.Playbook{Name: "net", Interface: "Wireguard1"}
+	tests := []struct {
+		name  string
+		addrs map[string][]string
+		want  map[string]string // Route target -> host it's tagged with.
+	}{
+		{
+			name:  "one per address",
+			addrs: map[string][]string{"a.com": {"1.1.1.1", "1.1.1.2"}, "10.0.0.0/8": {"10.0.0.0/8"}},
+			want:  map[string]string{"1.1.1.1": "a.com", "1.1.1.2": "a.com", "10.0.0.0/8": "10.0.0.0/8"},
+		},
+		{
+			name:  "shared address goes to the first host",
+			addrs: map[string][]string{"z.com": {"2.2.2.2"}, "m.com": {"2.2.2.2", "3.3.3.3"}, "b.com": {"2.2.2.2"}, "y.com": {"3.3.3.3"}},
+			want:  map[string]string{"2.2.2.2": "b.com", "3.3.3.3": "m.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ { // Map order is random, once isn't proof of anything.
+				got := make(map[string]string)
+				for _, r := range DesiredRoutes(pbook, tt.addrs) {
+					got[r.Target()] = strings.TrimPrefix(r.Comment, RouteTag("net"))
+				}
+				if !maps.Equal(got, tt.want) {
+					t.Fatalf("DesiredRoutes = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
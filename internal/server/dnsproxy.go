@@ -0,0 +1,425 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+	"github.com/sergds/autovpn2/internal/playbook"
+)
+
+// Separates playbook name from wildcard in comments of routes DNS proxy adds. Not " Host: ", so that applies, drift checks and gc don't take them for routes of hosts.
+const wildcardTagSep = " Wildcard: "
+
+// Comment prefix of routes DNS proxy adds for playbook.
+func WildcardTag(pbname string) string {
+	return routeTagPrefix + pbname + wildcardTagSep
+}
+
+// Optional DNS forwarder for playbooks' wildcards, same thing dnsmasq's ipset/nftset do. Pi-hole forwards wildcard domains to it
+// (server=/nflxvideo.net/10.0.2.5#5353), it asks upstream and answers, routing addresses of names that match some playbook's wildcard on the way.
+// These routes live as long as their TTL (clamped like ttlrefresh ones), every answer with the same address extends it.
+// Answers don't wait for the router, routes are added in the background. Client's very first connection may go the usual way, next ones won't.
+type DNSProxy struct {
+	server   *AutoVPNServer
+	upstream string
+	mu       sync.Mutex
+	live     map[string]*wildcardRoute // By endpoint + route target + interface.
+	queue    chan *wildcardBatch       // Routes waiting to be added.
+
+	cacheMu    sync.Mutex
+	installed  map[string]*playbook.Playbook // nil if it has to be read again.
+	cachedConf *ServerConfig                 // Profiles installed were applied with.
+}
+
+type wildcardRoute struct {
+	pbname  string
+	adapter string
+	conf    map[string]string
+	route   routes.Route
+	expires time.Time
+	pending bool // Queued, not on router yet.
+}
+
+// Routes one answer brought, for one playbook.
+type wildcardBatch struct {
+	ep      string
+	pbook   *playbook.Playbook
+	pattern string
+	routes  map[string]*wildcardRoute
+}
+
+func NewDNSProxy(server *AutoVPNServer, upstream string) *DNSProxy {
+	return &DNSProxy{server: server, upstream: upstream, live: make(map[string]*wildcardRoute), queue: make(chan *wildcardBatch, 256)}
+}
+
+// Serves both UDP and TCP on addr, adds and expires routes in the background. Doesn't return unless listening fails.
+func (p *DNSProxy) ListenAndServe(addr string) error {
+	go p.Loop()
+	go p.work()
+	errs := make(chan error, 2)
+	for _, network := range []string{"udp", "tcp"} {
+		srv := &dns.Server{Addr: addr, Net: network, Handler: p}
+		go func() {
+			errs <- srv.ListenAndServe()
+		}()
+	}
+	log.Printf("dns proxy running @ %s, upstream %s", addr, p.upstream)
+	return <-errs
+}
+
+func (p *DNSProxy) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	client := &dns.Client{Net: w.LocalAddr().Network(), Timeout: 5 * time.Second} // Truncated UDP answers make clients come back over TCP, upstream gets asked the same way.
+	resp, _, err := client.Exchange(req, p.upstream)
+	if err != nil {
+		log.Println("dns proxy: upstream failed: " + err.Error())
+		fail := new(dns.Msg)
+		fail.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(fail)
+		return
+	}
+	if len(req.Question) == 1 && resp.Rcode == dns.RcodeSuccess {
+		p.routeAnswer(req.Question[0].Name, resp)
+	}
+	w.WriteMsg(resp)
+}
+
+type wildcardAnswer struct {
+	addr string
+	ttl  uint32
+}
+
+// Installed playbooks, read from db only when something changed. Every query needs them, db scan and unsealing each time is too much.
+func (p *DNSProxy) playbooks() map[string]*playbook.Playbook {
+	conf, err := p.server.config.get()
+	if err != nil {
+		conf = nil // Profiles can't be applied either, playbooks keep adapters they had.
+	}
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	if p.installed == nil || conf != p.cachedConf {
+		p.installed = p.server.installedPlaybooks()
+		p.cachedConf = conf
+	}
+	return p.installed
+}
+
+// Drops cached playbooks. Server calls it whenever a playbook in db changes.
+func (p *DNSProxy) Invalidate() {
+	p.cacheMu.Lock()
+	p.installed = nil
+	p.cacheMu.Unlock()
+}
+
+func (p *DNSProxy) routeAnswer(qname string, resp *dns.Msg) {
+	installed := p.playbooks()
+	for _, pbook := range installed {
+		pattern := pbook.MatchWildcard(qname)
+		if pattern == "" {
+			continue
+		}
+		answers := make([]wildcardAnswer, 0)
+		for _, rr := range resp.Answer { // CNAMEs on the way are fine, addresses at the end of them are what matters.
+			switch rr := rr.(type) {
+			case *dns.A:
+				if pbook.WantsV4() {
+					answers = append(answers, wildcardAnswer{rr.A.String(), rr.Hdr.Ttl})
+				}
+			case *dns.AAAA:
+				if pbook.WantsV6() {
+					answers = append(answers, wildcardAnswer{rr.AAAA.String(), rr.Hdr.Ttl})
+				}
+			}
+		}
+		if len(answers) != 0 {
+			p.route(pbook, pattern, answers, installed)
+		}
+	}
+}
+
+// Targets@interfaces installed playbooks route on endpoint on their own. Proxy doesn't touch these, they're not it's to add or delete.
+func plannedRoutes(ep string, installed map[string]*playbook.Playbook) map[string]bool {
+	planned := make(map[string]bool)
+	for _, pbook := range installed {
+		if routes.Endpoint(pbook.Adapters.Routes, pbook.Adapterconfig.Routes) != ep {
+			continue
+		}
+		for _, r := range DesiredRoutes(pbook, pbook.PlaybookAddrs) {
+			planned[r.Target()+"@"+r.Interface] = true
+		}
+	}
+	return planned
+}
+
+func (p *DNSProxy) route(pbook *playbook.Playbook, pattern string, answers []wildcardAnswer, installed map[string]*playbook.Playbook) {
+	floor, ceiling := p.server.updater.ttlBounds(pbook)
+	ep := routes.Endpoint(pbook.Adapters.Routes, pbook.Adapterconfig.Routes)
+	planned := plannedRoutes(ep, installed)
+	toAdd := make(map[string]*wildcardRoute)
+	now := time.Now()
+	p.mu.Lock()
+	for _, a := range answers {
+		ttl := int(a.ttl)
+		if ttl < floor {
+			ttl = floor
+		}
+		if ceiling > 0 && ttl > ceiling {
+			ttl = ceiling
+		}
+		expires := now.Add(time.Duration(ttl) * time.Second)
+		r := routes.Route{Destination: a.addr, Gateway: "0.0.0.0", Interface: pbook.Interface, Comment: WildcardTag(pbook.Name) + pattern}
+		if planned[r.Target()+"@"+r.Interface] {
+			continue
+		}
+		key := ep + "|" + r.Target() + "@" + r.Interface
+		if e, ok := p.live[key]; ok {
+			if e.expires.Before(expires) {
+				e.expires = expires
+			}
+			continue
+		}
+		e := &wildcardRoute{pbname: pbook.Name, adapter: pbook.Adapters.Routes, conf: pbook.Adapterconfig.Routes, route: r, expires: expires, pending: true}
+		p.live[key] = e
+		toAdd[key] = e
+	}
+	p.mu.Unlock()
+	if len(toAdd) == 0 {
+		return
+	}
+	select {
+	case p.queue <- &wildcardBatch{ep: ep, pbook: pbook, pattern: pattern, routes: toAdd}:
+	default:
+		log.Println("dns proxy: too many routes waiting, not routing answers for " + pattern)
+		p.forget(toAdd)
+	}
+}
+
+func (p *DNSProxy) forget(entries map[string]*wildcardRoute) {
+	p.mu.Lock()
+	for key := range entries {
+		delete(p.live, key)
+	}
+	p.mu.Unlock()
+}
+
+// Adds queued routes. Whatever queued up while it was busy goes in together, one login per router.
+func (p *DNSProxy) work() {
+	for b := range p.queue {
+		batches := []*wildcardBatch{b}
+	drain:
+		for {
+			select {
+			case b := <-p.queue:
+				batches = append(batches, b)
+			default:
+				break drain
+			}
+		}
+		byRouter := make(map[string][]*wildcardBatch)
+		for _, b := range batches {
+			byRouter[b.ep+"|"+b.pbook.Adapters.Routes] = append(byRouter[b.ep+"|"+b.pbook.Adapters.Routes], b)
+		}
+		for _, bs := range byRouter {
+			p.add(bs)
+		}
+	}
+}
+
+// Batches all go to the same router.
+func (p *DNSProxy) add(batches []*wildcardBatch) {
+	first := batches[0]
+	err := p.withAdapter(first.ep, first.pbook.Adapters.Routes, first.pbook.Adapterconfig.Routes, "wildcard routes of "+first.pbook.Name, func(routead routes.RouteAdapter) {
+		for _, b := range batches {
+			for key, e := range b.routes {
+				p.mu.Lock()
+				untracked := p.live[key] != e // Playbook got undone while these waited.
+				p.mu.Unlock()
+				if untracked {
+					continue
+				}
+				err := routead.AddRoute(e.route)
+				p.mu.Lock()
+				if err != nil {
+					delete(p.live, key)
+				} else {
+					e.pending = false
+				}
+				p.mu.Unlock()
+				if err != nil {
+					log.Println("dns proxy: failed to route " + e.route.Target() + " for " + b.pattern + ": " + err.Error())
+				} else {
+					log.Println("dns proxy: routed " + e.route.Target() + " -> " + e.route.Interface + " for " + b.pattern + " (" + b.pbook.Name + ")")
+				}
+			}
+		}
+	})
+	if err != nil {
+		for _, b := range batches {
+			log.Println("dns proxy: not routing answers for " + b.pattern + ": " + err.Error())
+			p.forget(b.routes)
+		}
+	}
+}
+
+// Locks endpoint like any job would, authenticates and hands adapter to do.
+func (p *DNSProxy) withAdapter(ep string, adapter string, conf map[string]string, reason string, do func(routead routes.RouteAdapter)) error {
+	if ep != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		lease, err := p.server.locks.Acquire(ctx, []string{"routes/" + ep}, "dnsproxy-"+newJobID(), reason, nil)
+		cancel()
+		if err != nil {
+			return err
+		}
+		defer lease.Release()
+	}
+	routead := routes.NewRouteAdapter(adapter)
+	if routead == nil {
+		return errors.New("failed to create route adapter " + adapter)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	routead.SetContext(ctx)
+	if err := p.server.authenticate(routead, conf); err != nil {
+		return errors.New("failed to authenticate on " + adapter + ": " + err.Error())
+	}
+	do(routead)
+	return nil
+}
+
+func (p *DNSProxy) Loop() {
+	p.adopt()
+	for {
+		time.Sleep(30 * time.Second)
+		p.expire()
+	}
+}
+
+// Routes proxy added before server restarted are still on routers, but nobody remembers when they run out.
+// Take them back, with the shortest life possible. If they're still needed, next answer extends it.
+func (p *DNSProxy) adopt() {
+	installed := p.playbooks()
+	for _, pbook := range installed {
+		if len(pbook.Wildcards) == 0 {
+			continue
+		}
+		floor, _ := p.server.updater.ttlBounds(pbook)
+		ep := routes.Endpoint(pbook.Adapters.Routes, pbook.Adapterconfig.Routes)
+		err := p.withAdapter(ep, pbook.Adapters.Routes, pbook.Adapterconfig.Routes, "adopting wildcard routes of "+pbook.Name, func(routead routes.RouteAdapter) {
+			cur_routes, err := routead.GetRoutes()
+			if err != nil {
+				log.Println("dns proxy: failed to get routes of " + pbook.Name + ": " + err.Error())
+				return
+			}
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			for _, r := range cur_routes {
+				if !strings.HasPrefix(r.Comment, WildcardTag(pbook.Name)) {
+					continue
+				}
+				key := ep + "|" + r.Target() + "@" + r.Interface
+				if _, ok := p.live[key]; !ok {
+					p.live[key] = &wildcardRoute{pbname: pbook.Name, adapter: pbook.Adapters.Routes, conf: pbook.Adapterconfig.Routes, route: *r, expires: time.Now().Add(time.Duration(floor) * time.Second)}
+				}
+			}
+		})
+		if err != nil {
+			log.Println("dns proxy: failed to adopt routes of " + pbook.Name + ": " + err.Error())
+		}
+	}
+}
+
+// Deletes routes whose TTL ran out. Ones that some playbook routes on it's own by now are just forgotten.
+func (p *DNSProxy) expire() {
+	byEndpoint := make(map[string][]string)
+	p.mu.Lock()
+	now := time.Now()
+	for key, e := range p.live {
+		if !e.pending && now.After(e.expires) {
+			ep, _, _ := strings.Cut(key, "|")
+			byEndpoint[ep] = append(byEndpoint[ep], key)
+		}
+	}
+	p.mu.Unlock()
+	if len(byEndpoint) == 0 {
+		return
+	}
+	installed := p.playbooks()
+	for ep, keys := range byEndpoint {
+		p.mu.Lock()
+		first := p.live[keys[0]]
+		p.mu.Unlock()
+		if first == nil {
+			continue
+		}
+		planned := plannedRoutes(ep, installed)
+		err := p.withAdapter(ep, first.adapter, first.conf, "expiring wildcard routes", func(routead routes.RouteAdapter) {
+			for _, key := range keys {
+				p.mu.Lock()
+				e := p.live[key]
+				if e == nil || e.pending || !time.Now().After(e.expires) { // Extended while we were waiting for the lock.
+					p.mu.Unlock()
+					continue
+				}
+				delete(p.live, key)
+				p.mu.Unlock()
+				if planned[e.route.Target()+"@"+e.route.Interface] {
+					continue
+				}
+				if err := routead.DelRoute(e.route); err != nil {
+					log.Println("dns proxy: failed to delete expired route " + e.route.Target() + ": " + err.Error())
+				} else {
+					log.Println("dns proxy: expired " + e.route.Target() + " (" + e.pbname + ")")
+				}
+			}
+		})
+		if err != nil {
+			log.Println("dns proxy: not expiring routes on " + ep + " this time: " + err.Error())
+		}
+	}
+}
+
+// Forgets playbook's routes, undo has deleted them from router already. Otherwise they'd hang around until they expire, and expiring would delete them again.
+func (p *DNSProxy) Untrack(pbname string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, e := range p.live {
+		if e.pbname == pbname {
+			delete(p.live, key)
+		}
+	}
+}
+
+// How many routes proxy keeps for playbook right now.
+func (p *DNSProxy) Count(pbname string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, e := range p.live {
+		if e.pbname == pbname {
+			n++
+		}
+	}
+	return n
+}
+
+// Server has to run a DNS proxy for playbook's wildcards to mean anything. Whether they're valid is checked by Validate.
+func (s *AutoVPNServer) checkWildcards(pbook *playbook.Playbook) error {
+	if len(pbook.Wildcards) != 0 && s.dnsproxy == nil {
+		return errors.New("playbook has wildcards, but server's DNS proxy is off (set AVPN2_DNSPROXY)")
+	}
+	return nil
+}
+
+// Upstream given without a port gets the usual one.
+func upstreamAddr(upstream string) string {
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		return net.JoinHostPort(upstream, "53")
+	}
+	return upstream
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+func testProxy(t *testing.T) (*AutoVPNServer, *DNSProxy) {
+	t.Helper()
+	srv := testServer(t)
+	srv.dnsproxy = NewDNSProxy(srv, "127.0.0.1:53")
+	return srv, srv.dnsproxy
+}
+
+func wildcardPlaybook(name string, wildcard string, hosts ...string) string {
+	return nullPlaybook(name, hosts...) + "wildcards:\n- \"" + wildcard + "\"\n"
+}
+
+func answer(qname string, addrs ...string) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetQuestion(qname, dns.TypeA)
+	for _, a := range addrs {
+		resp.Answer = append(resp.Answer, &dns.A{Hdr: dns.RR_Header{Name: qname, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(a)})
+	}
+	return resp
+}
+
+func TestProxyPlaybookCache(t *testing.T) {
+	srv, p := testProxy(t)
+	if n := len(p.playbooks()); n != 0 {
+		t.Fatalf("%v playbooks cached before any apply, want 0", n)
+	}
+	if err := apply(t, srv, wildcardPlaybook("wild", "*.example.com")); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if _, ok := p.playbooks()["wild"]; !ok {
+		t.Fatal("applied playbook isn't seen by proxy")
+	}
+	cached := p.playbooks()
+	if p.playbooks()["wild"] != cached["wild"] {
+		t.Error("playbooks were read again, nothing changed")
+	}
+	if err := apply(t, srv, nullPlaybook("other", "1.2.3.4")); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if _, ok := p.playbooks()["other"]; !ok {
+		t.Error("playbook applied after caching isn't seen by proxy")
+	}
+}
+
+func TestProxyQueuesRoutes(t *testing.T) {
+	tests := []struct {
+		name  string
+		qname string
+		addrs []string
+		want  int // Routes proxy ends up with.
+	}{
+		{name: "matching name", qname: "a.example.com.", addrs: []string{"10.9.0.1", "10.9.0.2"}, want: 2},
+		{name: "other name", qname: "a.example.org.", addrs: []string{"10.9.0.1"}, want: 0},
+		{name: "domain itself", qname: "example.com.", addrs: []string{"10.9.0.1"}, want: 0},
+		{name: "address playbook routes anyway", qname: "a.example.com.", addrs: []string{"5.6.7.8"}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, p := testProxy(t)
+			if err := apply(t, srv, wildcardPlaybook("wild", "*.example.com", "5.6.7.8")); err != nil {
+				t.Fatalf("apply failed: %v", err)
+			}
+			p.routeAnswer(tt.qname, answer(tt.qname, tt.addrs...))
+			if n := p.Count("wild"); n != tt.want {
+				t.Fatalf("%v routes right after answer, want %v", n, tt.want)
+			}
+			if tt.want == 0 {
+				return
+			}
+			if len(p.queue) != 1 {
+				t.Fatalf("%v batches queued, want 1", len(p.queue))
+			}
+			go p.work()
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				p.mu.Lock()
+				pending := 0
+				for _, e := range p.live {
+					if e.pending {
+						pending++
+					}
+				}
+				p.mu.Unlock()
+				if pending == 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%v routes still pending", pending)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := p.Count("wild"); n != tt.want {
+				t.Errorf("%v routes after adding, want %v", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyUndoForgetsRoutes(t *testing.T) {
+	srv, p := testProxy(t)
+	if err := apply(t, srv, wildcardPlaybook("wild", "*.example.com", "5.6.7.8")); err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	p.routeAnswer("a.example.com.", answer("a.example.com.", "10.9.0.1", "10.9.0.2"))
+	if n := p.Count("wild"); n != 2 {
+		t.Fatalf("%v routes before undo, want 2", n)
+	}
+	tb := NewTaskBuilder(srv)
+	if err := tb.Undo("wild"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RunTask(context.Background(), tb, func(upd *executor.ExecutorUpdate) {}); err != nil {
+		t.Fatalf("undo failed: %v", err)
+	}
+	if n := p.Count("wild"); n != 0 {
+		t.Errorf("%v routes after undo, want 0", n)
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+	"github.com/sergds/autovpn2/internal/playbook"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+// What changed on adapters behind our back since playbook was applied. Someone deleted a route in router's web UI, Pi-hole restore wiped custom DNS, that kind of stuff.
+type DriftStatus struct {
+	Checked         time.Time
+	Err             string   // Check itself failed (adapter is down or something), nothing is known then.
+	MissingRoutes   []string // Route destinations playbook wants, but router doesn't have.
+	ModifiedRoutes  []string // Router has them, but not as we left them (other interface, comment isn't ours).
+	MissingRecords  []string
+	ModifiedRecords []string // Domain of ours points somewhere else.
+	Repair          string   // What reconciler did about it, if anything.
+}
+
+func (d *DriftStatus) Drifted() bool {
+	return len(d.MissingRoutes)+len(d.ModifiedRoutes)+len(d.MissingRecords)+len(d.ModifiedRecords) != 0
+}
+
+func (d *DriftStatus) String() string {
+	var desc string
+	switch {
+	case d.Err != "":
+		desc = "drift check failed: " + d.Err
+	case !d.Drifted():
+		desc = "in sync"
+	default:
+		parts := make([]string, 0)
+		for _, p := range []struct {
+			what []string
+			desc string
+		}{{d.MissingRoutes, "routes missing"}, {d.ModifiedRoutes, "routes modified"}, {d.MissingRecords, "DNS records missing"}, {d.ModifiedRecords, "DNS records modified"}} {
+			if len(p.what) != 0 {
+				parts = append(parts, fmt.Sprintf("%v %s (%s)", len(p.what), p.desc, strings.Join(p.what, ", ")))
+			}
+		}
+		desc = "DRIFTED: " + strings.Join(parts, "; ")
+	}
+	desc += ", checked " + d.Checked.Format(time.DateTime)
+	if d.Repair != "" {
+		desc += ", " + d.Repair
+	}
+	return desc
+}
+
+// Compares what playbook put on adapters last time (PlaybookAddrs) with what's there now. Doesn't change anything.
+// Adapters that don't talk to anything (null) have nothing to drift from, they're skipped.
+func (s *AutoVPNServer) CheckDrift(ctx context.Context, pbook *playbook.Playbook) *DriftStatus {
+	status := &DriftStatus{Checked: time.Now(), MissingRoutes: make([]string, 0), ModifiedRoutes: make([]string, 0), MissingRecords: make([]string, 0), ModifiedRecords: make([]string, 0)}
+	if routes.Endpoint(pbook.Adapters.Routes, pbook.Adapterconfig.Routes) != "" {
+		if err := s.driftRoutes(ctx, pbook, status); err != nil {
+			status.Err = err.Error()
+			return status
+		}
+	}
+	if dnsadapters.Endpoint(pbook.Adapters.Dns, pbook.Adapterconfig.Dns) != "" {
+		if err := s.driftRecords(ctx, pbook, status); err != nil {
+			status.Err = err.Error()
+		}
+	}
+	for _, list := range [][]string{status.MissingRoutes, status.ModifiedRoutes, status.MissingRecords, status.ModifiedRecords} {
+		sort.Strings(list)
+	}
+	return status
+}
+
+func (s *AutoVPNServer) driftRoutes(ctx context.Context, pbook *playbook.Playbook, status *DriftStatus) error {
+	routead := routes.NewRouteAdapter(pbook.Adapters.Routes)
+	if routead == nil {
+		return errors.New("unknown route adapter " + pbook.Adapters.Routes)
+	}
+	routead.SetContext(ctx)
+	if err := s.authenticate(routead, pbook.Adapterconfig.Routes); err != nil {
+		return errors.New("failed to authenticate on " + pbook.Adapters.Routes + ": " + err.Error())
+	}
+	cur_routes, err := routead.GetRoutes()
+	if err != nil {
+		return errors.New("failed to get routes from " + pbook.Adapters.Routes + ": " + err.Error())
+	}
+	desired := DesiredRoutes(pbook, pbook.PlaybookAddrs)
+	wanted := make(map[string]bool)
+	for _, r := range desired {
+		wanted[r.Target()] = true
+	}
+	changes := DiffRoutes(pbook.Name, desired, cur_routes)
+	modified := make(map[string]bool)
+	for _, c := range changes.Recreate {
+		modified[c.Wanted.Target()] = true
+	}
+	for _, r := range changes.Remove { // Ours, but going somewhere it shouldn't.
+		if dest := r.Target(); wanted[dest] {
+			modified[dest] = true
+		}
+	}
+	for _, r := range changes.Add {
+		if !modified[r.Target()] {
+			status.MissingRoutes = append(status.MissingRoutes, r.Target())
+		}
+	}
+	for dest := range modified {
+		status.ModifiedRoutes = append(status.ModifiedRoutes, dest)
+	}
+	return nil
+}
+
+func (s *AutoVPNServer) driftRecords(ctx context.Context, pbook *playbook.Playbook, status *DriftStatus) error {
+	dnsad := dnsadapters.NewDNSAdapter(pbook.Adapters.Dns)
+	if dnsad == nil {
+		return errors.New("unknown dns adapter " + pbook.Adapters.Dns)
+	}
+	dnsad.SetContext(ctx)
+	if err := s.authenticate(dnsad, pbook.Adapterconfig.Dns); err != nil {
+		return errors.New("failed to authenticate on " + pbook.Adapters.Dns + ": " + err.Error())
+	}
+	recs, err := getRecords(dnsad, pbook.RecordTypes())
+	if err != nil {
+		return errors.New("failed getting records from " + pbook.Adapters.Dns + ": " + err.Error())
+	}
+	changes := DiffRecords(DesiredRecords(pbook, pbook.PlaybookAddrs), recs, OwnedDomains(pbook))
+	modified := make(map[string]bool)
+	for _, r := range changes.Remove { // Domain of ours that points somewhere else now.
+		if _, ok := pbook.PlaybookAddrs[r.Domain]; ok {
+			modified[r.Domain] = true
+		}
+	}
+	for _, r := range changes.Add {
+		if modified[r.Domain] {
+			status.ModifiedRecords = append(status.ModifiedRecords, r.Domain)
+		} else {
+			status.MissingRecords = append(status.MissingRecords, r.Domain)
+		}
+	}
+	return nil
+}
+
+// Background loop that checks installed playbooks for drift every now and then, and puts things back if playbook says so (driftrepair).
+// Check interval is playbook's driftcheck (minutes), or server's AVPN2_DRIFT_INTERVAL (30) if it doesn't say. Negative driftcheck turns checks off.
+type Reconciler struct {
+	server   *AutoVPNServer
+	mu       sync.Mutex
+	status   map[string]*DriftStatus
+	interval time.Duration
+}
+
+func NewReconciler(server *AutoVPNServer) *Reconciler {
+	return &Reconciler{server: server, status: make(map[string]*DriftStatus), interval: time.Duration(envSeconds("AVPN2_DRIFT_INTERVAL", 30)) * time.Minute}
+}
+
+// Last known drift status of playbook, nil if it wasn't checked yet.
+func (r *Reconciler) Status(name string) *DriftStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status[name]
+}
+
+func (r *Reconciler) setStatus(name string, status *DriftStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status[name] = status
+}
+
+func (r *Reconciler) Loop() {
+	for {
+		time.Sleep(1 * time.Minute)
+		r.Tick()
+	}
+}
+
+func (r *Reconciler) Tick() {
+	books := r.server.playbooks()
+	r.mu.Lock()
+	for name := range r.status { // Undone ones.
+		if books[name] == nil {
+			delete(r.status, name)
+		}
+	}
+	r.mu.Unlock()
+	for name, pbook := range books {
+		interval := r.interval
+		if pbook.Driftcheck != 0 {
+			interval = time.Duration(pbook.Driftcheck) * time.Minute
+		}
+		if !pbook.GetInstallState() || pbook.Busy || interval <= 0 {
+			continue
+		}
+		if last := r.Status(name); last != nil && time.Since(last.Checked) < interval {
+			continue
+		}
+		r.reconcile(pbook)
+	}
+}
+
+// Checks one playbook and repairs it if it wants to be.
+func (r *Reconciler) reconcile(pbook *playbook.Playbook) {
+	// Adapters in the middle of an apply look drifted, so check waits for it's turn like any job. Not for long, there's always next time.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	lease, err := r.server.locks.Acquire(ctx, PlaybookLocks(pbook), "drift-"+newJobID(), "drift check of "+pbook.Name, nil)
+	cancel()
+	if err != nil {
+		log.Println("Skipping drift check of " + pbook.Name + ": " + err.Error())
+		return
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Minute)
+	status := r.server.CheckDrift(ctx, pbook)
+	cancel()
+	lease.Release()
+	if status.Err != "" || !status.Drifted() {
+		r.setStatus(pbook.Name, status)
+		if status.Err != "" {
+			log.Println("Drift check of " + pbook.Name + " failed: " + status.Err)
+		}
+		return
+	}
+	log.Println(pbook.Name + " " + status.String())
+	if !pbook.Driftrepair {
+		r.setStatus(pbook.Name, status)
+		return
+	}
+	builder := NewTaskBuilder(r.server)
+	builder.Repair(pbook.Name)
+	err = r.server.RunTask(context.Background(), builder, func(upd *executor.ExecutorUpdate) {
+		if upd.StepMessage != "" {
+			log.Println("[repair " + pbook.Name + "] [" + upd.CurrentStep + "] " + upd.StepMessage)
+		}
+	})
+	if err != nil {
+		status.Repair = "repair job " + builder.jobid + " failed: " + err.Error()
+	} else {
+		status.Repair = "repaired by job " + builder.jobid
+	}
+	r.setStatus(pbook.Name, status)
+	r.server.UpdateUpdaterTable()
+}
@@ -4,25 +4,51 @@ import (
 	"context"
 	"errors"
 	"log"
+	"sync"
 	"time"
 )
 
 const ERR_FINISHED = "executor finished"
 const ERR_NOTSTART = "executor is not running"
 
+// Not a real update. Tick sends it through the pump after every step to know when pump is done relaying step's messages.
+var flushmark = &ExecutorUpdate{}
+
 // Executor just does what's on the label.
 // In Start() you provide (chan *ExecutorUpdate) update channel to get status updates (including step errors! more on them later) carefully relayed from steps via stepchan pump goroutine.
-// on every Tick() It executes every step in order they were added until it reaches the end. Tick() May return unhandled step error or one of two executor's own errors (ERR_FINISHED or ERR_NOTSTART).
+// Steps run in order they were added, unless they said they only need some of the earlier ones (see Step.After). Steps that don't depend on each other run at the same time.
+// Every Tick() starts whatever steps are ready and waits for one of the running ones to finish. Tick() May return unhandled step error or one of two executor's own errors (ERR_FINISHED or ERR_NOTSTART).
 // Errors are pretty descriptive: ERR_FINISHED means it ran out of steps to execute (you're done with task), ERR_NOTSTART means you forgot to Start()
-// When step returns an ExecutorUpdate with "error" step, the stepchan pump relays it to your update channel, stops executor, and shutdowns itself. if you don't do GetLastError (bad for you), the error will still be returned to you by Tick() and then the executor behaves like a stopped one.
+// When step returns an ExecutorUpdate with "error" step, the stepchan pump relays it to your update channel like any other, and Tick() that saw the step finish waits out other running steps (there's no interrupting them), stops executor and returns that error to you. After that the executor behaves like a stopped one.
+// Start with StartContext to be able to cancel the whole thing: steps see it in their ctx, executor doesn't start new ones and Tick() returns job's error once running ones are done.
+// Step with a RetryPolicy gets retried instead, every retry shows up in your update channel as a "retry" update. Only the last failure is an error.
+// Values step puts into it's context with Set are merged into the shared one once it finishes, just those and nothing else (whatever step returns is ignored).
+// Steps running at the same time shouldn't Set the same keys, the last one to finish wins.
 type Executor struct {
 	Steps       []*Step
-	currentstep int
+	waitfor     [][]int // Indexes of steps every step waits for.
+	state       []int
+	finished    int
+	inflight    int
+	results     chan stepResult
 	ctx         context.Context
+	job         context.Context // Cancelling it stops the executor. Steps get it's Done() too, so they can stop early.
 	running     bool
 	updateschan chan *ExecutorUpdate
 	stepchan    chan *ExecutorUpdate
 	lasterr     chan error
+	stepdone    func(index int, step *Step) // Optional. Gets called after every finished step, so progress can be saved somewhere.
+}
+
+const (
+	stepPending = iota
+	stepRunning
+	stepDone
+)
+
+type stepResult struct {
+	index int
+	out   *outputs
 }
 
 type ExecutorUpdate struct {
@@ -30,8 +56,54 @@ type ExecutorUpdate struct {
 	StepMessage string
 }
 
+// What steps get: values from shared context, cancellation from job's.
+type stepCtx struct {
+	context.Context
+	values context.Context
+}
+
+func (c *stepCtx) Value(key any) any {
+	return c.values.Value(key)
+}
+
+// Values step hands over to the ones after it. Abandoned steps (see attempt) may still be setting them, hence the mutex.
+type outputs struct {
+	mu     sync.Mutex
+	values map[string]any
+}
+
+type outputsKey struct{}
+
+// Step's context, with somewhere for Set to put outputs.
+type outputCtx struct {
+	context.Context
+	out *outputs
+}
+
+func (c *outputCtx) Value(key any) any {
+	if key == (outputsKey{}) {
+		return c.out
+	}
+	return c.Context.Value(key)
+}
+
+func withOutputs(ctx context.Context) (context.Context, *outputs) {
+	out := &outputs{values: make(map[string]any)}
+	return &outputCtx{Context: ctx, out: out}, out
+}
+
+// Same as context.WithValue, but value makes it to steps after this one too. Values put with plain context.WithValue stay with step itself.
+func Set(ctx context.Context, key string, value any) context.Context {
+	if out, ok := ctx.Value(outputsKey{}).(*outputs); ok {
+		out.mu.Lock()
+		out.values[key] = value
+		out.mu.Unlock()
+	}
+	return context.WithValue(ctx, key, value)
+}
+
 func NewExecutor() *Executor {
-	return &Executor{currentstep: 0, ctx: context.Background(), running: false, Steps: make([]*Step, 0)}
+	return &Executor{ctx: context.Background(), running: false, Steps: make([]*Step, 0), waitfor: make([][]int, 0)}
 }
 
 func (e *Executor) SetContext(ctx context.Context) {
@@ -41,18 +113,59 @@ func (e *Executor) SetContext(ctx context.Context) {
 }
 
 func (e *Executor) AddStep(step *Step) {
+	if e.running {
+		return
+	}
+	waitfor := make([]int, 0)
+	if step.deps == nil {
+		for i := range e.Steps {
+			waitfor = append(waitfor, i)
+		}
+	}
+	for _, dep := range step.deps {
+		found := false
+		for i, s := range e.Steps {
+			if s == dep {
+				waitfor = append(waitfor, i)
+				found = true
+			}
+		}
+		if !found { // Would never be ready otherwise. Play it safe and wait for everything.
+			log.Println("step " + step.Id + " depends on " + dep.Id + " that isn't added before it, running it in order")
+			waitfor = waitfor[:0]
+			for i := range e.Steps {
+				waitfor = append(waitfor, i)
+			}
+			break
+		}
+	}
+	e.Steps = append(e.Steps, step)
+	e.waitfor = append(e.waitfor, waitfor)
+}
+
+func (e *Executor) SetStepCallback(f func(index int, step *Step)) {
 	if !e.running {
-		e.Steps = append(e.Steps, step)
+		e.stepdone = f
 	}
 }
 
 func (e *Executor) Start(updates chan *ExecutorUpdate) {
+	e.StartContext(context.Background(), updates)
+}
+
+// Same as Start, but executor stops once job is cancelled. Running steps are told about it through their context and waited for, the rest never start. Tick() returns job's error then.
+func (e *Executor) StartContext(job context.Context, updates chan *ExecutorUpdate) {
 	if e.running {
 		return
 	}
 	e.running = true
-	e.currentstep = 0
+	e.job = job
+	e.state = make([]int, len(e.Steps))
+	e.finished = 0
+	e.inflight = 0
+	e.results = make(chan stepResult)
 	e.stepchan = make(chan *ExecutorUpdate)
+	e.lasterr = make(chan error, 1)
 	e.updateschan = updates
 	go func() {
 		for {
@@ -60,12 +173,13 @@ func (e *Executor) Start(updates chan *ExecutorUpdate) {
 			if msg == nil { // HACK!
 				break
 			}
+			if msg == flushmark {
+				continue
+			}
 			e.updateschan <- msg
-			if msg.CurrentStep == "error" {
-				e.running = false
+			if msg.CurrentStep == "error" && len(e.lasterr) == 0 {
 				e.lasterr <- errors.New(msg.StepMessage)
-				log.Println("shutting down stepchan pump: " + msg.StepMessage)
-				break
+				log.Println("step failed: " + msg.StepMessage)
 			}
 		}
 	}()
@@ -85,19 +199,77 @@ func (e *Executor) GetLastError() error {
 }
 
 func (e *Executor) Tick() error {
-	if len(e.lasterr) != 0 {
-		return <-e.lasterr
-	}
 	if !e.running {
-		return errors.New("executor is not running")
+		return errors.New(ERR_NOTSTART)
 	}
-	if e.currentstep >= len(e.Steps) {
+	if e.finished >= len(e.Steps) {
 		e.running = false
 		e.stepchan <- nil
 		return errors.New(ERR_FINISHED)
 	}
-	e.updateschan <- &ExecutorUpdate{CurrentStep: e.Steps[e.currentstep].Id}
-	e.ctx = e.Steps[e.currentstep].Exec(e.ctx, e.stepchan)
-	e.currentstep++
+	for i, step := range e.Steps {
+		if e.job.Err() != nil {
+			break
+		}
+		if e.state[i] != stepPending || !e.ready(i) {
+			continue
+		}
+		e.state[i] = stepRunning
+		e.inflight++
+		e.stepchan <- &ExecutorUpdate{CurrentStep: step.Id}
+		go func(i int, step *Step, ctx context.Context) {
+			e.results <- stepResult{index: i, out: e.runStep(step, ctx)}
+		}(i, step, &stepCtx{Context: e.job, values: e.ctx})
+	}
+	if e.inflight > 0 {
+		e.finish(<-e.results)
+	}
+	if err := e.job.Err(); err != nil { // Goes first, step errors are most likely caused by it anyway.
+		e.Stop()
+		return err
+	}
+	if len(e.lasterr) != 0 {
+		e.Stop()
+		return <-e.lasterr
+	}
 	return nil
 }
+
+// Stops executor once steps that are running right now finish. Steps that didn't start yet never will.
+func (e *Executor) Stop() {
+	if !e.running {
+		return
+	}
+	for e.inflight > 0 {
+		e.finish(<-e.results)
+	}
+	e.running = false
+	e.stepchan <- nil
+}
+
+func (e *Executor) ready(i int) bool {
+	for _, dep := range e.waitfor[i] {
+		if e.state[dep] != stepDone {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Executor) finish(res stepResult) {
+	// Pump handles messages in order, so once it took the mark, everything step said got relayed and it's safe to look for errors.
+	e.stepchan <- flushmark
+	if res.out != nil { // Values only. Cancellation always comes from job, not from the step.
+		res.out.mu.Lock()
+		for k, v := range res.out.values {
+			e.ctx = context.WithValue(e.ctx, k, v)
+		}
+		res.out.mu.Unlock()
+	}
+	e.state[res.index] = stepDone
+	e.inflight--
+	e.finished++
+	if e.stepdone != nil {
+		e.stepdone(res.index, e.Steps[res.index])
+	}
+}
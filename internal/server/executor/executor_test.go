@@ -0,0 +1,182 @@
+package executor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Runs executor to the end, the way server's RunExecutor does. Returns step error, if any.
+func run(t *testing.T, ex *Executor) error {
+	t.Helper()
+	updates := make(chan *ExecutorUpdate)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-updates:
+			case <-done:
+				return
+			}
+		}
+	}()
+	ex.Start(updates)
+	var err error
+	for err == nil {
+		err = ex.Tick()
+	}
+	close(done)
+	wg.Wait()
+	if err.Error() == ERR_FINISHED {
+		return nil
+	}
+	return err
+}
+
+func setStep(key string, value any) func(chan *ExecutorUpdate, context.Context) context.Context {
+	return func(updates chan *ExecutorUpdate, ctx context.Context) context.Context {
+		return Set(ctx, key, value)
+	}
+}
+
+func TestContextMerge(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(ex *Executor)
+		want  map[string]any
+	}{
+		{
+			name: "set values reach later steps",
+			build: func(ex *Executor) {
+				ex.AddStep(NewStep("a", setStep("x", 1)))
+				ex.AddStep(NewStep("b", setStep("y", 2)))
+			},
+			want: map[string]any{"x": 1, "y": 2},
+		},
+		{
+			name: "later step overrides earlier one",
+			build: func(ex *Executor) {
+				ex.AddStep(NewStep("a", setStep("x", 1)))
+				ex.AddStep(NewStep("b", setStep("x", 2)))
+			},
+			want: map[string]any{"x": 2},
+		},
+		{
+			name: "plain WithValue stays with step",
+			build: func(ex *Executor) {
+				ex.AddStep(NewStep("a", func(updates chan *ExecutorUpdate, ctx context.Context) context.Context {
+					return context.WithValue(ctx, "x", 1)
+				}))
+			},
+			want: map[string]any{"x": nil},
+		},
+		{
+			name: "sibling finishing later doesn't shadow what the other one set",
+			build: func(ex *Executor) {
+				base := NewStep("base", setStep("x", 1))
+				ex.AddStep(base)
+				first := make(chan struct{})
+				ex.AddStep(NewStep("fast", func(updates chan *ExecutorUpdate, ctx context.Context) context.Context {
+					defer close(first)
+					return Set(ctx, "x", 2)
+				}).After(base))
+				ex.AddStep(NewStep("slow", func(updates chan *ExecutorUpdate, ctx context.Context) context.Context {
+					<-first
+					time.Sleep(50 * time.Millisecond) // Let fast one get merged first.
+					return Set(ctx, "y", 3)
+				}).After(base))
+			},
+			want: map[string]any{"x": 2, "y": 3},
+		},
+		{
+			name: "failed attempt's values are dropped",
+			build: func(ex *Executor) {
+				attempt := 0
+				ex.AddStep(NewStep("flaky", func(updates chan *ExecutorUpdate, ctx context.Context) context.Context {
+					attempt++
+					if attempt == 1 {
+						ctx = Set(ctx, "x", "bad")
+						updates <- &ExecutorUpdate{CurrentStep: "error", StepMessage: "flaked"}
+						return ctx
+					}
+					return Set(ctx, "y", "good")
+				}).Retry(&RetryPolicy{Attempts: 2, Backoff: time.Millisecond}))
+			},
+			want: map[string]any{"x": nil, "y": "good"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ex := NewExecutor()
+			tt.build(ex)
+			got := make(map[string]any)
+			ex.AddStep(NewStep("check", func(updates chan *ExecutorUpdate, ctx context.Context) context.Context {
+				for k := range tt.want {
+					got[k] = ctx.Value(k)
+				}
+				return ctx
+			}))
+			if err := run(t, ex); err != nil {
+				t.Fatalf("executor failed: %v", err)
+			}
+			for k, want := range tt.want {
+				if got[k] != want {
+					t.Errorf("%s = %v, want %v", k, got[k], want)
+				}
+			}
+		})
+	}
+}
+
+func TestStepOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		failing string // Step that fails, "" for none.
+		want    []string
+	}{
+		{name: "all steps run", want: []string{"a", "b", "c"}},
+		{name: "failed step stops the rest", failing: "a", want: []string{"a"}},
+		{name: "failed step stops steps waiting for it", failing: "b", want: []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			ran := make([]string, 0)
+			step := func(id string) *Step {
+				return NewStep(id, func(updates chan *ExecutorUpdate, ctx context.Context) context.Context {
+					mu.Lock()
+					ran = append(ran, id)
+					mu.Unlock()
+					if id == tt.failing {
+						updates <- &ExecutorUpdate{CurrentStep: "error", StepMessage: id + " failed"}
+					}
+					return ctx
+				})
+			}
+			ex := NewExecutor()
+			a := step("a")
+			ex.AddStep(a)
+			ex.AddStep(step("b").After(a))
+			ex.AddStep(step("c")) // Waits for everything before it.
+			err := run(t, ex)
+			if (err != nil) != (tt.failing != "") {
+				t.Fatalf("err = %v, failing step %q", err, tt.failing)
+			}
+			if err != nil && err.Error() != tt.failing+" failed" {
+				t.Errorf("err = %v, want %q", err, tt.failing+" failed")
+			}
+			if len(ran) != len(tt.want) {
+				t.Fatalf("ran %v, want %v", ran, tt.want)
+			}
+			for i := range ran {
+				if ran[i] != tt.want[i] {
+					t.Errorf("ran %v, want %v", ran, tt.want)
+				}
+			}
+		})
+	}
+}
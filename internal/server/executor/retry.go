@@ -0,0 +1,142 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// How hard executor should try before giving up on a step. Adapters love failing for a second or two (router busy saving config, pihole restarting FTL), no need to kill the whole task over that.
+// Step with a policy gets re-run from the start after it fails, so it has to be fine with that (diff based ones are).
+type RetryPolicy struct {
+	Attempts   int           // Including the first one. 0 or 1 means no retries.
+	Backoff    time.Duration // Wait before the first retry. Grows exponentially (with some random spread) with every next one.
+	MaxBackoff time.Duration // Cap for the wait. 0 means no cap.
+	Timeout    time.Duration // For one attempt. 0 means no limit.
+	Deadline   time.Duration // For all attempts together, waits included. 0 means no limit.
+}
+
+func (p *RetryPolicy) backoff(deadline time.Time) backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = p.Backoff
+	b.MaxInterval = p.MaxBackoff
+	if p.MaxBackoff == 0 {
+		b.MaxInterval = time.Duration(1<<63 - 1)
+	}
+	b.Multiplier = 2
+	b.MaxElapsedTime = 0 // deadlineBackOff does that, and it counts the wait in too.
+	retries := 0
+	if p.Attempts > 1 {
+		retries = p.Attempts - 1
+	}
+	return &deadlineBackOff{BackOff: backoff.WithMaxRetries(b, uint64(retries)), deadline: deadline}
+}
+
+// Gives up right away if waiting would take us past the deadline. No point sleeping just to fail.
+type deadlineBackOff struct {
+	backoff.BackOff
+	deadline time.Time
+}
+
+func (b *deadlineBackOff) NextBackOff() time.Duration {
+	next := b.BackOff.NextBackOff()
+	if next != backoff.Stop && !b.deadline.IsZero() && time.Now().Add(next).After(b.deadline) {
+		return backoff.Stop
+	}
+	return next
+}
+
+// How long a step that ran out of time has to return, before it's left to itself.
+const stepGrace = 10 * time.Second
+
+// Runs step as many times as it's policy allows. Errors of attempts that get retried don't reach stepchan, a "retry" update goes there instead.
+// Returns what step Set, on it's last attempt that didn't get abandoned. nil if every one of them did.
+func (e *Executor) runStep(step *Step, ctx context.Context) *outputs {
+	if step.Policy == nil {
+		sctx, out := withOutputs(ctx)
+		step.Exec(sctx, e.stepchan)
+		return out
+	}
+	var deadline time.Time
+	if step.Policy.Deadline > 0 {
+		deadline = time.Now().Add(step.Policy.Deadline)
+	}
+	var out *outputs
+	attempt := 1
+	err := backoff.RetryNotify(func() error {
+		actx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		if !deadline.IsZero() {
+			actx, cancel = context.WithDeadline(actx, deadline)
+			defer cancel()
+		}
+		if step.Policy.Timeout > 0 {
+			actx, cancel = context.WithTimeout(actx, step.Policy.Timeout)
+			defer cancel()
+		}
+		actx, aout := withOutputs(actx) // Failed attempt's outputs shouldn't outlive it.
+		res, err := e.attempt(step, actx)
+		if res != nil {
+			out = aout
+		}
+		return err
+	}, backoff.WithContext(step.Policy.backoff(deadline), ctx), func(err error, wait time.Duration) {
+		e.stepchan <- &ExecutorUpdate{CurrentStep: "retry", StepMessage: step.Id + ": attempt " + strconv.Itoa(attempt) + " of " + strconv.Itoa(step.Policy.Attempts) + " failed (" + err.Error() + "), retrying in " + wait.Round(time.Second/10).String()}
+		attempt++
+	})
+	if err != nil {
+		msg := err.Error()
+		if attempt > 1 {
+			msg += " (gave up after " + strconv.Itoa(attempt) + " attempts)"
+		}
+		e.stepchan <- &ExecutorUpdate{CurrentStep: "error", StepMessage: msg}
+	}
+	return out
+}
+
+// One go at step. Step's error is held back, so caller can decide if that's the end of it. nil context means step got abandoned after running out of time.
+func (e *Executor) attempt(step *Step, ctx context.Context) (context.Context, error) {
+	c := make(chan *ExecutorUpdate)
+	done := make(chan context.Context, 1)
+	go func() {
+		done <- step.Exec(ctx, c)
+	}()
+	var failed error
+	var grace <-chan time.Time
+	ctxdone := ctx.Done()
+	for {
+		select {
+		case upd := <-c:
+			if upd.CurrentStep == "error" {
+				if failed == nil {
+					failed = errors.New(upd.StepMessage)
+				}
+				continue
+			}
+			e.stepchan <- upd
+		case out := <-done:
+			return out, failed
+		case <-ctxdone:
+			// Give step a moment to notice and wrap up. Nothing is worse than another attempt racing the previous one.
+			ctxdone = nil
+			grace = time.After(stepGrace)
+		case <-grace:
+			// There's no killing a goroutine. Step that doesn't watch ctx keeps going on it's own, whatever it says from now on goes nowhere.
+			log.Println("step " + step.Id + " ignored it's context, abandoning it")
+			go func() {
+				for {
+					select {
+					case <-c:
+					case <-done:
+						return
+					}
+				}
+			}()
+			return nil, errors.New(step.Id + " didn't finish: " + ctx.Err().Error())
+		}
+	}
+}
@@ -4,15 +4,31 @@ import "context"
 
 // Like they say: if you break big tasks into smaller ones, then everything's achievable. So step is that one discrete part of a bigger task.
 // You make one with NewStep and feed it to executor. That's it. It's just a freaking fancy wrapper for a function, idk what to document there...
+// Well, one thing. By default step waits for every step added before it. If it only needs some of them, say so with After(), and executor will run it alongside whatever it doesn't care about.
 type Step struct {
-	Id string
-	F  func(updates chan *ExecutorUpdate, ctx context.Context) context.Context
+	Id   string
+	F    func(updates chan *ExecutorUpdate, ctx context.Context) context.Context
+	deps []*Step // nil means "everything before me"
+	// nil means step gets one go, and it's error ends the task.
+	Policy *RetryPolicy
 }
 
 func NewStep(id string, f func(updates chan *ExecutorUpdate, ctx context.Context) context.Context) *Step {
 	return &Step{Id: id, F: f}
 }
 
+// Makes step wait only for given steps (which have to be added to executor before it). After() with nothing means it doesn't wait at all.
+func (s *Step) After(deps ...*Step) *Step {
+	s.deps = append(make([]*Step, 0, len(deps)), deps...)
+	return s
+}
+
+// Lets executor retry step if it fails. See RetryPolicy.
+func (s *Step) Retry(policy *RetryPolicy) *Step {
+	s.Policy = policy
+	return s
+}
+
 func (s *Step) Exec(ctx context.Context, updates chan *ExecutorUpdate) context.Context {
 	return s.F(updates, ctx)
 }
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every job server ran (or is running), as remembered by the server. Output included, so it can be replayed with "attach" after client went away.
+type JobRecord struct {
+	ID       string
+	Task     string
+	Playbook string
+	Started  int64
+	Finished int64 // 0 while running
+	Status   string
+	Success  bool // Same as Status == JOB_DONE. Records from before job statuses only have this one.
+	Updates  []JobUpdate
+}
+
+// One update of job's output, same thing executor reports.
+type JobUpdate struct {
+	Step    string
+	Message string
+}
+
+const (
+	JOB_RUNNING     = "running"
+	JOB_DONE        = "done"
+	JOB_FAILED      = "failed"
+	JOB_CANCELLED   = "cancelled"
+	JOB_INTERRUPTED = "interrupted" // Server died while it was running.
+)
+
+// Job's status, even for old records that don't have one.
+func (r *JobRecord) GetStatus() string {
+	if r.Status != "" {
+		return r.Status
+	}
+	if r.Success {
+		return JOB_DONE
+	}
+	return JOB_FAILED
+}
+
+func jobRecordKey(rec *JobRecord) []byte {
+	// Zero padded start time first, so that bbolt keeps records sorted by age.
+	return []byte(fmt.Sprintf("%020d-%s", rec.Started, rec.ID))
+}
+
+// Adds or updates (same ID and start time) a job record.
+func AddJobRecordDB(db *bolt.DB, rec *JobRecord) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("job_history"))
+		recgob := &strings.Builder{}
+		err := gob.NewEncoder(recgob).Encode(rec)
+		if err != nil {
+			return errors.New("db transaction failed: " + err.Error())
+		}
+		b.Put(jobRecordKey(rec), []byte(recgob.String()))
+		// Don't let history grow forever, oldest ones go first.
+		n := 0
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			n++
+		}
+		for k, _ := c.First(); k != nil && n > maxJobHistory; k, _ = c.First() {
+			b.Delete(k)
+			n--
+		}
+		return nil
+	})
+	return err
+}
+
+// How many job records are kept.
+const maxJobHistory = 500
+
+// Oldest first.
+func GetJobHistoryDB(db *bolt.DB) []*JobRecord {
+	var records []*JobRecord = make([]*JobRecord, 0)
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("job_history"))
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var rec *JobRecord = &JobRecord{}
+			err := gob.NewDecoder(strings.NewReader(string(v))).Decode(rec)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			records = append(records, rec)
+		}
+		return nil
+	})
+	return records
+}
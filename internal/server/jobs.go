@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sergds/autovpn2/internal/server/executor"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Job that is running right now. Can be cancelled with "cancel" task and followed with "attach".
+type runningJob struct {
+	rec      *JobRecord
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	changed  chan struct{} // Gets closed (and replaced) on every new update, so followers know to wake up.
+	finished bool
+	saved    time.Time
+	db       *bolt.DB
+}
+
+// Registers a job for task, and writes it down.
+func (s *AutoVPNServer) startJob(builder *TaskBuilder, cancel context.CancelFunc) *runningJob {
+	rec := &JobRecord{ID: builder.jobid, Task: builder.task, Playbook: builder.pbname, Started: time.Now().Unix(), Status: JOB_RUNNING, Updates: make([]JobUpdate, 0)}
+	j := &runningJob{rec: rec, cancel: cancel, changed: make(chan struct{}), db: s.playbookDB}
+	s.jobsMu.Lock()
+	s.jobs[rec.ID] = j
+	s.jobsMu.Unlock()
+	j.mu.Lock()
+	j.save()
+	j.mu.Unlock()
+	return j
+}
+
+// Remembers an update. Record hits the disk at most once a second while job runs, it's own output shouldn't slow it down.
+func (j *runningJob) add(upd *executor.ExecutorUpdate) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.rec.Updates = append(j.rec.Updates, JobUpdate{Step: upd.CurrentStep, Message: upd.StepMessage})
+	close(j.changed)
+	j.changed = make(chan struct{})
+	if time.Since(j.saved) > time.Second {
+		j.save()
+	}
+}
+
+// Call with mu held.
+func (j *runningJob) save() {
+	j.saved = time.Now()
+	if err := AddJobRecordDB(j.db, j.rec); err != nil {
+		log.Println("failed saving job record " + j.rec.ID + ": " + err.Error())
+	}
+}
+
+// Job is over, err is what RunTask returns.
+func (s *AutoVPNServer) finishJob(j *runningJob, err error) {
+	j.mu.Lock()
+	j.rec.Finished = time.Now().Unix()
+	switch {
+	case err == nil:
+		j.rec.Status = JOB_DONE
+	case errors.Is(err, context.Canceled):
+		j.rec.Status = JOB_CANCELLED
+	default:
+		j.rec.Status = JOB_FAILED
+	}
+	j.rec.Success = err == nil
+	j.finished = true
+	j.save()
+	close(j.changed)
+	j.mu.Unlock()
+	s.jobsMu.Lock()
+	delete(s.jobs, j.rec.ID)
+	s.jobsMu.Unlock()
+}
+
+// Copy of the record, safe to look at while job keeps going.
+func (j *runningJob) snapshot() *JobRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	rec := *j.rec
+	rec.Updates = append([]JobUpdate(nil), j.rec.Updates...)
+	return &rec
+}
+
+// Cancels running jobs with given ID, or all jobs of given playbook. Returns IDs of cancelled ones.
+func (s *AutoVPNServer) CancelJobs(target string) []string {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	ids := make([]string, 0)
+	for id, job := range s.jobs {
+		if id == target || (job.rec.Playbook != "" && job.rec.Playbook == target) {
+			job.cancel()
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Latest jobs, newest first. Running ones are as fresh as it gets, not what was last saved.
+func (s *AutoVPNServer) ListJobs(limit int) []*JobRecord {
+	records := GetJobHistoryDB(s.playbookDB)
+	s.jobsMu.Lock()
+	for i, rec := range records {
+		if j, ok := s.jobs[rec.ID]; ok {
+			records[i] = j.snapshot()
+		}
+	}
+	s.jobsMu.Unlock()
+	sort.SliceStable(records, func(a, b int) bool { return records[a].Started > records[b].Started })
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records
+}
+
+// Replays job's output into out, and if it's still running, keeps following it until it's over (or ctx is done).
+// Returns the record as of the end of it.
+func (s *AutoVPNServer) FollowJob(ctx context.Context, id string, out func(upd JobUpdate)) (*JobRecord, error) {
+	s.jobsMu.Lock()
+	j, running := s.jobs[id]
+	s.jobsMu.Unlock()
+	if !running {
+		for _, rec := range GetJobHistoryDB(s.playbookDB) {
+			if rec.ID == id {
+				for _, upd := range rec.Updates {
+					out(upd)
+				}
+				return rec, nil
+			}
+		}
+		return nil, errors.New("No such job " + id + "!")
+	}
+	sent := 0
+	for {
+		j.mu.Lock()
+		pending := append([]JobUpdate(nil), j.rec.Updates[sent:]...)
+		changed, finished := j.changed, j.finished
+		j.mu.Unlock()
+		for _, upd := range pending {
+			out(upd)
+		}
+		sent += len(pending)
+		if finished {
+			return j.snapshot(), nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return j.snapshot(), ctx.Err()
+		}
+	}
+}
+
+// Jobs that were running when server went down never got to finish. Called on startup, before anything runs.
+func (s *AutoVPNServer) MarkInterruptedJobs() {
+	for _, rec := range GetJobHistoryDB(s.playbookDB) {
+		if rec.Status == JOB_RUNNING {
+			rec.Status = JOB_INTERRUPTED
+			if err := AddJobRecordDB(s.playbookDB, rec); err != nil {
+				log.Println("failed updating job record " + rec.ID + ": " + err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/secrets"
+	"github.com/sergds/autovpn2/internal/server/executor"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Progress of a job that changes things, kept on disk while the job runs. Finished jobs clean up after themselves,
+// so whatever is left in the journal when server starts got interrupted by a crash (or a kill -9, or a power outage, or a cat).
+type JournalEntry struct {
+	ID        string
+	Task      string
+	Playbook  string
+	Started   int64
+	StepsDone int // Steps can finish out of order, so that's how many of them, not up to which one.
+	LastStep  string
+	Tx        *Transaction // nil for tasks that can't be rolled back (undo)
+}
+
+type journal struct {
+	db    *bolt.DB
+	vault *secrets.Vault // Transaction has playbooks in it, adapterconfig included.
+	mu    sync.Mutex
+	entry *JournalEntry
+}
+
+func newJobID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// Starts journaling a task. Every finished step and every change on adapters gets written down right away.
+func (s *AutoVPNServer) openJournal(id string, builder *TaskBuilder, ex *executor.Executor) *journal {
+	j := &journal{db: s.playbookDB, vault: s.vault, entry: &JournalEntry{ID: id, Task: builder.task, Playbook: builder.pbname, Started: time.Now().Unix(), Tx: builder.tx}}
+	ex.SetStepCallback(func(index int, step *executor.Step) {
+		j.mu.Lock()
+		j.entry.StepsDone++
+		j.entry.LastStep = step.Id
+		j.mu.Unlock()
+		j.save()
+	})
+	builder.tx.SetChangeHook(j.save)
+	j.save()
+	return j
+}
+
+func (j *journal) save() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	buf := &bytes.Buffer{}
+	if j.entry.Tx != nil {
+		j.entry.Tx.mu.Lock()
+		defer j.entry.Tx.mu.Unlock()
+	}
+	if err := gob.NewEncoder(buf).Encode(j.entry); err != nil {
+		log.Println("failed encoding journal entry: " + err.Error())
+		return
+	}
+	err := j.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("job_journal")).Put([]byte(j.entry.ID), j.vault.Seal(buf.Bytes()))
+	})
+	if err != nil {
+		log.Println("failed writing journal entry: " + err.Error())
+	}
+}
+
+// Job is over (one way or another), nothing to recover anymore.
+func (j *journal) close() {
+	DeleteJournalDB(j.db, j.entry.ID)
+}
+
+func (s *AutoVPNServer) GetJournalDB() []*JournalEntry {
+	var entries []*JournalEntry = make([]*JournalEntry, 0)
+	s.playbookDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("job_journal"))
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var entry *JournalEntry = &JournalEntry{}
+			plain, _, err := s.vault.Open(v)
+			if err == nil {
+				err = gob.NewDecoder(bytes.NewReader(plain)).Decode(entry)
+			}
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	return entries
+}
+
+func DeleteJournalDB(db *bolt.DB, id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("job_journal")).Delete([]byte(id))
+	})
+}
+
+// What to do with jobs that got interrupted. Set by AVPN2_RECOVERY env var.
+const (
+	RECOVERY_ROLLBACK = "rollback" // Reverse what was done and put previous revision back. Default.
+	RECOVERY_RESUME   = "resume"   // Run the job again from the start. Apply steps only push the difference, so that effectively continues it.
+)
+
+// Deals with jobs left over from the previous run. Called on startup, before anything else can touch playbooks.
+func (s *AutoVPNServer) RecoverJobs() {
+	policy := os.Getenv("AVPN2_RECOVERY")
+	if policy == "" {
+		policy = RECOVERY_ROLLBACK
+	}
+	report := func(upd *executor.ExecutorUpdate) {
+		if upd.StepMessage != "" {
+			log.Println("[recovery] [" + upd.CurrentStep + "] " + upd.StepMessage)
+		}
+	}
+	for _, entry := range s.GetJournalDB() {
+		log.Println("Found interrupted " + entry.Task + " of " + entry.Playbook + " (" + strconv.Itoa(entry.StepsDone) + " steps done, last one " + entry.LastStep + "), recovering with policy: " + policy)
+		builder, err := s.recoveryTask(entry, policy)
+		if err != nil {
+			log.Println("Can't recover " + entry.ID + ": " + err.Error())
+		} else if builder != nil {
+			if err := s.RunTask(context.Background(), builder, report); err != nil {
+				log.Println("Recovery of " + entry.Playbook + " failed: " + err.Error())
+			}
+		}
+		DeleteJournalDB(s.playbookDB, entry.ID)
+	}
+	// Nothing is running yet, so any lock still around is stale. Journal didn't exist before, or job didn't need one.
+	for name, pbook := range s.playbooks() {
+		if pbook.Busy {
+			log.Println("Clearing stale lock of " + name + " (reason: " + pbook.GetLockReason() + ")")
+			pbook.Unlock()
+			s.UpdatePlaybookDB(pbook)
+		}
+	}
+}
+
+// Builds a task that gets interrupted job's playbook back into a sane state. nil builder means there's nothing to be done.
+func (s *AutoVPNServer) recoveryTask(entry *JournalEntry, policy string) (*TaskBuilder, error) {
+	builder := NewTaskBuilder(s)
+	if entry.Task == pb.TASK_UNDO { // Undo can't be rolled back, records are gone already. Finish it instead.
+		s.forceUnlock(entry.Playbook)
+		return builder, builder.Undo(entry.Playbook)
+	}
+	if entry.Tx == nil || entry.Tx.Playbook == nil {
+		return nil, nil // Didn't get to change anything.
+	}
+	switch policy {
+	case RECOVERY_ROLLBACK:
+		builder.tx = entry.Tx
+		builder.task, builder.pbname = pb.TASK_RECOVER, entry.Playbook
+		builder.lockInstalled(entry.Playbook)
+		builder.exec = builder.BuildRollback()
+		builder.tx = nil // Rollback of rollback is not a thing.
+		return builder, nil
+	case RECOVERY_RESUME:
+		// Put things back as they were before the job, as far as db is concerned, then go again.
+		if entry.Tx.Previous != nil {
+			s.UpdatePlaybookDB(entry.Tx.Previous)
+		} else {
+			s.DeletePlaybookDB(entry.Tx.Playbook)
+		}
+		switch entry.Task {
+		case pb.TASK_APPLY:
+			pbook := entry.Tx.Playbook
+			pbook.Unlock()
+			pbook.SetInstallState(false)
+			return builder, builder.ApplyPlaybook(pbook)
+		case pb.TASK_REFRESH:
+			return builder, builder.Refresh(entry.Playbook, nil)
+		case pb.TASK_REPAIR:
+			return builder, builder.Repair(entry.Playbook)
+		}
+	}
+	return nil, errors.New("don't know how to recover " + entry.Task + " with policy " + policy)
+}
+
+// Clears playbook's lock no matter who holds it. Returns false if there's no such playbook.
+func (s *AutoVPNServer) forceUnlock(name string) bool {
+	pbook, ok := s.playbooks()[name]
+	if !ok {
+		return false
+	}
+	pbook.Unlock()
+	s.UpdatePlaybookDB(pbook)
+	return true
+}
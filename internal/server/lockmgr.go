@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+	"github.com/sergds/autovpn2/internal/playbook"
+)
+
+// Keeps jobs from stepping on each other. Every job that changes things holds a lock of it's playbook, and locks of adapter endpoints it talks to,
+// so two applies of one playbook can't run at once, and two playbooks don't poke the same router at the same time.
+// Locks live only in server's memory, so there's nothing stale left of them after a crash (journal takes care of the jobs themselves).
+type LockManager struct {
+	mu      sync.Mutex
+	held    map[string]*LockInfo
+	changed chan struct{} // Gets closed (and replaced) whenever something is released, so waiters know to look again.
+	timeout time.Duration // How long to wait for locks before giving up.
+	lease   time.Duration // Lock that wasn't renewed for that long is up for grabs. Holder must've hung.
+}
+
+type LockInfo struct {
+	Name     string
+	Owner    string // Job ID
+	Reason   string
+	Acquired time.Time
+	Expires  time.Time
+}
+
+// Locks held by one owner. Renew it while working, release it when done.
+type Lease struct {
+	m     *LockManager
+	owner string
+	names []string
+}
+
+func NewLockManager(timeout time.Duration, lease time.Duration) *LockManager {
+	return &LockManager{held: make(map[string]*LockInfo), changed: make(chan struct{}), timeout: timeout, lease: lease}
+}
+
+func PlaybookLock(name string) string {
+	return "playbook/" + name
+}
+
+// Locks a job working on playbook needs.
+func PlaybookLocks(pbook *playbook.Playbook) []string {
+	names := []string{PlaybookLock(pbook.Name)}
+	if ep := routes.Endpoint(pbook.Adapters.Routes, pbook.Adapterconfig.Routes); ep != "" {
+		names = append(names, "routes/"+ep)
+	}
+	if ep := dnsadapters.Endpoint(pbook.Adapters.Dns, pbook.Adapterconfig.Dns); ep != "" {
+		names = append(names, "dns/"+ep)
+	}
+	return names
+}
+
+// Takes all of the locks at once, or none of them (so two jobs can't end up waiting for each other forever).
+// Waits for them until manager's timeout or until ctx is done. onwait is told about whoever is in the way, once per holder.
+func (m *LockManager) Acquire(ctx context.Context, names []string, owner string, reason string, onwait func(blocker LockInfo)) (*Lease, error) {
+	deadline := time.NewTimer(m.timeout)
+	defer deadline.Stop()
+	told := make(map[string]bool)
+	for {
+		m.mu.Lock()
+		now := time.Now()
+		var blocker *LockInfo
+		for _, name := range names {
+			if l, ok := m.held[name]; ok && l.Owner != owner && now.Before(l.Expires) {
+				blocker = l
+				break
+			}
+		}
+		if blocker == nil {
+			for _, name := range names {
+				m.held[name] = &LockInfo{Name: name, Owner: owner, Reason: reason, Acquired: now, Expires: now.Add(m.lease)}
+			}
+			m.mu.Unlock()
+			return &Lease{m: m, owner: owner, names: names}, nil
+		}
+		info, changed := *blocker, m.changed
+		m.mu.Unlock()
+		if !told[info.Name+info.Owner] && onwait != nil {
+			told[info.Name+info.Owner] = true
+			onwait(info)
+		}
+		expiry := time.NewTimer(time.Until(info.Expires))
+		select {
+		case <-changed:
+		case <-expiry.C:
+		case <-deadline.C:
+			expiry.Stop()
+			return nil, errors.New("Timed out waiting for " + info.Name + " (held by job " + info.Owner + ": " + info.Reason + ")")
+		case <-ctx.Done():
+			expiry.Stop()
+			return nil, ctx.Err()
+		}
+		expiry.Stop()
+	}
+}
+
+// Pushes expiry of lease's locks further. Locks that expired and got taken by someone else stay theirs.
+func (l *Lease) Renew() {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+	for _, name := range l.names {
+		if h, ok := l.m.held[name]; ok && h.Owner == l.owner {
+			h.Expires = time.Now().Add(l.m.lease)
+		}
+	}
+}
+
+func (l *Lease) Release() {
+	l.m.mu.Lock()
+	defer l.m.mu.Unlock()
+	for _, name := range l.names {
+		if h, ok := l.m.held[name]; ok && h.Owner == l.owner {
+			delete(l.m.held, name)
+		}
+	}
+	l.m.broadcast()
+}
+
+// Call with mu held.
+func (m *LockManager) broadcast() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// Admin's hammer. Drops a lock whoever holds it. Returns what was dropped, if anything.
+func (m *LockManager) ForceRelease(name string) (LockInfo, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.held[name]
+	if !ok {
+		return LockInfo{}, false
+	}
+	delete(m.held, name)
+	m.broadcast()
+	return *l, true
+}
+
+// Every lock that is held, expired ones included (they're still there until someone takes them).
+func (m *LockManager) List() []LockInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	locks := make([]LockInfo, 0, len(m.held))
+	for _, l := range m.held {
+		locks = append(locks, *l)
+	}
+	sort.Slice(locks, func(a, b int) bool { return strings.Compare(locks[a].Name, locks[b].Name) < 0 })
+	return locks
+}
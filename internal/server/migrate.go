@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+
+	"github.com/sergds/autovpn2/internal/playbook"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Brings db left by an older server up to date. Called on startup, before anything reads it.
+// Playbooks of older revisions are rewritten as current ones (see playbook.DecodeGob). Ones from before server had a key get sealed with it, journal entries too.
+func (s *AutoVPNServer) MigrateDB() {
+	err := s.playbookDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("playbook_obj"))
+		migrated := make(map[string]*playbook.Playbook)
+		err := b.ForEach(func(k, v []byte) error {
+			plain, sealed, err := s.vault.Open(v)
+			if err != nil { // Wrong key, most likely. Better not to start than to go on like there are no playbooks.
+				return errors.New("playbook " + string(k) + ": " + err.Error())
+			}
+			pbook, old, err := playbook.DecodeGob(plain)
+			if err != nil {
+				log.Println("Can't migrate playbook " + string(k) + ": " + err.Error())
+			} else if old || !sealed {
+				migrated[string(k)] = pbook
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for name, pbook := range migrated {
+			buf := &bytes.Buffer{}
+			if err := gob.NewEncoder(buf).Encode(pbook); err != nil {
+				return err
+			}
+			if err := b.Put([]byte(name), s.vault.Seal(buf.Bytes())); err != nil {
+				return err
+			}
+			log.Println("Migrated playbook " + name + " to current revision")
+		}
+		// Journal entries of an older server hold old playbooks too, deep inside of transaction. Not worth the trouble:
+		// there's no telling what to roll back anymore, so they're dropped and stale locks get cleared by RecoverJobs as usual.
+		j := tx.Bucket([]byte("job_journal"))
+		stale := make([][]byte, 0)
+		unsealed := make(map[string][]byte)
+		err = j.ForEach(func(k, v []byte) error {
+			plain, sealed, err := s.vault.Open(v)
+			if err != nil {
+				return errors.New("journal entry " + string(k) + ": " + err.Error())
+			}
+			if gob.NewDecoder(bytes.NewReader(plain)).Decode(&JournalEntry{}) != nil {
+				stale = append(stale, k)
+			} else if !sealed {
+				unsealed[string(k)] = plain
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			log.Println("Dropping journal entry " + string(k) + " of an older server, it can't be recovered. Check it's playbook with `autovpn plan`.")
+			j.Delete(k)
+		}
+		for k, plain := range unsealed {
+			if err := j.Put([]byte(k), s.vault.Seal(plain)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalln("failed migrating pbdb: " + err.Error())
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sergds/autovpn2/internal/playbook"
+	"gopkg.in/yaml.v3"
+)
+
+// Server's own config, avpn2_server.yaml next to the db (or wherever AVPN2_CONFIG says). Adapter profiles, and secrets adapter config can refer to:
+//
+//	secrets:
+//	  router: "hunter2"
+//	  pihole: "${file:/run/secrets/pihole}" # Secrets can say where they really are, env and file references are only for server's config.
+//	profiles:
+//	  home:
+//	    adapters: {routes: keeneticrci, dns: piholeapi}
+//	    adapterconfig:
+//	      routes: {keenetic_login: "admin:${secret:router}", keenetic_origin: "http://10.0.2.1"}
+//	      dns: {pihole_server: "http://10.0.2.2", pihole_apikey: "..."}
+//	sourcedir: /etc/avpn2/lists # Playbook sources can be files in there. Without it, only http(s) ones can.
+type ServerConfig struct {
+	Profiles  map[string]*playbook.Profile
+	Secrets   map[string]string
+	Sourcedir string
+}
+
+// Config is re-read whenever file changes, so that new router password gets used on next refresh, no restart or re-apply needed.
+type configFile struct {
+	path  string
+	mu    sync.Mutex
+	mtime time.Time
+	conf  *ServerConfig
+}
+
+// What get returns while there's no config file. Always the same one, so callers can tell config didn't change.
+var noConfig = &ServerConfig{}
+
+func (c *configFile) get() (*ServerConfig, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st, err := os.Stat(c.path)
+	if errors.Is(err, os.ErrNotExist) { // No config is fine, as long as nobody wants anything from it.
+		return noConfig, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.conf != nil && st.ModTime().Equal(c.mtime) {
+		return c.conf, nil
+	}
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &ServerConfig{}
+	if err := yaml.Unmarshal(b, conf); err != nil {
+		return nil, errors.New("bad server config " + c.path + ": " + err.Error())
+	}
+	c.conf, c.mtime = conf, st.ModTime()
+	log.Printf("Loaded server config %s (%v adapter profiles)", c.path, len(conf.Profiles))
+	return conf, nil
+}
+
+// Fills playbook's adapters in from it's profile, if it has one.
+func (s *AutoVPNServer) applyProfile(pbook *playbook.Playbook) error {
+	if pbook.Profile == "" {
+		if pbook.Overrides != nil { // Had one before.
+			pbook.UseProfile(nil)
+		}
+		return nil
+	}
+	conf, err := s.config.get()
+	if err != nil {
+		return err
+	}
+	prof, ok := conf.Profiles[pbook.Profile]
+	if !ok {
+		return errors.New("no such adapter profile " + pbook.Profile + " in " + s.config.path)
+	}
+	pbook.UseProfile(prof)
+	return nil
+}
+
+// Playbooks from db, with profiles applied as they are right now. Playbook whose profile is gone keeps adapters it had last time.
+func (s *AutoVPNServer) playbooks() map[string]*playbook.Playbook {
+	books := s.GetAllPlaybooksFromDB()
+	for name, pbook := range books {
+		if err := s.applyProfile(pbook); err != nil {
+			log.Println("Playbook " + name + ": " + err.Error())
+		}
+	}
+	return books
+}
+
+// Secrets of server's config, for ${secret:name} references, and every value config has: env and file references playbooks can use are only the ones in there.
+func (s *AutoVPNServer) serverSecrets() (map[string]string, []string, error) {
+	conf, err := s.config.get()
+	if err != nil {
+		return nil, nil, err
+	}
+	trusted := make([]string, 0)
+	for _, prof := range conf.Profiles {
+		if prof == nil {
+			continue
+		}
+		for _, conf := range []map[string]string{prof.Adapterconfig.Routes, prof.Adapterconfig.Dns} {
+			for _, v := range conf {
+				trusted = append(trusted, v)
+			}
+		}
+	}
+	return conf.Secrets, trusted, nil
+}
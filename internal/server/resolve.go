@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/likexian/doh"
+	"github.com/likexian/doh/dns"
+)
+
+// Numeric types of records resolver answers with.
+var dnsTypeCodes = map[string]int{"A": 1, "AAAA": 28, "CNAME": 5}
+
+// CNAME chains longer than that are most likely loops.
+const maxChain = 8
+
+// What resolving a host gave.
+type resolved struct {
+	addrs []string
+	chain []string // CNAMEs on the way from host to addresses, in order. Host itself isn't there.
+	ttl   int      // Lowest of every record on the way, whichever runs out first changes the answer.
+}
+
+func normName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// Resolves host's records of qtype ("A" or "AAAA"), following CNAMEs. Resolver usually gives the whole chain in one answer,
+// if it doesn't, whatever name chain stopped at gets asked about again.
+func resolveHost(ctx context.Context, host string, qtype string) (*resolved, error) {
+	c := doh.Use(doh.CloudflareProvider)
+	return followChain(host, qtype, func(name string) (*dns.Response, error) {
+		qctx, cancel := context.WithTimeout(ctx, 10*time.Second) // Job's ctx as parent, so cancelled job doesn't wait for resolver.
+		defer cancel()
+		return c.Query(qctx, dns.Domain(name), dns.Type(qtype))
+	})
+}
+
+// The actual chain walking, query asks resolver about a name.
+func followChain(host string, qtype string, query func(name string) (*dns.Response, error)) (*resolved, error) {
+	res := &resolved{addrs: make([]string, 0), chain: make([]string, 0)}
+	name := normName(host)
+	for queries := 0; queries < maxChain; queries++ {
+		resp, err := query(name)
+		if err != nil {
+			return nil, err
+		}
+		cnames := make(map[string]dns.Answer)
+		addrs := make(map[string][]dns.Answer)
+		for _, a := range resp.Answer {
+			switch a.Type {
+			case dnsTypeCodes["CNAME"]:
+				cnames[normName(a.Name)] = a
+			case dnsTypeCodes[qtype]:
+				addrs[normName(a.Name)] = append(addrs[normName(a.Name)], a)
+			}
+		}
+		asked := name
+		for {
+			if found := addrs[name]; len(found) != 0 {
+				for _, a := range found {
+					if !slices.Contains(res.addrs, a.Data) {
+						res.addrs = append(res.addrs, a.Data)
+					}
+					res.lower(a.TTL)
+				}
+				return res, nil
+			}
+			cname, ok := cnames[name]
+			if !ok {
+				break
+			}
+			name = normName(cname.Data)
+			if slices.Contains(res.chain, name) || len(res.chain) >= maxChain {
+				return nil, errors.New("CNAME chain of " + host + " goes in circles or is way too long")
+			}
+			res.chain = append(res.chain, name)
+			res.lower(cname.TTL)
+		}
+		if name == asked { // Didn't get anywhere, there's just nothing there.
+			return res, nil
+		}
+	}
+	return nil, errors.New("CNAME chain of " + host + " is way too long")
+}
+
+func (r *resolved) lower(ttl int) {
+	if r.ttl == 0 || ttl < r.ttl {
+		r.ttl = ttl
+	}
+}
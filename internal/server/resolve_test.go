@@ -0,0 +1,130 @@
+package server
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/likexian/doh/dns"
+)
+
+func cnameAnswer(name string, target string, ttl int) dns.Answer {
+	return dns.Answer{Name: name + ".", Type: dnsTypeCodes["CNAME"], TTL: ttl, Data: target + "."}
+}
+
+func addrAnswer(name string, addr string, ttl int) dns.Answer {
+	return dns.Answer{Name: name + ".", Type: dnsTypeCodes["A"], TTL: ttl, Data: addr}
+}
+
+func TestFollowChain(t *testing.T) {
+	tests := []struct {
+		name      string
+		host      string
+		answers   map[string][]dns.Answer // What resolver says about each name.
+		wantAddrs []string
+		wantChain []string
+		wantTTL   int
+		wantAsked []string
+		wantErr   bool
+	}{
+		{
+			name:      "plain",
+			host:      "a.com",
+			answers:   map[string][]dns.Answer{"a.com": {addrAnswer("a.com", "1.1.1.1", 300), addrAnswer("a.com", "1.1.1.2", 200)}},
+			wantAddrs: []string{"1.1.1.1", "1.1.1.2"},
+			wantChain: []string{},
+			wantTTL:   200,
+			wantAsked: []string{"a.com"},
+		},
+		{
+			name:      "whole chain in one answer",
+			host:      "WWW.A.com.",
+			answers:   map[string][]dns.Answer{"www.a.com": {cnameAnswer("www.a.com", "a.cdn.net", 60), cnameAnswer("a.cdn.net", "edge.cdn.net", 3600), addrAnswer("edge.cdn.net", "2.2.2.2", 120)}},
+			wantAddrs: []string{"2.2.2.2"},
+			wantChain: []string{"a.cdn.net", "edge.cdn.net"},
+			wantTTL:   60,
+			wantAsked: []string{"www.a.com"},
+		},
+		{
+			name: "chain asked again where it stopped",
+			host: "www.a.com",
+			answers: map[string][]dns.Answer{
+				"www.a.com": {cnameAnswer("www.a.com", "a.cdn.net", 600)},
+				"a.cdn.net": {addrAnswer("a.cdn.net", "3.3.3.3", 900)},
+			},
+			wantAddrs: []string{"3.3.3.3"},
+			wantChain: []string{"a.cdn.net"},
+			wantTTL:   600,
+			wantAsked: []string{"www.a.com", "a.cdn.net"},
+		},
+		{
+			name:      "records of other names are ignored",
+			host:      "a.com",
+			answers:   map[string][]dns.Answer{"a.com": {addrAnswer("b.com", "9.9.9.9", 10), addrAnswer("a.com", "1.1.1.1", 300)}},
+			wantAddrs: []string{"1.1.1.1"},
+			wantChain: []string{},
+			wantTTL:   300,
+			wantAsked: []string{"a.com"},
+		},
+		{
+			name:      "nothing there",
+			host:      "nx.a.com",
+			answers:   map[string][]dns.Answer{},
+			wantAddrs: []string{},
+			wantChain: []string{},
+			wantAsked: []string{"nx.a.com"},
+		},
+		{
+			name:      "dangling CNAME",
+			host:      "www.a.com",
+			answers:   map[string][]dns.Answer{"www.a.com": {cnameAnswer("www.a.com", "gone.cdn.net", 60)}},
+			wantAddrs: []string{},
+			wantChain: []string{"gone.cdn.net"},
+			wantTTL:   60,
+			wantAsked: []string{"www.a.com", "gone.cdn.net"},
+		},
+		{
+			name:    "loop",
+			host:    "a.com",
+			answers: map[string][]dns.Answer{"a.com": {cnameAnswer("a.com", "b.com", 60), cnameAnswer("b.com", "c.com", 60), cnameAnswer("c.com", "b.com", 60)}},
+			wantErr: true,
+		},
+		{
+			name: "too long",
+			host: "c0.com",
+			answers: func() map[string][]dns.Answer {
+				answers := make(map[string][]dns.Answer)
+				names := []string{"c0.com", "c1.com", "c2.com", "c3.com", "c4.com", "c5.com", "c6.com", "c7.com", "c8.com", "c9.com"}
+				for i := 0; i+1 < len(names); i++ {
+					answers[names[i]] = []dns.Answer{cnameAnswer(names[i], names[i+1], 60)} // One hop per query.
+				}
+				return answers
+			}(),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asked := make([]string, 0)
+			res, err := followChain(tt.host, "A", func(name string) (*dns.Response, error) {
+				asked = append(asked, name)
+				return &dns.Response{Answer: tt.answers[name]}, nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !slices.Equal(res.addrs, tt.wantAddrs) || !slices.Equal(res.chain, tt.wantChain) || res.ttl != tt.wantTTL {
+				t.Errorf("got addrs %v, chain %v, ttl %v, want %v, %v, %v", res.addrs, res.chain, res.ttl, tt.wantAddrs, tt.wantChain, tt.wantTTL)
+			}
+			if !slices.Equal(asked, tt.wantAsked) {
+				t.Errorf("asked about %v, want %v", asked, tt.wantAsked)
+			}
+		})
+	}
+	if _, err := followChain("a.com", "A", func(name string) (*dns.Response, error) { return nil, errors.New("resolver is down") }); err == nil {
+		t.Error("resolver failing isn't an error")
+	}
+}
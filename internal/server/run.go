@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"encoding/gob"
 	"errors"
@@ -8,12 +9,14 @@ import (
 	"log"
 	"net"
 	"os"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/grandcat/zeroconf"
+	"github.com/sergds/autovpn2/internal/asndb"
 	"github.com/sergds/autovpn2/internal/playbook"
 	pb "github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/secrets"
 	"github.com/sergds/autovpn2/internal/server/executor"
 	bolt "go.etcd.io/bbolt"
 	"google.golang.org/grpc"
@@ -25,18 +28,32 @@ type AutoVPNServer struct {
 	pb.UnimplementedAutoVPNServer
 	playbookDB *bolt.DB
 	updater    *AutoUpdater
+	reconciler *Reconciler
+	jobs       map[string]*runningJob // Jobs running right now, by ID.
+	jobsMu     sync.Mutex
+	locks      *LockManager
+	asndb      *asndb.DB // nil if there's none configured.
+	dnsproxy   *DNSProxy // nil if it's off.
+	config     *configFile
+	secrets    *secrets.Store
+	vault      *secrets.Vault
 }
 
-func GetAllPlaybooksFromDB(db *bolt.DB) map[string]*playbook.Playbook {
+// Playbooks are sealed with server's key on disk, adapterconfig has passwords in it.
+func (s *AutoVPNServer) GetAllPlaybooksFromDB() map[string]*playbook.Playbook {
 	var playbooks map[string]*playbook.Playbook = make(map[string]*playbook.Playbook)
-	db.View(func(tx *bolt.Tx) error {
+	s.playbookDB.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("playbook_obj"))
 
 		c := b.Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			var pb *playbook.Playbook = &playbook.Playbook{}
-			err := gob.NewDecoder(strings.NewReader(string(v))).Decode(pb)
+			plain, _, err := s.vault.Open(v)
+			if err != nil {
+				log.Println("playbook " + string(k) + ": " + err.Error())
+				continue
+			}
+			pb, _, err := playbook.DecodeGob(plain)
 			if err != nil {
 				log.Println(err)
 				continue
@@ -48,29 +65,38 @@ func GetAllPlaybooksFromDB(db *bolt.DB) map[string]*playbook.Playbook {
 	return playbooks
 }
 
-func DeletePlaybookDB(db *bolt.DB, pb *playbook.Playbook) error {
-	err := db.Update(func(tx *bolt.Tx) error {
+func (s *AutoVPNServer) DeletePlaybookDB(pb *playbook.Playbook) error {
+	err := s.playbookDB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("playbook_obj"))
 		b.Delete([]byte(pb.Name))
 		return nil
 	})
+	s.playbooksChanged()
 	return err
 }
 
-func UpdatePlaybookDB(db *bolt.DB, pb *playbook.Playbook) error {
-	err := db.Update(func(tx *bolt.Tx) error {
+func (s *AutoVPNServer) UpdatePlaybookDB(pb *playbook.Playbook) error {
+	err := s.playbookDB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("playbook_obj"))
-		pbgob := &strings.Builder{}
+		pbgob := &bytes.Buffer{}
 		err := gob.NewEncoder(pbgob).Encode(pb)
 		if err != nil {
 			return errors.New("db transaction failed: " + err.Error())
 		}
-		b.Put([]byte(pb.Name), []byte(pbgob.String()))
+		b.Put([]byte(pb.Name), s.vault.Seal(pbgob.Bytes()))
 		return nil
 	})
+	s.playbooksChanged()
 	return err
 }
 
+// Whoever keeps playbooks around has to read them again.
+func (s *AutoVPNServer) playbooksChanged() {
+	if s.dnsproxy != nil {
+		s.dnsproxy.Invalidate()
+	}
+}
+
 func (*AutoVPNServer) reportStatus(ss pb.AutoVPN_ExecuteTaskServer, state string, msg string) {
 	st := "[" + state + "] " + pb.DescribeState(state)
 	ss.Send(&pb.ExecuteUpdate{Statecode: state, Statetext: &st, Opdesc: &msg})
@@ -78,81 +104,34 @@ func (*AutoVPNServer) reportStatus(ss pb.AutoVPN_ExecuteTaskServer, state string
 
 func (s *AutoVPNServer) ExecuteTask(in *pb.ExecuteRequest, ss pb.AutoVPN_ExecuteTaskServer) error {
 	s.reportStatus(ss, pb.STEP_NOTIFY, "Building Executor")
-	var ex *executor.Executor = executor.NewExecutor()
 	var builder *TaskBuilder = NewTaskBuilder(s)
-	switch in.Operation { // Build Executor
-	case pb.TASK_LIST:
-		{
-			err := builder.List()
-			if err != nil {
-				s.reportStatus(ss, pb.STEP_ERROR, err.Error())
-				return err
-			}
-			ex = builder.Build()
-		}
-	case pb.TASK_APPLY:
-		{
-			err := builder.Apply(in.Argv[0])
-			if err != nil {
-				s.reportStatus(ss, pb.STEP_ERROR, err.Error())
-				return err
-			}
-			ex = builder.Build()
+	if in.Operation == pb.TASK_DETACH {
+		if len(in.Argv) == 0 {
+			s.reportStatus(ss, pb.STEP_ERROR, "Missing task to detach!")
+			return nil
 		}
-	case pb.TASK_UNDO:
-		{
-			err := builder.Undo(in.Argv[0])
-			if err != nil {
-				s.reportStatus(ss, pb.STEP_ERROR, err.Error())
-				return err
-			}
-			ex = builder.Build()
+		if err := builder.Task(in.Argv[0], in.Argv[1:]); err != nil {
+			s.reportStatus(ss, pb.STEP_ERROR, err.Error())
+			return err
 		}
-	default:
-		s.reportStatus(ss, pb.STEP_ERROR, "Failed to build executor: task doesn't exist")
+		// Nobody is watching, so it's not tied to this stream. Whatever it says ends up in job record.
+		go func() {
+			s.RunTask(context.Background(), builder, func(upd *executor.ExecutorUpdate) {})
+			s.UpdateUpdaterTable()
+		}()
+		s.reportStatus(ss, pb.STEP_PUSH_SUMMARY, "Started job "+builder.jobid+" in background. Follow it with: autovpn attach "+builder.jobid)
 		return nil
 	}
-	if ex != nil { // Run & Report
-		c := make(chan *executor.ExecutorUpdate)
-		ex.Start(c)
-		var err error
-		for err == nil && ss.Context().Err() == nil {
-			eupdctx, cancel := context.WithCancel(context.Background())
-			go func() {
-				for eupdctx.Err() == nil {
-					upd := <-c
-					s.reportStatus(ss, upd.CurrentStep, upd.StepMessage)
-				}
-			}()
-			err = ex.Tick()
-			if err != nil {
-				if err.Error() == executor.ERR_FINISHED || err.Error() == executor.ERR_NOTSTART {
-					cancel()
-					break
-				} else {
-					log.Fatalln(err)
-				}
-			}
-			err = ex.GetLastError()
-			if err != nil {
-				if err.Error() == executor.ERR_FINISHED || err.Error() == executor.ERR_NOTSTART {
-					cancel()
-					break
-				} else {
-					// Otherwise this error is from a step, let the pump process that
-					err = nil
-					time.Sleep(time.Millisecond * 10)
-				}
-			}
-			cancel()
-			time.Sleep(time.Millisecond * 10)
-		}
-		if ex.IsRunning() {
-			return ss.Context().Err()
-		}
-	} else {
-		s.reportStatus(ss, pb.STEP_ERROR, "Failed to run executor: executor is nil")
-		return nil
+	if err := builder.Task(in.Operation, in.Argv); err != nil { // Build Executor
+		s.reportStatus(ss, pb.STEP_ERROR, err.Error())
+		return err
+	}
+	// Run & Report
+	err := s.RunTask(ss.Context(), builder, func(upd *executor.ExecutorUpdate) {
+		s.reportStatus(ss, upd.CurrentStep, upd.StepMessage)
+	})
+	if err != nil && ss.Context().Err() != nil {
+		return err
 	}
 	s.UpdateUpdaterTable()
 	return nil
@@ -160,11 +139,16 @@ func (s *AutoVPNServer) ExecuteTask(in *pb.ExecuteRequest, ss pb.AutoVPN_Execute
 
 func (s *AutoVPNServer) UpdateUpdaterTable() {
 	log.Println("Updating autoupdater ")
-	books := GetAllPlaybooksFromDB(s.playbookDB)
+	books := s.playbooks()
 	for name, pbook := range books {
 		if pbook.GetInstallState() && pbook.GetLockReason() == "" {
-			log.Println("Adding updater entry: " + name + " :: " + fmt.Sprint(pbook.Autoupdateinterval) + " hour(s)")
-			s.updater.UpdateEntry(name, pbook.Autoupdateinterval)
+			sched, window, err := pbook.UpdateSchedule()
+			if err != nil {
+				log.Println("Not auto updating " + name + ": " + err.Error())
+				continue
+			}
+			log.Println("Adding updater entry: " + name + " :: " + fmt.Sprint(sched))
+			s.updater.UpdateEntry(name, sched, window, time.Duration(pbook.Schedulejitter)*time.Minute)
 		}
 	}
 	// Clean up removed.
@@ -189,6 +173,28 @@ func (s *AutoVPNServer) UpdaterLoop() {
 	}
 }
 
+// Opens server's db, with every bucket it needs.
+func openPlaybookDB(path string) (*bolt.DB, error) {
+	pbdb, err := bolt.Open(path, 0666, &bolt.Options{})
+	if err != nil {
+		return nil, err
+	}
+	err = pbdb.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []string{"playbook_obj", "job_history", "job_journal"} {
+			_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		pbdb.Close()
+		return nil, fmt.Errorf("failed preparing pbdb: %s", err)
+	}
+	return pbdb, nil
+}
+
 func ServerMain() {
 	lis, err := net.Listen("tcp", "0.0.0.0:15328")
 	if err != nil {
@@ -199,25 +205,52 @@ func ServerMain() {
 	if dbpath != "" {
 		dbpath += string(os.PathSeparator)
 	}
-	pbdb, err := bolt.Open(dbpath+"avpn2_playbooks.db", 0666, &bolt.Options{})
+	pbdb, err := openPlaybookDB(dbpath + "avpn2_playbooks.db")
 	if err != nil {
 		log.Println("failed to open pbdb: " + err.Error())
 		os.Exit(1)
 	}
-	err = pbdb.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("playbook_obj"))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+	srv := &AutoVPNServer{playbookDB: pbdb, jobs: make(map[string]*runningJob)}
+	srv.config = &configFile{path: dbpath + "avpn2_server.yaml"}
+	if path := os.Getenv("AVPN2_CONFIG"); path != "" {
+		srv.config.path = path
+	}
+	srv.secrets = secrets.NewStore(srv.serverSecrets)
+	log.SetOutput(&redactingWriter{out: log.Writer(), store: srv.secrets})
+	keypath := dbpath + "avpn2.key"
+	if path := os.Getenv("AVPN2_KEYFILE"); path != "" {
+		keypath = path
+	}
+	if srv.vault, err = secrets.OpenVault(keypath); err != nil {
+		log.Fatalln("failed opening server key: " + err.Error())
+	}
+	if path := os.Getenv("AVPN2_ASNDB"); path != "" {
+		srv.asndb = asndb.Open(path)
+		if url := os.Getenv("AVPN2_ASNDB_URL"); url != "" {
+			go srv.asndb.RefreshLoop(url, time.Duration(envSeconds("AVPN2_ASNDB_REFRESH", 24))*time.Hour)
 		}
-		return nil
-	})
-	if err != nil {
-		log.Fatalf("failed preparing pbdb: %s", err)
 	}
-	srv := &AutoVPNServer{playbookDB: pbdb}
+	srv.locks = NewLockManager(time.Duration(envSeconds("AVPN2_LOCK_TIMEOUT", 120))*time.Second, time.Duration(envSeconds("AVPN2_LOCK_LEASE", 600))*time.Second)
 	upd := NewAutoUpdater(srv)
 	srv.updater = upd
+	if os.Getenv("AVPN2_DNSPROXY") != "" { // Before any job runs, they tell it when playbooks change.
+		upstream := os.Getenv("AVPN2_DNSPROXY_UPSTREAM")
+		if upstream == "" {
+			upstream = "1.1.1.1"
+		}
+		srv.dnsproxy = NewDNSProxy(srv, upstreamAddr(upstream))
+	}
+	srv.MigrateDB()
+	srv.MarkInterruptedJobs()
+	srv.RecoverJobs()
 	go srv.UpdaterLoop()
+	srv.reconciler = NewReconciler(srv)
+	go srv.reconciler.Loop()
+	if addr := os.Getenv("AVPN2_DNSPROXY"); addr != "" {
+		go func() {
+			log.Fatalln("dns proxy failed: " + srv.dnsproxy.ListenAndServe(addr).Error())
+		}()
+	}
 	pb.RegisterAutoVPNServer(s, srv)
 	host, _ := os.Hostname()
 	server, err := zeroconf.Register("AutoVPN Server @ "+host, "_autovpn._tcp", "local.", 15328, []string{"txtv=0", "host=" + host}, nil)
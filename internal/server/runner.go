@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	pb "github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+// Drives executor until it runs out of steps (or a step fails), handing every update to report.
+// Used both by grpc tasks and by background jobs nobody is watching (like auto-updates).
+// Cancelling ctx cancels the job: running steps are told to stop and waited for, the rest never start.
+// Returns the step error if some step failed, or ctx error if job got cancelled.
+func RunExecutor(ctx context.Context, ex *executor.Executor, report func(upd *executor.ExecutorUpdate)) error {
+	c := make(chan *executor.ExecutorUpdate)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case upd := <-c:
+				report(upd)
+			case <-done:
+				return
+			}
+		}
+	}()
+	ex.StartContext(ctx, c)
+	var err error
+	for err == nil {
+		err = ex.Tick() // Blocks until some step finishes, no need to poll.
+	}
+	close(done)
+	wg.Wait()
+	if err.Error() == executor.ERR_FINISHED {
+		return nil
+	}
+	return err
+}
+
+// Runs task built by builder as a job: with an ID, a record and output that can be followed (see jobs.go).
+// If some step fails or job gets cancelled, whatever the task changed so far gets rolled back.
+// Rollback runs to the end even if caller is gone, leaving half applied playbook around is worse. Secrets are cut out of every update.
+// Before anything runs, job takes the locks task needs, waiting for whoever holds them.
+func (s *AutoVPNServer) RunTask(ctx context.Context, builder *TaskBuilder, report func(upd *executor.ExecutorUpdate)) error {
+	if builder.quiet {
+		return RunExecutor(ctx, builder.Build(), func(upd *executor.ExecutorUpdate) {
+			report(s.redactUpdate(upd))
+		})
+	}
+	jobctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	job := s.startJob(builder, cancel)
+	tee := func(upd *executor.ExecutorUpdate) {
+		upd = s.redactUpdate(upd)
+		job.add(upd)
+		report(upd)
+	}
+	if len(builder.locks) != 0 {
+		reason := builder.task
+		if builder.pbname != "" {
+			reason += " of " + builder.pbname
+		}
+		lease, err := s.locks.Acquire(jobctx, builder.locks, builder.jobid, reason, func(blocker LockInfo) {
+			tee(&executor.ExecutorUpdate{CurrentStep: pb.STEP_PUSH_SUMMARY, StepMessage: "Waiting for " + blocker.Name + ", held by job " + blocker.Owner + " (" + blocker.Reason + ")"})
+		})
+		if err != nil {
+			tee(&executor.ExecutorUpdate{CurrentStep: pb.STEP_ERROR, StepMessage: "Couldn't lock: " + err.Error()})
+			s.finishJob(job, err)
+			return err
+		}
+		defer lease.Release() // After rollback, that one needs the locks too.
+		renew := tee
+		tee = func(upd *executor.ExecutorUpdate) {
+			lease.Renew() // Job that says something is alive.
+			renew(upd)
+		}
+	}
+	ex := builder.Build()
+	if builder.journaled {
+		j := s.openJournal(builder.jobid, builder, ex)
+		defer j.close()
+	}
+	err := RunExecutor(jobctx, ex, tee)
+	if err != nil {
+		if rb := builder.BuildRollback(); rb != nil {
+			log.Println("task failed, rolling back: " + err.Error())
+			if errors.Is(err, context.Canceled) {
+				tee(&executor.ExecutorUpdate{CurrentStep: pb.STEP_PUSH_SUMMARY, StepMessage: "Task cancelled, rolling back:"})
+			} else {
+				tee(&executor.ExecutorUpdate{CurrentStep: pb.STEP_PUSH_SUMMARY, StepMessage: "Task failed (" + err.Error() + "), rolling back:"})
+			}
+			if rberr := RunExecutor(context.Background(), rb, tee); rberr != nil {
+				log.Println("rollback failed: " + rberr.Error())
+			}
+			tee(&executor.ExecutorUpdate{CurrentStep: pb.STEP_PUSH_SUMMARY, StepMessage: "Rolled back."})
+		}
+	}
+	s.finishJob(job, err)
+	return err
+}
+
+// Checks if job got cancelled, and if so tells the client. Step should just return then.
+func cancelled(updates chan *executor.ExecutorUpdate, ctx context.Context) bool {
+	if ctx.Err() == nil {
+		return false
+	}
+	updates <- &executor.ExecutorUpdate{CurrentStep: pb.STEP_ERROR, StepMessage: "Cancelled: " + ctx.Err().Error()}
+	return true
+}
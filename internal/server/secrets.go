@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"slices"
+
+	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+	"github.com/sergds/autovpn2/internal/playbook"
+
+	"github.com/sergds/autovpn2/internal/secrets"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+// Route and DNS adapters both.
+type authenticator interface {
+	Authenticate(conf map[string]string) error
+}
+
+// Authenticates ad with references in conf resolved. Adapters like to put what they got into their errors, those are redacted.
+func (s *AutoVPNServer) authenticate(ad authenticator, conf map[string]string) error {
+	resolved, err := s.secrets.Resolve(conf, secretKey)
+	if err != nil {
+		return errors.New("bad secret reference: " + err.Error())
+	}
+	if err := ad.Authenticate(resolved); err != nil {
+		return errors.New(s.secrets.Redact(err.Error()))
+	}
+	return nil
+}
+
+// env and file references playbook has on it's own are refused before anything gets applied, not when adapter authenticates halfway through.
+func (s *AutoVPNServer) checkSecrets(pbook *playbook.Playbook) error {
+	for _, conf := range []map[string]string{pbook.Adapterconfig.Routes, pbook.Adapterconfig.Dns} {
+		if err := s.secrets.Check(conf); err != nil {
+			return errors.New("bad secret reference: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Whether key holds credentials of some adapter. Keys are named after adapters, so there's no telling one adapter's key from another's anyway.
+func secretKey(key string) bool {
+	for _, name := range routes.Names {
+		if slices.Contains(routes.SecretKeys(name), key) {
+			return true
+		}
+	}
+	for _, name := range dnsadapters.Names {
+		if slices.Contains(dnsadapters.SecretKeys(name), key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy of upd that's fine to show to people (and to keep in job history).
+func (s *AutoVPNServer) redactUpdate(upd *executor.ExecutorUpdate) *executor.ExecutorUpdate {
+	redacted := *upd
+	redacted.StepMessage = s.secrets.Redact(upd.StepMessage)
+	return &redacted
+}
+
+// Server's log goes through this, so that whatever adapters and steps log doesn't leak secrets either.
+type redactingWriter struct {
+	out   io.Writer
+	store *secrets.Store
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := w.out.Write([]byte(w.store.Redact(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sergds/autovpn2/internal/playbook"
+	"github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+// Lists are big, but not that big. Anything larger is most likely not a list.
+const maxSourceSize = 64 << 20
+
+func (s *AutoVPNServer) readSource(ctx context.Context, url string) (string, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		path, err := s.sourcePath(url)
+		if err != nil {
+			return "", err
+		}
+		b, err := os.ReadFile(path)
+		return string(b), err
+	}
+	rctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(rctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", errors.New("non 200 status code")
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxSourceSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > maxSourceSize {
+		return "", fmt.Errorf("larger than %v MiB", maxSourceSize>>20)
+	}
+	return string(b), nil
+}
+
+// Anyone who can apply a playbook picks what server reads, so files are off unless server's config has a sourcedir, and then only files in it are.
+// Relative paths are relative to it.
+func (s *AutoVPNServer) sourcePath(path string) (string, error) {
+	if strings.Contains(path, "://") {
+		return "", errors.New("only http(s) sources can be fetched")
+	}
+	conf, err := s.config.get()
+	if err != nil {
+		return "", err
+	}
+	if conf.Sourcedir == "" {
+		return "", errors.New("local sources are off (set sourcedir in " + s.config.path + ")")
+	}
+	dir, err := filepath.EvalSymlinks(conf.Sourcedir)
+	if err != nil {
+		return "", errors.New("bad sourcedir: " + err.Error())
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	target, err := filepath.EvalSymlinks(path) // Symlink in sourcedir pointing out of it is no different from the path it points to.
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(dir, target); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New(path + " is outside of sourcedir " + conf.Sourcedir)
+	}
+	return target, nil
+}
+
+// Hosts playbook's sources have that aren't in it's hosts already, in order, and which source each came from.
+// Source that can't be fetched keeps whatever it gave last time (prev), so that a site being down doesn't unroute half of the list. First time around there's nothing to keep, and that's an error.
+func (s *AutoVPNServer) fetchSources(ctx context.Context, pbook *playbook.Playbook, prev map[string]string, updates chan *executor.ExecutorUpdate) (map[string]string, []string, error) {
+	sourced := make(map[string]string)
+	extra := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, h := range pbook.Hosts {
+		seen[strings.ToLower(strings.TrimSuffix(h, "."))] = true
+	}
+	for _, src := range pbook.Sources {
+		var hosts []string
+		text, err := s.readSource(ctx, src.Url)
+		if err != nil {
+			for h, from := range prev {
+				if from == src.Url {
+					hosts = append(hosts, h)
+				}
+			}
+			if len(hosts) == 0 {
+				return nil, nil, errors.New("failed to fetch source " + src.Url + ": " + err.Error())
+			}
+			slices.Sort(hosts)
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: fmt.Sprintf("Failed to fetch source %s (%s), keeping %v hosts it had last time", src.Url, err.Error(), len(hosts))}
+		} else {
+			var skipped int
+			hosts, skipped = playbook.ParseSource(src.Format, text)
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: fmt.Sprintf("Fetched source %s: %v hosts, %v entries skipped", src.Url, len(hosts), skipped)}
+		}
+		for _, h := range hosts {
+			key := strings.ToLower(strings.TrimSuffix(h, "."))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			sourced[h] = src.Url
+			extra = append(extra, h)
+		}
+	}
+	return sourced, extra, nil
+}
+
+// " (from <source>)" for hosts that came from a source, so that summary tells where that weird host came from.
+func sourceNote(pbook *playbook.Playbook, host string) string {
+	if from, ok := pbook.PlaybookSourced[host]; ok {
+		return " (from " + from + ")"
+	}
+	return ""
+}
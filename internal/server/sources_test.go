@@ -0,0 +1,65 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSourcePath(t *testing.T) {
+	tests := []struct {
+		name      string
+		sourcedir bool // Whether config has one.
+		path      string
+		want      string // Relative to sourcedir.
+		wantErr   string
+	}{
+		{name: "off by default", path: "{dir}/list.txt", wantErr: "local sources are off"},
+		{name: "absolute", sourcedir: true, path: "{dir}/list.txt", want: "list.txt"},
+		{name: "relative", sourcedir: true, path: "sub/list.txt", want: "sub/list.txt"},
+		{name: "outside", sourcedir: true, path: "{other}/secret.txt", wantErr: "outside of sourcedir"},
+		{name: "dots", sourcedir: true, path: "../other/secret.txt", wantErr: "outside of sourcedir"},
+		{name: "symlink out", sourcedir: true, path: "link.txt", wantErr: "outside of sourcedir"},
+		{name: "other scheme", sourcedir: true, path: "file://{dir}/list.txt", wantErr: "only http(s)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := testServer(t)
+			root := t.TempDir()
+			dir, other := filepath.Join(root, "lists"), filepath.Join(root, "other")
+			for _, d := range []string{filepath.Join(dir, "sub"), other} {
+				if err := os.MkdirAll(d, 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, f := range []string{filepath.Join(dir, "list.txt"), filepath.Join(dir, "sub", "list.txt"), filepath.Join(other, "secret.txt")} {
+				if err := os.WriteFile(f, []byte("a.com\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.Symlink(filepath.Join(other, "secret.txt"), filepath.Join(dir, "link.txt")); err != nil {
+				t.Fatal(err)
+			}
+			if tt.sourcedir {
+				if err := os.WriteFile(srv.config.path, []byte("sourcedir: "+dir+"\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			path := strings.NewReplacer("{dir}", dir, "{other}", other).Replace(tt.path)
+			got, err := srv.sourcePath(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, _ := filepath.EvalSymlinks(filepath.Join(dir, tt.want)); got != want {
+				t.Errorf("path = %v, want %v", got, want)
+			}
+		})
+	}
+}
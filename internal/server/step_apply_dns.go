@@ -2,9 +2,6 @@ package server
 
 import (
 	"context"
-	"net"
-	"strings"
-	"time"
 
 	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
 	"github.com/sergds/autovpn2/internal/playbook"
@@ -12,54 +9,61 @@ import (
 	"github.com/sergds/autovpn2/internal/server/executor"
 )
 
-// Put these DNS records onto our dns cache server or whatever.
-// Wants in context: "playbook", "dnsrecords"
+// Put these DNS records onto our dns cache server or whatever. Only the difference gets pushed, records that are already right are left alone.
+// Wants in context: "playbook", "dnsrecords", "old_playbook" (optional, records of it's hosts are ours to remove), "transaction" (optional)
 func (s *AutoVPNServer) StepApplyDNS(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
 	curpb := ctx.Value("playbook").(*playbook.Playbook)
-	dnsrecords := ctx.Value("dnsrecords").(map[string]string)
+	dnsrecords := ctx.Value("dnsrecords").(map[string][]string)
+	old_pbook, _ := ctx.Value("old_playbook").(*playbook.Playbook)
+	tx, _ := ctx.Value("transaction").(*Transaction)
 
 	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "DNS Summary:"}
 	var dnsad dnsadapters.DNSAdapter = dnsadapters.NewDNSAdapter(curpb.Adapters.Dns)
-	if err := dnsad.Authenticate(curpb.Adapterconfig.Dns); err == nil {
+	if dnsad == nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to create dns adapter " + curpb.Adapters.Dns}
+		return ctx
+	}
+	dnsad.SetContext(ctx)
+	if err := s.authenticate(dnsad, curpb.Adapterconfig.Dns); err == nil {
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Authenticated!"}
 	} else {
-		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Unauthorized!"}
-		time.Sleep(1 * time.Second)
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to authenticate on " + curpb.Adapters.Dns + ": " + err.Error()}
 		return ctx
 	}
-	conflicts := make([]dnsadapters.DNSRecord, 0)
-	recs, err := dnsad.GetRecords("A")
+	recs, err := getRecords(dnsad, curpb.RecordTypes())
 	if err != nil {
-		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed getting conflicts! Applying blindly"}
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed getting current records: " + err.Error()}
+		return ctx
 	}
-	for _, rec := range recs {
-		for _, domain := range curpb.Hosts {
-			if rec.Domain == domain {
-				updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Found conflicting record: " + rec.Domain}
-				conflicts = append(conflicts, rec) // conflicts shall be recreated
-			}
-		}
+	changes := DiffRecords(DesiredRecords(curpb, dnsrecords), recs, OwnedDomains(curpb, old_pbook))
+	for _, record := range changes.Unchanged {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Unchanged " + record.String()}
 	}
-	for _, record := range conflicts {
+	for _, record := range changes.Remove {
+		if cancelled(updates, ctx) {
+			return ctx
+		}
 		err := dnsad.DelRecord(record)
 		if err != nil {
-			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed to delete conflict " + record.Domain + ": " + err.Error()}
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to remove " + record.String() + ": " + err.Error()}
+			return ctx
 		}
+		tx.RecordRemoved(record)
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Removed " + record.String()}
 	}
-	for host, ip := range dnsrecords {
-		// Ignore raw IP's
-		if strings.Contains(host, "in-addr") {
-			continue
+	for _, record := range changes.Add {
+		if cancelled(updates, ctx) {
+			return ctx
 		}
-		ipaddr := net.ParseIP(ip)
-		err := dnsad.AddRecord(dnsadapters.DNSRecord{Domain: host, Addr: ipaddr, Type: "A"})
+		err := dnsad.AddRecord(record)
 		if err != nil {
-			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed to add " + host + "\tIN\tA\t" + ip + ": " + err.Error()}
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to add " + record.String() + ": " + err.Error()}
 			return ctx
 		}
-		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Added " + host + "\tIN\tA\t" + ip}
+		tx.RecordAdded(record)
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Added " + record.String()}
 	}
-	err = UpdatePlaybookDB(s.playbookDB, curpb)
+	err = s.UpdatePlaybookDB(curpb)
 	s.UpdateUpdaterTable()
 	if err != nil {
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed updating playbook in db: " + err.Error()}
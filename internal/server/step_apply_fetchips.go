@@ -2,67 +2,192 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"slices"
 	"strings"
 	"time"
 
-	"github.com/likexian/doh"
-	"github.com/likexian/doh/dns"
 	"github.com/sergds/autovpn2/internal/playbook"
 	"github.com/sergds/autovpn2/internal/rpc"
 	"github.com/sergds/autovpn2/internal/server/executor"
 )
 
-// Run DOH resolver to gather ips to route.
-// Wants in context: "playbook"
+// Run DOH resolver to gather ips to route. Every A record of a host is kept, hosts behind several addresses need all of them routed.
+// CNAMEs are followed to the end, names on the way are remembered (and pinned to the same addresses, if playbook says so).
+// Playbook's ASNs are expanded into prefixes they announce, from server's ASN db. Hosts of playbook's sources are fetched and resolved along with it's own.
+// Wants in context: "playbook", "only_hosts" (optional, resolve just these and keep the rest of PlaybookAddrs as is)
 func (s *AutoVPNServer) StepFetchIPs(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
-	var dnsrecords map[string]string = make(map[string]string)
+	var dnsrecords map[string][]string = make(map[string][]string)
 	curpb := ctx.Value("playbook").(*playbook.Playbook)
-	for _, host := range curpb.Hosts {
-		// Check if host is an internet address. Just store them as is and generate an arpa rdns domain.
-		if net.ParseIP(host) != nil {
-			octets := strings.Split(host, ".")
-			slices.Reverse(octets)
-			arpa := strings.Join(octets, ".") + ".in-addr.arpa"
-			dnsrecords[arpa] = host
-			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Processed IP " + host + " -> " + arpa}
-
-			continue
+	hosts := curpb.Hosts
+	only_hosts := false
+	if some, ok := ctx.Value("only_hosts").([]string); ok {
+		hosts, only_hosts = some, true
+		for h, ips := range curpb.PlaybookAddrs {
+			dnsrecords[h] = ips
+		}
+	}
+	if curpb.PlaybookTTLs == nil || curpb.PlaybookResolved == nil {
+		curpb.PlaybookTTLs = make(map[string]int)
+		curpb.PlaybookResolved = make(map[string]int64)
+	}
+	if curpb.PlaybookChains == nil {
+		curpb.PlaybookChains = make(map[string][]string)
+	}
+	if !only_hosts { // Sources are fetched anew on full updates only, like ASNs.
+		prev := curpb.PlaybookSourced
+		if old, ok := ctx.Value("old_playbook").(*playbook.Playbook); ok && prev == nil {
+			prev = old.PlaybookSourced
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		c := doh.Use(doh.CloudflareProvider)
-		resp, err := c.Query(ctx, dns.Domain(host), dns.TypeA)
+		sourced, extra, err := s.fetchSources(ctx, curpb, prev, updates)
 		if err != nil {
-			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to resolve domain " + host + "! " + err.Error()}
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: err.Error()}
 			return ctx
 		}
-		answ := ""
-		for _, a := range resp.Answer {
-			if a.Type == 1 {
-				answ = a.Data
+		curpb.PlaybookSourced = sourced
+		hosts = append(slices.Clone(hosts), extra...)
+		// Hosts that left playbook (or their source) shouldn't come back with TTL refresh.
+		current := make(map[string]bool, len(hosts))
+		for _, h := range hosts {
+			current[h] = true
+		}
+		for h := range curpb.PlaybookResolved {
+			if !current[h] {
+				delete(curpb.PlaybookResolved, h)
+				delete(curpb.PlaybookTTLs, h)
+				delete(curpb.PlaybookChains, h)
 			}
 		}
-		if err != nil {
-			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed to resolve domain " + host + "! " + err.Error()}
+	}
+nextHost:
+	for _, host := range hosts {
+		if cancelled(updates, ctx) {
+			return ctx
+		}
+		// Networks (prefixes and ranges) are routed as they are. Nothing to resolve, nothing to pin.
+		if prefixes, ok, err := playbook.ParseNetwork(host); ok {
+			if err != nil {
+				updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: err.Error()}
+				return ctx
+			}
+			nets := make([]string, 0, len(prefixes))
+			for _, p := range prefixes {
+				nets = append(nets, p.String())
+			}
+			dnsrecords[host] = nets
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Processed network " + host + sourceNote(curpb, host) + " -> " + strings.Join(nets, ", ")}
+			continue
+		}
+		// Check if host is an internet address. Just store them as is and generate an arpa rdns domain.
+		if ip := net.ParseIP(host); ip != nil {
+			arpa := reverseName(ip)
+			dnsrecords[arpa] = []string{host}
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Processed IP " + host + sourceNote(curpb, host) + " -> " + arpa}
+
 			continue
 		}
-		if answ != "" {
+		if only_hosts { // Chain may have changed since, names pinned for it are going to be pinned anew.
+			for _, name := range curpb.PlaybookChains[host] {
+				if !curpb.IsHost(name) && !inOtherChain(curpb, host, name) {
+					delete(dnsrecords, name)
+				}
+			}
+		}
+		answ := make([]string, 0)
+		chain := make([]string, 0)
+		ttl := 0
+		for _, qtype := range curpb.RecordTypes() {
+			res, err := resolveHost(ctx, host, qtype)
+			if err != nil && sourceNote(curpb, host) != "" && ctx.Err() == nil { // Lists have dead domains in them, one of them shouldn't fail the whole thing.
+				updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed to resolve domain " + host + sourceNote(curpb, host) + ": " + err.Error()}
+				s.unresolved(curpb, host)
+				continue nextHost
+			}
+			if err != nil {
+				updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to resolve domain " + host + "! " + err.Error()}
+				return ctx
+			}
+			if len(res.addrs) == 0 {
+				continue
+			}
+			answ = append(answ, res.addrs...)
+			for _, name := range res.chain {
+				if !slices.Contains(chain, name) {
+					chain = append(chain, name)
+				}
+			}
+			if ttl == 0 || res.ttl < ttl { // Refresh when the first of them runs out.
+				ttl = res.ttl
+			}
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_FETCHIP, StepMessage: "Resolved " + strings.Join(append([]string{host}, res.chain...), " -> ") + sourceNote(curpb, host) + "\tIN\t" + qtype + "\t" + strings.Join(res.addrs, ", ")}
+		}
+		if len(answ) != 0 {
 			dnsrecords[host] = answ
-			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_FETCHIP, StepMessage: "Resolved " + host + "\tIN\tA\t" + answ}
+			curpb.PlaybookTTLs[host] = ttl
+			curpb.PlaybookResolved[host] = time.Now().Unix()
+			curpb.PlaybookChains[host] = chain
+			if curpb.Pincnames { // So that clients asking for CDN name directly end up on routed addresses too.
+				for _, name := range chain {
+					if !curpb.IsHost(name) {
+						dnsrecords[name] = answ
+					}
+				}
+			}
 		} else {
-			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed getting INET Address of " + host + "!"}
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed getting INET Address of " + host + sourceNote(curpb, host) + "!"}
+			s.unresolved(curpb, host)
 			continue
 		}
 	}
+	if !only_hosts { // ASN db has no TTLs, ASNs are expanded anew on full updates only.
+		for _, as := range curpb.Asns {
+			if cancelled(updates, ctx) {
+				return ctx
+			}
+			host, nets, err := s.asnPrefixes(curpb, as)
+			if err != nil {
+				updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to expand " + as + ": " + err.Error()}
+				return ctx
+			}
+			if len(nets) == 0 {
+				updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "No prefixes of " + host + " in ASN db!"}
+				continue
+			}
+			dnsrecords[host] = nets
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_FETCHIP, StepMessage: fmt.Sprintf("Expanded %s -> %v prefixes", host, len(nets))}
+		}
+	}
 	if curpb.Custom != nil {
 		for h, ip := range curpb.Custom {
-			dnsrecords[h] = ip
+			dnsrecords[h] = []string{ip}
 		}
 	}
 	curpb.PlaybookAddrs = dnsrecords
-	ctx = context.WithValue(ctx, "playbook", curpb)
-	ctx = context.WithValue(ctx, "dnsrecords", dnsrecords)
+	ctx = executor.Set(ctx, "playbook", curpb)
+	ctx = executor.Set(ctx, "dnsrecords", dnsrecords)
+	// DNS and routes go at the same time, and DNS side is the one saving playbook. Routes get a copy of their own, so that nothing one does to it can race the other.
+	ctx = executor.Set(ctx, "routes_playbook", curpb.Clone())
 	return ctx
 }
+
+// Least time before a host that gave nothing gets asked about again, whatever TTL floor is.
+const unresolvedTTL = 60
+
+// Host that gave nothing still counts as resolved now, with the shortest TTL there is. Otherwise it stays expired for good,
+// and TTL refresh runs a job for it on every tick for as long as the domain is dead.
+func (s *AutoVPNServer) unresolved(curpb *playbook.Playbook, host string) {
+	floor, _ := s.updater.ttlBounds(curpb)
+	curpb.PlaybookTTLs[host] = max(floor, unresolvedTTL)
+	curpb.PlaybookResolved[host] = time.Now().Unix()
+}
+
+// Whether name is in CNAME chain of some other host of playbook.
+func inOtherChain(curpb *playbook.Playbook, host string, name string) bool {
+	for h, chain := range curpb.PlaybookChains {
+		if h != host && slices.Contains(chain, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sergds/autovpn2/internal/playbook"
+)
+
+// Dead domain shouldn't look expired right away again, or TTL refresh runs a job for it every tick.
+func TestUnresolvedHostWaits(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttlfloor int
+		want     int // Seconds till it's expired again.
+	}{
+		{name: "server default floor", want: 60},
+		{name: "floor below minimum", ttlfloor: 10, want: unresolvedTTL},
+		{name: "higher floor", ttlfloor: 600, want: 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := testServer(t)
+			pbook := &playbook.Playbook{Ttlrefresh: true, Ttlfloor: tt.ttlfloor, PlaybookTTLs: map[string]int{}, PlaybookResolved: map[string]int64{}}
+			srv.unresolved(pbook, "dead.com")
+			floor, ceiling := srv.updater.ttlBounds(pbook)
+			now := time.Now().Unix()
+			if expired := pbook.ExpiredHosts(now+1, floor, ceiling); len(expired) != 0 {
+				t.Errorf("expired right after failing: %v", expired)
+			}
+			if expired := pbook.ExpiredHosts(now+int64(tt.want)+1, floor, ceiling); !slices.Equal(expired, []string{"dead.com"}) {
+				t.Errorf("expired after %vs = %v, want [dead.com]", tt.want, expired)
+			}
+		})
+	}
+}
@@ -10,13 +10,15 @@ import (
 )
 
 // Set out playbook as installed and unlock.
-// Wants in context: "playbook"
+// Wants in context: "playbook", "only_hosts" (optional, partial refresh doesn't count as a fresh install)
 func (s *AutoVPNServer) StepFinalizePlaybook(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
 	curpb := ctx.Value("playbook").(*playbook.Playbook)
 	curpb.SetInstallState(true)
-	curpb.InstallTime = time.Now().Unix()
+	if _, partial := ctx.Value("only_hosts").([]string); !partial {
+		curpb.InstallTime = time.Now().Unix()
+	}
 	curpb.Unlock()
-	err := UpdatePlaybookDB(s.playbookDB, curpb)
+	err := s.UpdatePlaybookDB(curpb)
 	s.UpdateUpdaterTable()
 	if err != nil {
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed finalizing and updating playbook in db: " + err.Error()}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+	"github.com/sergds/autovpn2/internal/playbook"
+	"github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+// Apply steps only look at adapters playbook has now. If re-apply moved it to another adapter or endpoint, whatever previous revision put on the old one
+// would stay there forever, so these take it off. Credentials alone changing doesn't count: same router, apply's own diff cleans it up.
+
+// Whether playbook's routes moved from old's router to another one.
+func routesMoved(old *playbook.Playbook, cur *playbook.Playbook) bool {
+	if old == nil || old.Adapters.Routes == "" || strings.EqualFold(old.Adapters.Routes, "null") {
+		return false
+	}
+	return !strings.EqualFold(old.Adapters.Routes, cur.Adapters.Routes) || routes.Endpoint(old.Adapters.Routes, old.Adapterconfig.Routes) != routes.Endpoint(cur.Adapters.Routes, cur.Adapterconfig.Routes)
+}
+
+func dnsMoved(old *playbook.Playbook, cur *playbook.Playbook) bool {
+	if old == nil || old.Adapters.Dns == "" || strings.EqualFold(old.Adapters.Dns, "null") {
+		return false
+	}
+	return !strings.EqualFold(old.Adapters.Dns, cur.Adapters.Dns) || dnsadapters.Endpoint(old.Adapters.Dns, old.Adapterconfig.Dns) != dnsadapters.Endpoint(cur.Adapters.Dns, cur.Adapterconfig.Dns)
+}
+
+// Remove previous revision's routes from the router playbook moved away from. Removals are recorded, so a rollback puts them back.
+// Wants in context: "old_playbook", "transaction" (optional)
+func (s *AutoVPNServer) StepLeaveRoutes(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	oldpb := ctx.Value("old_playbook").(*playbook.Playbook)
+	tx, _ := ctx.Value("transaction").(*Transaction)
+
+	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Route adapter changed, removing routes from " + oldpb.Adapters.Routes + ":"}
+	var routead routes.RouteAdapter = routes.NewRouteAdapter(oldpb.Adapters.Routes)
+	if routead == nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to create route adapter " + oldpb.Adapters.Routes}
+		return ctx
+	}
+	routead.SetContext(ctx)
+	if err := s.authenticate(routead, oldpb.Adapterconfig.Routes); err != nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to authenticate on previous route adapter " + oldpb.Adapters.Routes + ": " + err.Error()}
+		return ctx
+	}
+	cur_routes, err := routead.GetRoutes()
+	if err != nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to get routes from previous route adapter " + oldpb.Adapters.Routes + ": " + err.Error()}
+		return ctx
+	}
+	for _, r := range DiffRoutes(oldpb.Name, nil, cur_routes).Remove { // Nothing is wanted there anymore.
+		if cancelled(updates, ctx) {
+			return ctx
+		}
+		if err := routead.DelRoute(r); err != nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to delete a route " + r.Target() + " from previous route adapter: " + err.Error()}
+			return ctx
+		}
+		tx.PreviousRouteRemoved(r)
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Removed " + r.Target() + "\t->\t" + r.Interface}
+	}
+	routead.SaveConfig()
+	return ctx
+}
+
+// Remove previous revision's records from the DNS server playbook moved away from.
+// Wants in context: "old_playbook", "transaction" (optional)
+func (s *AutoVPNServer) StepLeaveDNS(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	oldpb := ctx.Value("old_playbook").(*playbook.Playbook)
+	tx, _ := ctx.Value("transaction").(*Transaction)
+
+	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "DNS adapter changed, removing records from " + oldpb.Adapters.Dns + ":"}
+	var dnsad dnsadapters.DNSAdapter = dnsadapters.NewDNSAdapter(oldpb.Adapters.Dns)
+	if dnsad == nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to create dns adapter " + oldpb.Adapters.Dns}
+		return ctx
+	}
+	dnsad.SetContext(ctx)
+	if err := s.authenticate(dnsad, oldpb.Adapterconfig.Dns); err != nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to authenticate on previous dns adapter " + oldpb.Adapters.Dns + ": " + err.Error()}
+		return ctx
+	}
+	recs, err := getRecords(dnsad, oldpb.RecordTypes())
+	if err != nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed getting records from previous dns adapter: " + err.Error()}
+		return ctx
+	}
+	for _, record := range DiffRecords(nil, recs, OwnedDomains(oldpb)).Remove {
+		if cancelled(updates, ctx) {
+			return ctx
+		}
+		if err := dnsad.DelRecord(record); err != nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to remove " + record.String() + " from previous dns adapter: " + err.Error()}
+			return ctx
+		}
+		tx.PreviousRecordRemoved(record)
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Removed " + record.String()}
+	}
+	dnsad.CommitRecords()
+	return ctx
+}
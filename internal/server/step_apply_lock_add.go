@@ -8,19 +8,16 @@ import (
 	"github.com/sergds/autovpn2/internal/server/executor"
 )
 
-// Lock newly parsed playbook and add to db.
+// Mark newly parsed playbook as busy and add to db. Task already holds it's lock by now.
 // Wants in context: playbook
 func (s *AutoVPNServer) StepApplyLockAdd(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
 	curpb := ctx.Value("playbook").(*playbook.Playbook)
-	if !curpb.Lock("Apply") {
-		updates <- &executor.ExecutorUpdate{CurrentStep: pb.STEP_ERROR, StepMessage: "Unexpected lock on fresh playbook! (reason: " + curpb.GetLockReason() + ")"}
-		return ctx
-	}
-	err := UpdatePlaybookDB(s.playbookDB, curpb)
+	curpb.MarkBusy("Apply")
+	err := s.UpdatePlaybookDB(curpb)
 	if err != nil {
 		updates <- &executor.ExecutorUpdate{CurrentStep: pb.STEP_ERROR, StepMessage: "Failed adding playbook to db: " + err.Error()}
 		return ctx
 	}
-	ctx = context.WithValue(ctx, "playbook", curpb)
+	ctx = executor.Set(ctx, "playbook", curpb)
 	return ctx
 }
@@ -2,7 +2,6 @@ package server
 
 import (
 	"context"
-	"strings"
 
 	"github.com/sergds/autovpn2/internal/adapters/routes"
 	"github.com/sergds/autovpn2/internal/playbook"
@@ -10,11 +9,12 @@ import (
 	"github.com/sergds/autovpn2/internal/server/executor"
 )
 
-// Put these routes on our router.
-// Wants in context: playbook, dnsrecords
+// Put these routes on our router. Only the difference gets pushed, routes that are already right are left alone.
+// Wants in context: routes_playbook (playbook's copy, see StepFetchIPs), transaction (optional)
 func (s *AutoVPNServer) StepApplyRoutes(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
-	curpb := ctx.Value("playbook").(*playbook.Playbook)
-	dnsrecords := ctx.Value("dnsrecords").(map[string]string)
+	curpb := ctx.Value("routes_playbook").(*playbook.Playbook)
+	dnsrecords := curpb.PlaybookAddrs // Same as "dnsrecords", but copy's own.
+	tx, _ := ctx.Value("transaction").(*Transaction)
 
 	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Routes Summary:"}
 	var routead routes.RouteAdapter = routes.NewRouteAdapter(curpb.Adapters.Routes)
@@ -22,7 +22,8 @@ func (s *AutoVPNServer) StepApplyRoutes(updates chan *executor.ExecutorUpdate, c
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to create route adapter " + curpb.Adapters.Routes}
 		return ctx
 	}
-	err := routead.Authenticate(curpb.Adapterconfig.Routes)
+	routead.SetContext(ctx)
+	err := s.authenticate(routead, curpb.Adapterconfig.Routes)
 	if err == nil {
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Authenticated!"}
 	} else {
@@ -34,32 +35,51 @@ func (s *AutoVPNServer) StepApplyRoutes(updates chan *executor.ExecutorUpdate, c
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to get routes from " + curpb.Adapters.Routes + ": " + err.Error()}
 		return ctx
 	}
-	route_conflicts := make([]*routes.Route, 0)
-	for _, r := range cur_routes {
-		ip := strings.Split(r.Destination, "/")[0]
-		for _, newip := range dnsrecords {
-			if ip == newip && r.Interface == curpb.Interface {
-				route_conflicts = append(route_conflicts, r)
-			}
+	changes := DiffRoutes(curpb.Name, DesiredRoutes(curpb, dnsrecords), cur_routes)
+	for _, r := range changes.Unchanged {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Unchanged " + r.Target() + "\t->\t" + r.Interface}
+	}
+	for _, r := range changes.Remove {
+		if cancelled(updates, ctx) {
+			return ctx
 		}
+		err := routead.DelRoute(r)
+		if err != nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to delete a route " + r.Target() + ": " + err.Error()}
+			return ctx
+		}
+		tx.RouteRemoved(r)
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Removed " + r.Target() + "\t->\t" + r.Interface}
 	}
-	if len(route_conflicts) != 0 {
-		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "There are conflicts! The conflicting routes will be recreated!"}
-		for _, r := range route_conflicts {
-			err := routead.DelRoute(*r)
-			if err != nil {
-				updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to delete a route " + r.Destination + ": " + err.Error()}
-				return ctx
-			}
+	for _, c := range changes.Recreate {
+		if cancelled(updates, ctx) {
+			return ctx
+		}
+		err := routead.DelRoute(c.Existing)
+		if err != nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to delete a conflicting route " + c.Existing.Target() + ": " + err.Error()}
+			return ctx
 		}
+		tx.RouteRemoved(c.Existing)
+		err = routead.AddRoute(c.Wanted)
+		if err != nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to add a route " + c.Wanted.Target() + ": " + err.Error()}
+			return ctx
+		}
+		tx.RouteAdded(c.Wanted)
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Recreated " + c.Wanted.Target() + "\t->\t" + c.Wanted.Interface}
 	}
-	for h, ip := range dnsrecords {
-		err := routead.AddRoute(routes.Route{Destination: ip, Gateway: "0.0.0.0", Interface: curpb.Interface, Comment: "[AutoVPN2] Playbook: " + curpb.Name + " Host: " + h})
+	for _, r := range changes.Add {
+		if cancelled(updates, ctx) {
+			return ctx
+		}
+		err := routead.AddRoute(r)
 		if err != nil {
-			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to add a route " + ip + ": " + err.Error()}
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to add a route " + r.Target() + ": " + err.Error()}
 			return ctx
 		}
-		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Routed " + ip + "\t->\t" + curpb.Interface}
+		tx.RouteAdded(r)
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Routed " + r.Target() + "\t->\t" + r.Interface}
 	}
 	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ROUTES, StepMessage: "Saving changes"}
 	routead.SaveConfig()
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"context"
+
+	"github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+// Cancel running jobs. They notice on their own, stop and roll back, so we don't wait for them here.
+// Wants in context: "cancel_target" (playbook name or job id)
+func (s *AutoVPNServer) StepCancel(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	target := ctx.Value("cancel_target").(string)
+	ids := s.CancelJobs(target)
+	if len(ids) == 0 {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "No running jobs of " + target + "!"}
+		return ctx
+	}
+	for _, id := range ids {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Cancelled job " + id}
+	}
+	return ctx
+}
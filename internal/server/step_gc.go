@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+	"github.com/sergds/autovpn2/internal/playbook"
+	"github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+// Adapter instance garbage is looked for on. There's no list of those anywhere, so they're collected from playbooks that used them.
+type gcTarget struct {
+	adapter string
+	conf    map[string]string
+}
+
+// Unique route and DNS adapter endpoints of playbooks. Null ones have nothing to collect.
+func gcTargets(pbooks []*playbook.Playbook) (routeTargets map[string]gcTarget, dnsTargets map[string]gcTarget) {
+	routeTargets, dnsTargets = make(map[string]gcTarget), make(map[string]gcTarget)
+	for _, pbook := range pbooks {
+		if ep := routes.Endpoint(pbook.Adapters.Routes, pbook.Adapterconfig.Routes); ep != "" {
+			routeTargets[ep] = gcTarget{adapter: pbook.Adapters.Routes, conf: pbook.Adapterconfig.Routes}
+		}
+		if ep := dnsadapters.Endpoint(pbook.Adapters.Dns, pbook.Adapterconfig.Dns); ep != "" {
+			dnsTargets[ep] = gcTarget{adapter: pbook.Adapters.Dns, conf: pbook.Adapterconfig.Dns}
+		}
+	}
+	return routeTargets, dnsTargets
+}
+
+// Playbooks that are installed right now. Whatever they want is not garbage.
+func (s *AutoVPNServer) installedPlaybooks() map[string]*playbook.Playbook {
+	installed := make(map[string]*playbook.Playbook)
+	for name, pbook := range s.playbooks() {
+		if pbook.GetInstallState() {
+			installed[name] = pbook
+		}
+	}
+	return installed
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Find routes tagged as ours that no installed playbook wants (undo that failed halfway, db that got deleted, apply that never finished). Delete them if told to.
+// Hosts from their tags go into context, records of these are most likely garbage too.
+// Wants in context: "gc_playbooks" (where to look), "gc_delete" (optional)
+// Puts in context: "gc_hosts"
+func (s *AutoVPNServer) StepGCRoutes(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	pbooks := ctx.Value("gc_playbooks").([]*playbook.Playbook)
+	del, _ := ctx.Value("gc_delete").(bool)
+	installed := s.installedPlaybooks()
+	wanted := make(map[string]bool)
+	for _, pbook := range installed {
+		for _, r := range DesiredRoutes(pbook, pbook.PlaybookAddrs) {
+			wanted[r.Target()+"@"+r.Interface+"@"+pbook.Name] = true
+		}
+	}
+	hosts := make(map[string]bool)
+	routeTargets, _ := gcTargets(pbooks)
+	found := 0
+	for _, ep := range sortedKeys(routeTargets) {
+		target := routeTargets[ep]
+		routead := routes.NewRouteAdapter(target.adapter)
+		if routead == nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Unknown route adapter " + target.adapter}
+			return ctx
+		}
+		routead.SetContext(ctx)
+		if err := s.authenticate(routead, target.conf); err != nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to authenticate on " + ep + ": " + err.Error()}
+			return ctx
+		}
+		cur_routes, err := routead.GetRoutes()
+		if err != nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to get routes from " + ep + ": " + err.Error()}
+			return ctx
+		}
+		deleted := false
+		for _, r := range cur_routes {
+			tag, ok := strings.CutPrefix(r.Comment, routeTagPrefix)
+			if !ok {
+				continue // Not ours, not our business.
+			}
+			pbname, host, _ := strings.Cut(tag, " Host: ")
+			dest := r.Target()
+			if wanted[dest+"@"+r.Interface+"@"+pbname] {
+				continue
+			}
+			if wcpb, _, ok := strings.Cut(tag, wildcardTagSep); ok { // DNS proxy expires these by itself, unless their playbook is gone.
+				if installed[wcpb] != nil {
+					continue
+				}
+				host = ""
+			}
+			found++
+			if host != "" && !isRawHost(host) {
+				hosts[host] = true
+			}
+			desc := dest + "\t->\t" + r.Interface + "\t(" + r.Comment + ") on " + ep
+			if !del {
+				updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Orphan route " + desc}
+				continue
+			}
+			if cancelled(updates, ctx) {
+				return ctx
+			}
+			if err := routead.DelRoute(*r); err != nil {
+				updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to delete orphan route " + desc + ": " + err.Error()}
+				return ctx
+			}
+			deleted = true
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Deleted orphan route " + desc}
+		}
+		if deleted {
+			if err := routead.SaveConfig(); err != nil {
+				updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed saving config on " + ep + ": " + err.Error()}
+			}
+		}
+	}
+	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: fmt.Sprintf("%v orphan routes on %v route adapters", found, len(routeTargets))}
+	return executor.Set(ctx, "gc_hosts", hosts)
+}
+
+// Find DNS records no installed playbook owns, and delete them if told to. Records have no tags, so only domains that were ours once are looked at:
+// hosts of orphan routes, of playbooks that never finished installing, and of playbook client gave us.
+// Wants in context: "gc_playbooks", "gc_hosts", "gc_delete" (optional)
+func (s *AutoVPNServer) StepGCDNS(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	pbooks := ctx.Value("gc_playbooks").([]*playbook.Playbook)
+	hosts := ctx.Value("gc_hosts").(map[string]bool)
+	del, _ := ctx.Value("gc_delete").(bool)
+	installed := s.installedPlaybooks()
+	for _, pbook := range pbooks {
+		if installed[pbook.Name] == nil {
+			for h := range OwnedDomains(pbook) {
+				hosts[h] = true
+			}
+		}
+	}
+	keep := make([]*playbook.Playbook, 0, len(installed))
+	for _, pbook := range installed {
+		keep = append(keep, pbook)
+	}
+	owned := OwnedDomains(keep...)
+	_, dnsTargets := gcTargets(pbooks)
+	found := 0
+	for _, ep := range sortedKeys(dnsTargets) {
+		target := dnsTargets[ep]
+		dnsad := dnsadapters.NewDNSAdapter(target.adapter)
+		if dnsad == nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Unknown dns adapter " + target.adapter}
+			return ctx
+		}
+		dnsad.SetContext(ctx)
+		if err := s.authenticate(dnsad, target.conf); err != nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to authenticate on " + ep + ": " + err.Error()}
+			return ctx
+		}
+		recs, err := getRecords(dnsad, []string{"A", "AAAA"})
+		if err != nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed getting records from " + ep + ": " + err.Error()}
+			return ctx
+		}
+		deleted := false
+		for _, record := range recs {
+			if !hosts[record.Domain] || owned[record.Domain] {
+				continue
+			}
+			found++
+			desc := record.String() + " on " + ep
+			if !del {
+				updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Orphan record " + desc}
+				continue
+			}
+			if cancelled(updates, ctx) {
+				return ctx
+			}
+			if err := dnsad.DelRecord(record); err != nil {
+				updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to delete orphan record " + desc + ": " + err.Error()}
+				return ctx
+			}
+			deleted = true
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Deleted orphan record " + desc}
+		}
+		if deleted {
+			dnsad.CommitRecords()
+		}
+	}
+	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: fmt.Sprintf("%v orphan DNS records on %v DNS adapters", found, len(dnsTargets))}
+	if !del {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Dry run, nothing was deleted."}
+	}
+	return ctx
+}
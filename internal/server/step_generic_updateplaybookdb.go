@@ -12,7 +12,7 @@ import (
 // Wants in context: playbook
 func (s *AutoVPNServer) StepUpdatePlaybook(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
 	curpb := ctx.Value("playbook").(*playbook.Playbook)
-	err := UpdatePlaybookDB(s.playbookDB, curpb)
+	err := s.UpdatePlaybookDB(curpb)
 	s.UpdateUpdaterTable()
 	if err != nil {
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed updating playbook in db: " + err.Error()}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+// List latest jobs, newest first.
+// Wants in context: "jobs_limit" (0 means all of them)
+func (s *AutoVPNServer) StepJobs(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	records := s.ListJobs(ctx.Value("jobs_limit").(int))
+	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_JOBS, StepMessage: "Jobs (" + strconv.Itoa(len(records)) + ")"}
+	if len(records) == 0 {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "No jobs yet"}
+	}
+	for _, rec := range records {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: describeJob(rec)}
+	}
+	return ctx
+}
+
+// Replay job's output as if it was running right here, and follow it if it still does.
+// Wants in context: "job_id"
+func (s *AutoVPNServer) StepAttach(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	id := ctx.Value("job_id").(string)
+	rec, err := s.FollowJob(ctx, id, func(upd JobUpdate) {
+		if upd.Step == rpc.STEP_ERROR { // That's job's error, not ours. As is, it'd fail attach.
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Error: " + upd.Message}
+			return
+		}
+		updates <- &executor.ExecutorUpdate{CurrentStep: upd.Step, StepMessage: upd.Message}
+	})
+	if err != nil {
+		if rec == nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: err.Error()}
+		}
+		return ctx // Otherwise we just got detached.
+	}
+	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: describeJob(rec)}
+	return ctx
+}
+
+// One line about a job, like "dm7o1lpj4vdo apply of netflix: done (started 2024-08-01 12:00:00, took 5s)"
+func describeJob(rec *JobRecord) string {
+	line := rec.ID + " " + rec.Task
+	if rec.Playbook != "" {
+		line += " of " + rec.Playbook
+	}
+	line += ": " + rec.GetStatus() + " (started " + time.Unix(rec.Started, 0).Format(time.DateTime)
+	if rec.Finished != 0 {
+		line += ", took " + (time.Duration(rec.Finished-rec.Started) * time.Second).String()
+	}
+	return line + ")"
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+func TestAttach(t *testing.T) {
+	srv := testServer(t)
+	tb := NewTaskBuilder(srv)
+	if err := tb.Undo("nope"); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.RunTask(context.Background(), tb, func(upd *executor.ExecutorUpdate) {}); err == nil {
+		t.Fatal("undo of a playbook that isn't there went fine")
+	}
+	failed := srv.ListJobs(1)[0].ID
+	tests := []struct {
+		name     string
+		id       string
+		wantErr  bool
+		wantLine string // Summary line attach has to show.
+	}{
+		{name: "failed job", id: failed, wantLine: "Error: No such playbook nope installed!"},
+		{name: "no such job", id: "nope", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tb := NewTaskBuilder(srv)
+			if err := tb.Attach([]string{tt.id}); err != nil {
+				t.Fatal(err)
+			}
+			summary := make([]string, 0)
+			err := srv.RunTask(context.Background(), tb, func(upd *executor.ExecutorUpdate) {
+				if upd.CurrentStep == rpc.STEP_PUSH_SUMMARY {
+					summary = append(summary, upd.StepMessage)
+				}
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %v", err, tt.wantErr)
+			}
+			if tt.wantLine != "" && !strings.Contains(strings.Join(summary, "\n"), tt.wantLine) {
+				t.Errorf("summary doesn't have %q:\n%v", tt.wantLine, strings.Join(summary, "\n"))
+			}
+		})
+	}
+}
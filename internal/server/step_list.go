@@ -3,19 +3,33 @@ package server
 import (
 	"context"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/sergds/autovpn2/internal/rpc"
 	"github.com/sergds/autovpn2/internal/server/executor"
 )
 
-// List our playbooks to the user
+// List our playbooks to the user, with what drift reconciler knows about them.
 func (s *AutoVPNServer) StepList(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
-	pbooks := GetAllPlaybooksFromDB(s.playbookDB)
+	pbooks := s.playbooks()
 	var pbnames []string = make([]string, 0)
 	for pbname, _ := range pbooks {
 		pbnames = append(pbnames, pbname)
 	}
+	sort.Strings(pbnames)
 	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_LIST, StepMessage: "Playbooks (" + fmt.Sprintf("%v", len(pbooks)) + "): " + strings.Join(pbnames, ", ")}
+	for _, pbname := range pbnames {
+		desc := "not checked for drift yet"
+		if !pbooks[pbname].GetInstallState() {
+			desc = "not installed"
+		} else if status := s.reconciler.Status(pbname); status != nil {
+			desc = status.String()
+		}
+		if s.dnsproxy != nil && len(pbooks[pbname].Wildcards) != 0 {
+			desc += fmt.Sprintf(", %v wildcard routes", s.dnsproxy.Count(pbname))
+		}
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: pbname + ": " + desc}
+	}
 	return ctx
 }
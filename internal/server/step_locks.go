@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+// Show who holds which lock and why, along with jobs journal still remembers. Or force-clear a lock.
+// Wants in context: "clear_lock" (optional, lock name like "routes/keeneticrci@http://10.0.2.1", or playbook to unlock)
+func (s *AutoVPNServer) StepLocks(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	if name, ok := ctx.Value("clear_lock").(string); ok {
+		s.clearLock(updates, name)
+		return ctx
+	}
+	locks := s.locks.List()
+	held := make(map[string]bool)
+	for _, l := range locks {
+		held[l.Name] = true
+		msg := "Locked: " + l.Name + " by job " + l.Owner + " (" + l.Reason + ") since " + l.Acquired.Format(time.DateTime)
+		if time.Now().After(l.Expires) {
+			msg += ", lease expired " + l.Expires.Format(time.DateTime)
+		} else {
+			msg += ", lease until " + l.Expires.Format(time.DateTime)
+		}
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: msg}
+	}
+	if len(locks) == 0 {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "No locks held"}
+	}
+	// Busy flag is only a marker now, but one without a lock behind it means some job left it behind.
+	for name, pbook := range s.playbooks() {
+		if pbook.Busy && !held[PlaybookLock(name)] {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Stale busy mark: " + name + " (reason: " + pbook.GetLockReason() + ")"}
+		}
+	}
+	for _, entry := range s.GetJournalDB() {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Running job " + entry.ID + ": " + entry.Task + " of " + entry.Playbook + " since " + time.Unix(entry.Started, 0).Format(time.DateTime) + ", at step " + entry.LastStep}
+	}
+	return ctx
+}
+
+// Drops a lock by name. Plain playbook name drops it's playbook lock and busy mark, and makes journal forget about it's jobs.
+func (s *AutoVPNServer) clearLock(updates chan *executor.ExecutorUpdate, name string) {
+	lockname, pbname := name, ""
+	if !strings.Contains(name, "/") {
+		lockname, pbname = PlaybookLock(name), name
+	} else if after, ok := strings.CutPrefix(name, "playbook/"); ok {
+		pbname = after
+	}
+	released, washeld := s.locks.ForceRelease(lockname)
+	marked := false
+	if pbname != "" {
+		marked = s.forceUnlock(pbname)
+		// Whatever journal says about it is a lie now.
+		for _, entry := range s.GetJournalDB() {
+			if entry.Playbook == pbname {
+				DeleteJournalDB(s.playbookDB, entry.ID)
+			}
+		}
+		s.UpdateUpdaterTable()
+	}
+	if !washeld && !marked {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "No such lock or playbook " + name + "!"}
+		return
+	}
+	if washeld {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Force-released " + lockname + " held by job " + released.Owner + " (" + released.Reason + ")"}
+		s.jobsMu.Lock()
+		_, running := s.jobs[released.Owner]
+		s.jobsMu.Unlock()
+		if running {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Job " + released.Owner + " is still running! Consider `autovpn cancel " + released.Owner + "` too."}
+		}
+	}
+	if marked {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Cleared busy mark of " + pbname}
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+	"github.com/sergds/autovpn2/internal/playbook"
+	"github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+// Tell what StepApplyDNS would do, without doing it.
+// Wants in context: "playbook", "dnsrecords", "old_playbook" (optional)
+func (s *AutoVPNServer) StepPlanDNS(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	curpb := ctx.Value("playbook").(*playbook.Playbook)
+	dnsrecords := ctx.Value("dnsrecords").(map[string][]string)
+	old_pbook, _ := ctx.Value("old_playbook").(*playbook.Playbook)
+
+	var dnsad dnsadapters.DNSAdapter = dnsadapters.NewDNSAdapter(curpb.Adapters.Dns)
+	if dnsad == nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to create dns adapter " + curpb.Adapters.Dns}
+		return ctx
+	}
+	dnsad.SetContext(ctx)
+	if err := s.authenticate(dnsad, curpb.Adapterconfig.Dns); err != nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to authenticate on " + curpb.Adapters.Dns + ": " + err.Error()}
+		return ctx
+	}
+	recs, err := getRecords(dnsad, curpb.RecordTypes())
+	if err != nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed getting current records: " + err.Error()}
+		return ctx
+	}
+	changes := DiffRecords(DesiredRecords(curpb, dnsrecords), recs, OwnedDomains(curpb, old_pbook))
+	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: fmt.Sprintf("DNS plan (%v to add, %v to remove, %v unchanged):", len(changes.Add), len(changes.Remove), len(changes.Unchanged))}
+	for _, record := range changes.Remove {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "- " + record.String()}
+	}
+	for _, record := range changes.Add {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "+ " + record.String()}
+	}
+	return ctx
+}
+
+// Tell what StepApplyRoutes would do, without doing it.
+// Wants in context: "playbook", "dnsrecords"
+func (s *AutoVPNServer) StepPlanRoutes(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	curpb := ctx.Value("playbook").(*playbook.Playbook)
+	dnsrecords := ctx.Value("dnsrecords").(map[string][]string)
+
+	var routead routes.RouteAdapter = routes.NewRouteAdapter(curpb.Adapters.Routes)
+	if routead == nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to create route adapter " + curpb.Adapters.Routes}
+		return ctx
+	}
+	routead.SetContext(ctx)
+	if err := s.authenticate(routead, curpb.Adapterconfig.Routes); err != nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to authenticate on " + curpb.Adapters.Routes + ": " + err.Error()}
+		return ctx
+	}
+	cur_routes, err := routead.GetRoutes()
+	if err != nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to get routes from " + curpb.Adapters.Routes + ": " + err.Error()}
+		return ctx
+	}
+	changes := DiffRoutes(curpb.Name, DesiredRoutes(curpb, dnsrecords), cur_routes)
+	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: fmt.Sprintf("Routes plan (%v to add, %v to remove, %v to recreate, %v unchanged):", len(changes.Add), len(changes.Remove), len(changes.Recreate), len(changes.Unchanged))}
+	for _, r := range changes.Remove {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "- " + r.Target() + "\t->\t" + r.Interface + "\t(" + r.Comment + ")"}
+	}
+	for _, c := range changes.Recreate {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "~ " + c.Wanted.Target() + "\t->\t" + c.Wanted.Interface + "\t(conflict, existing comment: \"" + c.Existing.Comment + "\")"}
+	}
+	for _, r := range changes.Add {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "+ " + r.Target() + "\t->\t" + r.Interface + "\t(" + r.Comment + ")"}
+	}
+	return ctx
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+	"github.com/sergds/autovpn2/internal/playbook"
+	"github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/server/executor"
+)
+
+// Rollback steps reverse whatever failed job managed to change. They never raise STEP_ERROR themselves:
+// a half done rollback is still better than none, so every step gets it's chance and failures end up in summary.
+
+// Reverse route changes of a failed job, newest first. Each on the router it was made on, that's previous revision's one for routes apply took off of it.
+// Wants in context: "transaction"
+func (s *AutoVPNServer) StepRollbackRoutes(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	tx := ctx.Value("transaction").(*Transaction)
+	changes, _ := tx.reversed()
+	if tx.Playbook == nil || len(changes) == 0 {
+		return ctx
+	}
+	own, previous := make([]RouteChange, 0), make([]RouteChange, 0)
+	for _, c := range changes {
+		if c.Previous {
+			previous = append(previous, c)
+		} else {
+			own = append(own, c)
+		}
+	}
+	s.rollbackRoutes(updates, ctx, tx.Playbook, own)
+	if tx.Previous != nil {
+		s.rollbackRoutes(updates, ctx, tx.Previous, previous)
+	}
+	return ctx
+}
+
+func (s *AutoVPNServer) rollbackRoutes(updates chan *executor.ExecutorUpdate, ctx context.Context, pbook *playbook.Playbook, changes []RouteChange) {
+	if len(changes) == 0 {
+		return
+	}
+	var routead routes.RouteAdapter = routes.NewRouteAdapter(pbook.Adapters.Routes)
+	if routead == nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Can't roll back routes, unknown route adapter " + pbook.Adapters.Routes}
+		return
+	}
+	routead.SetContext(ctx)
+	if err := s.authenticate(routead, pbook.Adapterconfig.Routes); err != nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Can't roll back routes, failed to authenticate on " + pbook.Adapters.Routes + ": " + err.Error()}
+		return
+	}
+	failed := 0
+	for _, c := range changes {
+		var err error
+		if c.Added {
+			err = routead.DelRoute(c.Route)
+		} else {
+			err = routead.AddRoute(c.Route)
+		}
+		if err != nil {
+			failed++
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed to roll back route " + c.Route.Target() + ": " + err.Error()}
+		}
+	}
+	routead.SaveConfig()
+	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: fmt.Sprintf("Rolled back %v of %v route change(s) on %v", len(changes)-failed, len(changes), pbook.Adapters.Routes)}
+}
+
+// Reverse DNS changes of a failed job, newest first. Same as routes, each on the server it was made on.
+// Wants in context: "transaction"
+func (s *AutoVPNServer) StepRollbackDNS(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	tx := ctx.Value("transaction").(*Transaction)
+	_, changes := tx.reversed()
+	if tx.Playbook == nil || len(changes) == 0 {
+		return ctx
+	}
+	own, previous := make([]RecordChange, 0), make([]RecordChange, 0)
+	for _, c := range changes {
+		if c.Previous {
+			previous = append(previous, c)
+		} else {
+			own = append(own, c)
+		}
+	}
+	s.rollbackDNS(updates, ctx, tx.Playbook, own)
+	if tx.Previous != nil {
+		s.rollbackDNS(updates, ctx, tx.Previous, previous)
+	}
+	return ctx
+}
+
+func (s *AutoVPNServer) rollbackDNS(updates chan *executor.ExecutorUpdate, ctx context.Context, pbook *playbook.Playbook, changes []RecordChange) {
+	if len(changes) == 0 {
+		return
+	}
+	var dnsad dnsadapters.DNSAdapter = dnsadapters.NewDNSAdapter(pbook.Adapters.Dns)
+	if dnsad == nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Can't roll back DNS, unknown dns adapter " + pbook.Adapters.Dns}
+		return
+	}
+	dnsad.SetContext(ctx)
+	if err := s.authenticate(dnsad, pbook.Adapterconfig.Dns); err != nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Can't roll back DNS, failed to authenticate on " + pbook.Adapters.Dns + ": " + err.Error()}
+		return
+	}
+	failed := 0
+	for _, c := range changes {
+		var err error
+		if c.Added {
+			err = dnsad.DelRecord(c.Record)
+		} else {
+			err = dnsad.AddRecord(c.Record)
+		}
+		if err != nil {
+			failed++
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed to roll back record " + c.Record.Domain + ": " + err.Error()}
+		}
+	}
+	dnsad.CommitRecords()
+	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: fmt.Sprintf("Rolled back %v of %v DNS record change(s) on %v", len(changes)-failed, len(changes), pbook.Adapters.Dns)}
+}
+
+// Put previous revision of playbook back into db, or drop the unfinished one if there was nothing before.
+// Wants in context: "transaction"
+func (s *AutoVPNServer) StepRollbackPlaybook(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	tx := ctx.Value("transaction").(*Transaction)
+	if tx.Playbook == nil { // Job failed before it got to touch the playbook (like when it's locked by someone else). Nothing of ours to restore.
+		return ctx
+	}
+	if tx.Previous != nil {
+		if err := s.UpdatePlaybookDB(tx.Previous); err != nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed restoring previous revision of playbook: " + err.Error()}
+		} else {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Restored previous revision of playbook " + tx.Previous.Name}
+		}
+	} else {
+		if err := s.DeletePlaybookDB(tx.Playbook); err != nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed removing unfinished playbook from db: " + err.Error()}
+		} else {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Removed unfinished playbook " + tx.Playbook.Name + " from db"}
+		}
+	}
+	s.UpdateUpdaterTable()
+	return ctx
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/sergds/autovpn2/internal/rpc"
+	"github.com/sergds/autovpn2/internal/server/executor"
+	"gopkg.in/yaml.v3"
+)
+
+// Show playbook the way server ended up with it, so there's no guessing what vars, extends and profile turned it into.
+// Wants in context: "show_playbook"
+func (s *AutoVPNServer) StepShow(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+	pbname := ctx.Value("show_playbook").(string)
+	pbook, ok := s.playbooks()[pbname]
+	if !ok {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "No such playbook " + pbname}
+		return ctx
+	}
+	out := &strings.Builder{}
+	enc := yaml.NewEncoder(out)
+	enc.SetIndent(2) // Same as local show, and most people's playbooks.
+	if err := enc.Encode(pbook.Redacted().Spec()); err != nil {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: err.Error()}
+		return ctx
+	}
+	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_SHOW, StepMessage: pbname}
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: line}
+	}
+	return ctx
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"context"
+	"strconv"
+	"strings"
 
 	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
 	"github.com/sergds/autovpn2/internal/playbook"
@@ -19,7 +21,8 @@ func (s *AutoVPNServer) StepUndoDNS(updates chan *executor.ExecutorUpdate, ctx c
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to create dns adapter " + curpb.Adapters.Dns}
 		return ctx
 	}
-	err := dnsad.Authenticate(curpb.Adapterconfig.Dns)
+	dnsad.SetContext(ctx)
+	err := s.authenticate(dnsad, curpb.Adapterconfig.Dns)
 	if err == nil {
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Authenticated!"}
 	} else {
@@ -27,25 +30,33 @@ func (s *AutoVPNServer) StepUndoDNS(updates chan *executor.ExecutorUpdate, ctx c
 		return ctx
 	}
 	var records []dnsadapters.DNSRecord = make([]dnsadapters.DNSRecord, 0)
-	recs, err := dnsad.GetRecords("A")
+	recs, err := getRecords(dnsad, curpb.RecordTypes())
 	if err != nil {
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed getting current records: " + err.Error()}
 		return ctx
 	}
+	owned := OwnedDomains(curpb) // Hosts, and whatever else got pinned for them (custom records, names of CNAME chains).
 	for _, rec := range recs {
-		for _, domain := range curpb.Hosts {
-			if rec.Domain == domain {
-				records = append(records, rec) // delete records that intersect with the applied ones.
-			}
+		if owned[rec.Domain] {
+			records = append(records, rec) // delete records that intersect with the applied ones.
 		}
 	}
+	failed := make([]string, 0) // Same as with routes, playbook stays until every record is gone.
 	for _, record := range records {
+		if cancelled(updates, ctx) {
+			return ctx
+		}
 		err := dnsad.DelRecord(record)
 		if err != nil {
 			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed to delete " + record.Domain + ": " + err.Error()}
+			failed = append(failed, record.String())
+			continue
 		}
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Deleted " + record.Domain}
 	}
 	dnsad.CommitRecords()
+	if len(failed) != 0 {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to delete " + strconv.Itoa(len(failed)) + " of " + strconv.Itoa(len(records)) + " records: " + strings.Join(failed, ", ")}
+	}
 	return ctx
 }
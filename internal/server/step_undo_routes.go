@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"strconv"
 	"strings"
 
 	"github.com/sergds/autovpn2/internal/adapters/routes"
@@ -12,7 +13,7 @@ import (
 
 // Remove these routes records from our router.
 // Wants in context: "playbook"
-func (*AutoVPNServer) StepUndoRoutes(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+func (s *AutoVPNServer) StepUndoRoutes(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
 	curpb := ctx.Value("playbook").(*playbook.Playbook)
 
 	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.UNDO_STEP_ROUTES, StepMessage: "Authenticating with " + curpb.Adapters.Routes + " route adapter..."}
@@ -21,7 +22,8 @@ func (*AutoVPNServer) StepUndoRoutes(updates chan *executor.ExecutorUpdate, ctx
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to create route adapter " + curpb.Adapters.Routes}
 		return ctx
 	}
-	err := routead.Authenticate(curpb.Adapterconfig.Routes)
+	routead.SetContext(ctx)
+	err := s.authenticate(routead, curpb.Adapterconfig.Routes)
 	if err == nil {
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Authenticated!"}
 	} else {
@@ -30,30 +32,47 @@ func (*AutoVPNServer) StepUndoRoutes(updates chan *executor.ExecutorUpdate, ctx
 	}
 
 	updates <- &executor.ExecutorUpdate{CurrentStep: rpc.UNDO_STEP_ROUTES, StepMessage: "Trying to get addresses from route addresses"}
-	var addrs []string = make([]string, 0)
+	var unroute []routes.Route = make([]routes.Route, 0)
 	cur_routes, err := routead.GetRoutes()
 	if err != nil || len(cur_routes) == 0 {
-		for _, ip := range curpb.PlaybookAddrs {
-			addrs = append(addrs, ip)
+		for _, ips := range curpb.PlaybookAddrs {
+			for _, ip := range ips {
+				unroute = append(unroute, addrRoute(ip, curpb.Interface, ""))
+			}
 		}
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Falling back to address cold storage!"}
 	} else {
 		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Retrieved needed addresses from router adapter!"}
-		for _, r := range cur_routes {
-			if strings.Contains(r.Comment, "AutoVPN2") {
-				if strings.Contains(r.Comment, curpb.Name) {
-					addrs = append(addrs, r.Destination)
-				}
-			}
-		}
+		unroute = playbookRoutes(curpb.Name, cur_routes)
 	}
-	for _, ip := range addrs {
-		err := routead.DelRoute(routes.Route{Destination: ip, Gateway: "0.0.0.0", Interface: curpb.Interface})
+	failed := make([]string, 0) // Undo isn't done until every one is gone, step fails (and gets retried) with whatever's left.
+	for _, r := range unroute {
+		if cancelled(updates, ctx) {
+			return ctx
+		}
+		err := routead.DelRoute(r)
 		if err != nil {
-			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed to unroute: " + ip}
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Failed to unroute " + r.Target() + ": " + err.Error()}
+			failed = append(failed, r.Target())
+			continue
 		}
-		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Unrouted " + ip}
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_PUSH_SUMMARY, StepMessage: "Unrouted " + r.Target()}
 	}
 	routead.SaveConfig()
+	if len(failed) != 0 {
+		updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed to unroute " + strconv.Itoa(len(failed)) + " of " + strconv.Itoa(len(unroute)) + " routes: " + strings.Join(failed, ", ")}
+	}
 	return ctx
 }
+
+// Routes of playbook's hosts and wildcards router has, whatever interface they're on. Tags are matched exactly, same as diffs do:
+// undoing "net" has no business with "netflix" routes.
+func playbookRoutes(pbname string, current []*routes.Route) []routes.Route {
+	owned := make([]routes.Route, 0)
+	for _, r := range current {
+		if strings.HasPrefix(r.Comment, RouteTag(pbname)) || strings.HasPrefix(r.Comment, WildcardTag(pbname)) {
+			owned = append(owned, routes.Route{Destination: r.Destination, Prefix: r.Prefix, Gateway: "0.0.0.0", Interface: r.Interface})
+		}
+	}
+	return owned
+}
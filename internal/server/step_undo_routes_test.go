@@ -0,0 +1,48 @@
+package server
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+)
+
+func TestPlaybookRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		current []routes.Route
+		want    []string
+	}{
+		{
+			name:    "hosts and wildcards",
+			current: []routes.Route{addrRoute("1.1.1.1", "Wireguard1", RouteTag("net")+"a.com"), addrRoute("2.2.2.2", "Wireguard1", WildcardTag("net")+"*.b.com"), addrRoute("10.0.0.0/8", "Wireguard1", RouteTag("net")+"10.0.0.0/8")},
+			want:    []string{"1.1.1.1@Wireguard1", "10.0.0.0/8@Wireguard1", "2.2.2.2@Wireguard1"},
+		},
+		{
+			name:    "playbooks with longer names",
+			current: []routes.Route{addrRoute("1.1.1.1", "Wireguard1", RouteTag("netflix")+"a.com"), addrRoute("2.2.2.2", "Wireguard1", WildcardTag("netflix")+"*.b.com"), addrRoute("3.3.3.3", "Wireguard1", RouteTag("my-net")+"c.com")},
+			want:    []string{},
+		},
+		{
+			name:    "untagged",
+			current: []routes.Route{addrRoute("1.1.1.1", "Wireguard1", "net"), addrRoute("2.2.2.2", "Wireguard1", "[AutoVPN2] net")},
+			want:    []string{},
+		},
+		{
+			name:    "interface changed since apply",
+			current: []routes.Route{addrRoute("1.1.1.1", "OpenVPN0", RouteTag("net")+"a.com")},
+			want:    []string{"1.1.1.1@OpenVPN0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := make([]*routes.Route, 0)
+			for i := range tt.current {
+				current = append(current, &tt.current[i])
+			}
+			if got := targets(playbookRoutes("net", current)); !slices.Equal(got, tt.want) {
+				t.Errorf("playbookRoutes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
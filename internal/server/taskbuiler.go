@@ -2,6 +2,9 @@ package server
 
 import (
 	"context"
+	"errors"
+	"slices"
+	"time"
 
 	"github.com/sergds/autovpn2/internal/playbook"
 	"github.com/sergds/autovpn2/internal/rpc"
@@ -12,56 +15,229 @@ import (
 type TaskBuilder struct {
 	serv *AutoVPNServer
 	exec *executor.Executor
+	tx   *Transaction // Set for tasks that change adapters, so they can be rolled back if they fail.
+	// Tasks that change things are journaled while they run, so they can be recovered after a crash.
+	journaled bool
+	task      string
+	pbname    string
+	jobid     string   // Known before task even starts, so detached jobs can tell it right away.
+	quiet     bool     // Not run as a job. For tasks that only look at other jobs, they aren't worth remembering.
+	locks     []string // Taken from server's lock manager before task runs, see lockmgr.go.
 }
 
+// For steps that talk to adapters or resolvers, which tend to fail for a moment and then work again. All of them are safe to run twice.
+var adapterRetry = &executor.RetryPolicy{Attempts: 4, Backoff: 2 * time.Second, MaxBackoff: 30 * time.Second, Timeout: 2 * time.Minute, Deadline: 5 * time.Minute}
+
 func NewTaskBuilder(srv *AutoVPNServer) *TaskBuilder {
-	return &TaskBuilder{exec: executor.NewExecutor(), serv: srv}
+	return &TaskBuilder{exec: executor.NewExecutor(), serv: srv, jobid: newJobID()}
+}
+
+// Builds task by it's name and client's arguments.
+func (tb *TaskBuilder) Task(operation string, argv []string) error {
+	switch operation {
+	case rpc.TASK_LIST:
+		return tb.List()
+	case rpc.TASK_LOCKS:
+		return tb.Locks(argv)
+	case rpc.TASK_CANCEL:
+		return tb.Cancel(argv)
+	case rpc.TASK_JOBS:
+		return tb.Jobs(argv)
+	case rpc.TASK_ATTACH:
+		return tb.Attach(argv)
+	case rpc.TASK_UNLOCK:
+		if len(argv) != 1 {
+			return errors.New("expected lock or playbook name")
+		}
+		if err := tb.Locks([]string{"clear", argv[0]}); err != nil {
+			return err
+		}
+		tb.task = rpc.TASK_UNLOCK
+		return nil
+	}
+	if len(argv) == 0 {
+		return errors.New("Missing argument for " + operation + "!")
+	}
+	switch operation {
+	case rpc.TASK_APPLY:
+		return tb.Apply(argv[0])
+	case rpc.TASK_PLAN:
+		return tb.Plan(argv[0])
+	case rpc.TASK_UNDO:
+		return tb.Undo(argv[0])
+	case rpc.TASK_GC:
+		return tb.GC(argv)
+	case rpc.TASK_SHOW:
+		return tb.Show(argv[0])
+	}
+	return errors.New("Failed to build executor: task doesn't exist")
 }
 
 func (tb *TaskBuilder) List() error {
+	tb.task = rpc.TASK_LIST
 	tb.exec.AddStep(executor.NewStep(rpc.STEP_LIST, tb.serv.StepList))
 	return nil
 }
 
+// Admin stuff: list locks and interrupted jobs, or force-clear a lock with "clear <name>".
+func (tb *TaskBuilder) Locks(argv []string) error {
+	if len(argv) != 0 {
+		if len(argv) != 2 || argv[0] != "clear" {
+			return errors.New("expected no arguments or \"clear <lock|playbook>\"")
+		}
+		tb.exec.SetContext(context.WithValue(context.Background(), "clear_lock", argv[1]))
+	}
+	tb.task = rpc.TASK_LOCKS
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_LOCKS, tb.serv.StepLocks))
+	return nil
+}
+
+// Lists latest jobs, "all" as argument lists every one server remembers.
+func (tb *TaskBuilder) Jobs(argv []string) error {
+	limit := 20
+	if len(argv) == 1 && argv[0] == "all" {
+		limit = 0
+	} else if len(argv) != 0 {
+		return errors.New("expected no arguments or \"all\"")
+	}
+	tb.task, tb.quiet = rpc.TASK_JOBS, true
+	tb.exec.SetContext(context.WithValue(context.Background(), "jobs_limit", limit))
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_JOBS, tb.serv.StepJobs))
+	return nil
+}
+
+// Shows stored playbook. Nothing worth remembering as a job either.
+func (tb *TaskBuilder) Show(pbname string) error {
+	tb.task, tb.quiet = rpc.TASK_SHOW, true
+	tb.exec.SetContext(context.WithValue(context.Background(), "show_playbook", pbname))
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_SHOW, tb.serv.StepShow))
+	return nil
+}
+
+// Replays job's output, and follows it if it's still running.
+func (tb *TaskBuilder) Attach(argv []string) error {
+	if len(argv) != 1 {
+		return errors.New("expected job id")
+	}
+	tb.task, tb.quiet = rpc.TASK_ATTACH, true
+	tb.exec.SetContext(context.WithValue(context.Background(), "job_id", argv[0]))
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_ATTACH, tb.serv.StepAttach))
+	return nil
+}
+
+// Cancels running jobs of a playbook, or a single job by it's ID. Cancelled jobs roll back what they've done.
+func (tb *TaskBuilder) Cancel(argv []string) error {
+	if len(argv) != 1 {
+		return errors.New("expected playbook name or job id")
+	}
+	tb.task = rpc.TASK_CANCEL
+	tb.exec.SetContext(context.WithValue(context.Background(), "cancel_target", argv[0]))
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_CANCEL, tb.serv.StepCancel))
+	return nil
+}
+
 func (tb *TaskBuilder) Apply(playbk_yaml string) error {
-	// Build context for executor
-	var is_updated = false
 	currpc, err := playbook.Parse(playbk_yaml)
 	if err != nil {
 		return err
 	}
+	return tb.ApplyPlaybook(currpc)
+}
+
+// Same as Apply, but for an already parsed playbook.
+func (tb *TaskBuilder) ApplyPlaybook(currpc *playbook.Playbook) error {
+	// Build context for executor
+	if err := tb.serv.applyProfile(currpc); err != nil {
+		return err
+	}
+	if err := currpc.Validate(); err != nil {
+		return err
+	}
+	if err := tb.serv.checkAsns(currpc); err != nil {
+		return err
+	}
+	if err := tb.serv.checkWildcards(currpc); err != nil {
+		return err
+	}
+	if err := tb.serv.checkSecrets(currpc); err != nil {
+		return err
+	}
 	ctx := context.WithValue(context.Background(), "playbook", currpc)
-	rpcooks := GetAllPlaybooksFromDB(tb.serv.playbookDB)
-	for pname, rpcook := range rpcooks {
-		if currpc.Name == pname && rpcook.GetInstallState() {
-			is_updated = true
-			ctx = context.WithValue(ctx, "old_playbook", rpcook)
-		}
+	oldpb, ok := tb.serv.playbooks()[currpc.Name]
+	if ok {
+		// Apply steps diff against adapters, old revision is needed to know which of the DNS records are ours.
+		ctx = context.WithValue(ctx, "old_playbook", oldpb)
+		tb.tx = NewTransaction(currpc, oldpb.Clone())
+		tb.locks = PlaybookLocks(oldpb) // Old endpoints too, stuff gets removed from them if adapters changed (see StepLeaveRoutes).
+	} else {
+		tb.tx = NewTransaction(currpc, nil)
 	}
+	ctx = context.WithValue(ctx, "transaction", tb.tx)
+	tb.journaled, tb.task, tb.pbname = true, rpc.TASK_APPLY, currpc.Name
+	tb.lock(PlaybookLocks(currpc)...)
 	tb.exec.SetContext(ctx)
 	tb.exec.AddStep(executor.NewStep(rpc.STEP_LOCK_ADD, tb.serv.StepApplyLockAdd))
-	// Just to be sure. Apply steps ~should~ handle old addrs, but potentially can lead to stray routes or dns records in the long run when undoing time cometb.serv.
-	if is_updated {
-		tb.exec.AddStep(executor.NewStep("swap", tb.serv.StepSwapPlaybooks))
-		tb.exec.AddStep(executor.NewStep(rpc.UNDO_STEP_DNS, tb.serv.StepUndoDNS))
-		tb.exec.AddStep(executor.NewStep(rpc.UNDO_STEP_ROUTES, tb.serv.StepUndoRoutes))
-		tb.exec.AddStep(executor.NewStep("swap", tb.serv.StepSwapPlaybooks)) // At this point old_playbook is no longer needed and was overwritten, so no need to unlock and stuff.
-		// Continue with new one as usual.
-	}
-	tb.exec.AddStep(executor.NewStep(rpc.STEP_FETCHIP, tb.serv.StepFetchIPs))
-	tb.exec.AddStep(executor.NewStep(rpc.STEP_DNS, tb.serv.StepApplyDNS))
-	tb.exec.AddStep(executor.NewStep(rpc.STEP_DNS, tb.serv.StepUpdatePlaybook))
-	tb.exec.AddStep(executor.NewStep(rpc.STEP_ROUTES, tb.serv.StepApplyRoutes))
-	tb.exec.AddStep(executor.NewStep(rpc.STEP_ROUTES, tb.serv.StepFinalizePlaybook)) // "finalize" here - set status as installed and unlock
+	fetch := executor.NewStep(rpc.STEP_FETCHIP, tb.serv.StepFetchIPs).Retry(adapterRetry)
+	tb.exec.AddStep(fetch)
+	// If playbook moved to another router or DNS server, the old one is cleaned up first.
+	dnsAfter, routesAfter := fetch, fetch
+	if dnsMoved(oldpb, currpc) {
+		dnsAfter = executor.NewStep(rpc.UNDO_STEP_DNS, tb.serv.StepLeaveDNS).After(fetch).Retry(adapterRetry)
+		tb.exec.AddStep(dnsAfter)
+	}
+	if routesMoved(oldpb, currpc) {
+		routesAfter = executor.NewStep(rpc.UNDO_STEP_ROUTES, tb.serv.StepLeaveRoutes).After(fetch).Retry(adapterRetry)
+		tb.exec.AddStep(routesAfter)
+	}
+	// DNS and routes live on different adapters and only need the addresses, so they go at the same time.
+	// StepApplyDNS saves the playbook itself, StepFinalizePlaybook saves it once more after both.
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_DNS, tb.serv.StepApplyDNS).After(dnsAfter).Retry(adapterRetry))
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_ROUTES, tb.serv.StepApplyRoutes).After(routesAfter).Retry(adapterRetry))
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_ROUTES, tb.serv.StepFinalizePlaybook)) // "finalize" here - set status as installed and unlock. Waits for everything above.
+	return nil
+}
+
+// Dry run of Apply. Resolves and reads adapters, but doesn't change anything, not even the db.
+func (tb *TaskBuilder) Plan(playbk_yaml string) error {
+	currpc, err := playbook.Parse(playbk_yaml)
+	if err != nil {
+		return err
+	}
+	if err := tb.serv.applyProfile(currpc); err != nil {
+		return err
+	}
+	if err := currpc.Validate(); err != nil {
+		return err
+	}
+	if err := tb.serv.checkAsns(currpc); err != nil {
+		return err
+	}
+	if err := tb.serv.checkWildcards(currpc); err != nil {
+		return err
+	}
+	if err := tb.serv.checkSecrets(currpc); err != nil {
+		return err
+	}
+	ctx := context.WithValue(context.Background(), "playbook", currpc)
+	if oldpb, ok := tb.serv.playbooks()[currpc.Name]; ok {
+		ctx = context.WithValue(ctx, "old_playbook", oldpb)
+	}
+	tb.task, tb.pbname = rpc.TASK_PLAN, currpc.Name
+	tb.exec.SetContext(ctx)
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_FETCHIP, tb.serv.StepFetchIPs).Retry(adapterRetry))
+	tb.exec.AddStep(executor.NewStep(rpc.PLAN_STEP_DNS, tb.serv.StepPlanDNS).Retry(adapterRetry))
+	tb.exec.AddStep(executor.NewStep(rpc.PLAN_STEP_ROUTES, tb.serv.StepPlanRoutes).Retry(adapterRetry))
 	return nil
 }
 
 func (tb *TaskBuilder) Undo(pbook_name string) error {
-	tb.exec.AddStep(executor.NewStep("prep_ctx", func(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context { // TODO: Should I introduce new step const for these?
+	tb.journaled, tb.task, tb.pbname = true, rpc.TASK_UNDO, pbook_name
+	tb.lockInstalled(pbook_name)
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_PREP_CTX, func(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
 		var ok bool = false
 		var wasinstalled bool = false
 		var curpb *playbook.Playbook = nil
-		pbooks := GetAllPlaybooksFromDB(tb.serv.playbookDB)
+		pbooks := tb.serv.playbooks()
 
 		for _, pbook := range pbooks {
 			if pbook.Name == pbook_name {
@@ -78,36 +254,148 @@ func (tb *TaskBuilder) Undo(pbook_name string) error {
 		}
 		if !wasinstalled {
 			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Such playbook exists, but didn't finish installing! Removing!"}
-			DeletePlaybookDB(tb.serv.playbookDB, curpb)
+			tb.serv.DeletePlaybookDB(curpb)
 			return ctx
 		}
-		if !curpb.Lock("Undo") {
-			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Playbook is being processed at the moment (reason: " + curpb.GetLockReason() + ")!"}
-			return ctx
-		}
-		err := UpdatePlaybookDB(tb.serv.playbookDB, curpb)
+		curpb.MarkBusy("Undo")
+		err := tb.serv.UpdatePlaybookDB(curpb)
 		if err != nil {
 			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed updating playbook in db: " + err.Error()}
 			return ctx
 		}
 		tb.serv.UpdateUpdaterTable()
-		ctx = context.WithValue(ctx, "playbook", curpb)
+		ctx = executor.Set(ctx, "playbook", curpb)
 		return ctx
 	}))
 	tb.exec.AddStep(executor.NewStep(rpc.UNDO_STEP_DNS, tb.serv.StepUpdatePlaybook))
-	tb.exec.AddStep(executor.NewStep(rpc.UNDO_STEP_DNS, tb.serv.StepUndoDNS))
-	tb.exec.AddStep(executor.NewStep(rpc.UNDO_STEP_ROUTES, tb.serv.StepUndoRoutes))
+	tb.exec.AddStep(executor.NewStep(rpc.UNDO_STEP_DNS, tb.serv.StepUndoDNS).Retry(adapterRetry))
+	tb.exec.AddStep(executor.NewStep(rpc.UNDO_STEP_ROUTES, tb.serv.StepUndoRoutes).Retry(adapterRetry))
 	tb.exec.AddStep(executor.NewStep("finalize", func(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
 		curpb := ctx.Value("playbook").(*playbook.Playbook)
-		err := DeletePlaybookDB(tb.serv.playbookDB, curpb)
+		err := tb.serv.DeletePlaybookDB(curpb)
 		if err != nil {
 			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed removing playbook from db: " + err.Error()}
+			return ctx
+		}
+		if tb.serv.dnsproxy != nil { // Only now, proxy keeps routing answers for playbook while it's in db.
+			tb.serv.dnsproxy.Untrack(curpb.Name)
 		}
 		return ctx
 	}))
 	return nil
 }
 
+// Re-resolve hosts of an already installed playbook and push what changed (apply steps only push the difference anyway). This is what autoupdater runs.
+// With hosts given only those get re-resolved (TTL driven refresh), otherwise all of them.
+func (tb *TaskBuilder) Refresh(pbook_name string, hosts []string) error {
+	tb.tx = NewTransaction(nil, nil) // Filled in by prep, once playbook is ours.
+	tb.journaled, tb.task, tb.pbname = true, rpc.TASK_REFRESH, pbook_name
+	tb.lockInstalled(pbook_name)
+	tb.exec.SetContext(context.WithValue(context.Background(), "transaction", tb.tx))
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_PREP_CTX, func(updates chan *executor.ExecutorUpdate, ctx context.Context) context.Context {
+		curpb, ok := tb.serv.playbooks()[pbook_name]
+		if !ok || !curpb.GetInstallState() {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "No such playbook " + pbook_name + " installed!"}
+			return ctx
+		}
+		previous := curpb.Clone()
+		curpb.MarkBusy("Refresh")
+		tb.tx.Playbook, tb.tx.Previous = curpb, previous
+		err := tb.serv.UpdatePlaybookDB(curpb)
+		if err != nil {
+			updates <- &executor.ExecutorUpdate{CurrentStep: rpc.STEP_ERROR, StepMessage: "Failed updating playbook in db: " + err.Error()}
+			return ctx
+		}
+		tb.serv.UpdateUpdaterTable()
+		ctx = executor.Set(ctx, "playbook", curpb)
+		if hosts != nil {
+			ctx = executor.Set(ctx, "only_hosts", hosts)
+		}
+		return ctx
+	}))
+	fetch := executor.NewStep(rpc.STEP_FETCHIP, tb.serv.StepFetchIPs).Retry(adapterRetry)
+	tb.exec.AddStep(fetch)
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_DNS, tb.serv.StepApplyDNS).After(fetch).Retry(adapterRetry))
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_ROUTES, tb.serv.StepApplyRoutes).After(fetch).Retry(adapterRetry))
+	tb.exec.AddStep(executor.NewStep(rpc.STEP_ROUTES, tb.serv.StepFinalizePlaybook))
+	return nil
+}
+
+// Collects garbage routes and DNS records no installed playbook owns. Only lists them, unless first arg is "delete".
+// Adapters are those of playbooks in db, plus of playbook yaml given as second arg (for when db is gone, and so is everything it knew).
+func (tb *TaskBuilder) GC(argv []string) error {
+	if len(argv) > 2 || (argv[0] != "dry" && argv[0] != "delete") {
+		return errors.New("expected \"dry\" or \"delete\", and optionally a playbook")
+	}
+	pbooks := make([]*playbook.Playbook, 0)
+	for _, pbook := range tb.serv.playbooks() {
+		pbooks = append(pbooks, pbook)
+	}
+	if len(argv) == 2 {
+		pbook, err := playbook.Parse(argv[1])
+		if err != nil {
+			return err
+		}
+		if err := tb.serv.applyProfile(pbook); err != nil {
+			return err
+		}
+		pbooks = append(pbooks, pbook)
+	}
+	// Endpoint locks only: playbook that is being applied right now holds them, so it's half done routes don't look like garbage.
+	routeTargets, dnsTargets := gcTargets(pbooks)
+	for ep := range routeTargets {
+		tb.lock("routes/" + ep)
+	}
+	for ep := range dnsTargets {
+		tb.lock("dns/" + ep)
+	}
+	ctx := context.WithValue(context.Background(), "gc_playbooks", pbooks)
+	ctx = context.WithValue(ctx, "gc_delete", argv[0] == "delete")
+	tb.task = rpc.TASK_GC
+	tb.exec.SetContext(ctx)
+	tb.exec.AddStep(executor.NewStep(rpc.GC_STEP_ROUTES, tb.serv.StepGCRoutes).Retry(adapterRetry))
+	tb.exec.AddStep(executor.NewStep(rpc.GC_STEP_DNS, tb.serv.StepGCDNS).Retry(adapterRetry))
+	return nil
+}
+
+// Puts back routes and records that went missing from adapters (see drift.go). Same as refresh of no hosts: addresses playbook already has get pushed again.
+func (tb *TaskBuilder) Repair(pbook_name string) error {
+	err := tb.Refresh(pbook_name, []string{})
+	tb.task = rpc.TASK_REPAIR
+	return err
+}
+
+// Adds locks task needs, skipping ones it has already.
+func (tb *TaskBuilder) lock(names ...string) {
+	for _, name := range names {
+		if !slices.Contains(tb.locks, name) {
+			tb.locks = append(tb.locks, name)
+		}
+	}
+}
+
+// Locks of playbook as it's installed now. Just the playbook one if there's no such playbook, prep step will complain about it anyway.
+func (tb *TaskBuilder) lockInstalled(pbook_name string) {
+	if pbook, ok := tb.serv.playbooks()[pbook_name]; ok {
+		tb.lock(PlaybookLocks(pbook)...)
+	} else {
+		tb.lock(PlaybookLock(pbook_name))
+	}
+}
+
 func (tb *TaskBuilder) Build() *executor.Executor {
 	return tb.exec
 }
+
+// Builds an executor that reverses what the task managed to change before failing. nil if task isn't something that can be rolled back.
+func (tb *TaskBuilder) BuildRollback() *executor.Executor {
+	if tb.tx == nil {
+		return nil
+	}
+	ex := executor.NewExecutor()
+	ex.SetContext(context.WithValue(context.Background(), "transaction", tb.tx))
+	ex.AddStep(executor.NewStep(rpc.ROLLBACK_STEP_ROUTES, tb.serv.StepRollbackRoutes))
+	ex.AddStep(executor.NewStep(rpc.ROLLBACK_STEP_DNS, tb.serv.StepRollbackDNS).After())
+	ex.AddStep(executor.NewStep(rpc.ROLLBACK_STEP_PLAYBOOK, tb.serv.StepRollbackPlaybook))
+	return ex
+}
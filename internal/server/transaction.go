@@ -0,0 +1,98 @@
+package server
+
+import (
+	"sync"
+
+	dnsadapters "github.com/sergds/autovpn2/internal/adapters/dns"
+	"github.com/sergds/autovpn2/internal/adapters/routes"
+	"github.com/sergds/autovpn2/internal/playbook"
+)
+
+// Everything a job changed on adapters so far, in order. If the job fails, it all gets reversed (see StepRollback*).
+type Transaction struct {
+	Playbook *playbook.Playbook // Whose adapters were used.
+	Previous *playbook.Playbook // Revision to put back into db on rollback. nil means there was none, so playbook gets removed.
+	Routes   []RouteChange
+	Records  []RecordChange
+	mu       sync.Mutex
+	onchange func()
+}
+
+type RouteChange struct {
+	Added    bool // false means removed
+	Route    routes.Route
+	Previous bool // Made on Previous' adapters (playbook moved away from them), not Playbook's.
+}
+
+type RecordChange struct {
+	Added    bool // false means removed
+	Record   dnsadapters.DNSRecord
+	Previous bool // Same as RouteChange's.
+}
+
+func NewTransaction(pbook *playbook.Playbook, previous *playbook.Playbook) *Transaction {
+	return &Transaction{Playbook: pbook, Previous: previous, Routes: make([]RouteChange, 0), Records: make([]RecordChange, 0)}
+}
+
+func (t *Transaction) RouteAdded(r routes.Route) {
+	t.record(func() { t.Routes = append(t.Routes, RouteChange{Added: true, Route: r}) })
+}
+
+func (t *Transaction) RouteRemoved(r routes.Route) {
+	t.record(func() { t.Routes = append(t.Routes, RouteChange{Added: false, Route: r}) })
+}
+
+// Route removed from router playbook used before, see StepLeaveRoutes.
+func (t *Transaction) PreviousRouteRemoved(r routes.Route) {
+	t.record(func() { t.Routes = append(t.Routes, RouteChange{Added: false, Route: r, Previous: true}) })
+}
+
+func (t *Transaction) RecordAdded(r dnsadapters.DNSRecord) {
+	t.record(func() { t.Records = append(t.Records, RecordChange{Added: true, Record: r}) })
+}
+
+func (t *Transaction) RecordRemoved(r dnsadapters.DNSRecord) {
+	t.record(func() { t.Records = append(t.Records, RecordChange{Added: false, Record: r}) })
+}
+
+func (t *Transaction) PreviousRecordRemoved(r dnsadapters.DNSRecord) {
+	t.record(func() { t.Records = append(t.Records, RecordChange{Added: false, Record: r, Previous: true}) })
+}
+
+// Set a hook that gets called after every recorded change. Journal uses it to get changes to disk before the next one happens.
+func (t *Transaction) SetChangeHook(f func()) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onchange = f
+}
+
+func (t *Transaction) record(change func()) {
+	if t == nil { // Job isn't transactional
+		return
+	}
+	t.mu.Lock()
+	change()
+	hook := t.onchange
+	t.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+}
+
+// Copies of change lists, newest first. That's the order to undo them in.
+func (t *Transaction) reversed() ([]RouteChange, []RecordChange) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rc := make([]RouteChange, 0, len(t.Routes))
+	for i := len(t.Routes) - 1; i >= 0; i-- {
+		rc = append(rc, t.Routes[i])
+	}
+	dc := make([]RecordChange, 0, len(t.Records))
+	for i := len(t.Records) - 1; i >= 0; i-- {
+		dc = append(dc, t.Records[i])
+	}
+	return rc, dc
+}